@@ -0,0 +1,184 @@
+package main
+
+// 应用层 WARP API 校验：api 模式下 TCP 与 TLS 有回应并不代表该地址真的承载 api.cloudflareclient.com，
+// 京东云等合作方节点可能把请求转给别的后端。握手完成后在同一 uTLS 连接上发送真实的 HTTP 请求
+// (h2 或 HTTP/1.1，按 ALPN)，只有返回 Cloudflare API JSON 信封的 endpoint 才适合作为
+// WARP_OVERRIDE_API_ENDPOINT。
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	utls "github.com/refraction-networking/utls"
+	"golang.org/x/net/http2"
+)
+
+// apiDefaultPath 为无需注册即可访问的客户端配置接口。
+const apiDefaultPath = "/v0a2158/client_config"
+
+const (
+	apiUserAgent     = "okhttp/3.12.1"
+	apiClientVersion = "a-6.30-3596"
+	// apiMaxBody 为读取响应体的上限，API 信封远小于此。
+	apiMaxBody = 64 << 10
+)
+
+// API 校验结果，按可信程度从低到高排列。
+const (
+	apiNoTLS        = "no-tls"        // 没有一轮完成 TLS 握手，未发送请求
+	apiTimeout      = "timeout"       // 请求发出后无响应
+	apiReset        = "reset"         // 请求发出后连接或 stream 被重置 / 关闭
+	apiWrongBackend = "wrong-backend" // 有 HTTP 响应，但不是 WARP API
+	apiOK           = "ok"            // 返回 Cloudflare API JSON 信封
+)
+
+var apiOutcomeRank = map[string]int{apiNoTLS: 0, apiTimeout: 1, apiReset: 2, apiWrongBackend: 3, apiOK: 4}
+
+// APIOptions controls the application-level check of the HTTPS probe.
+type APIOptions struct {
+	Action checkAction
+	// Path 为空时为 apiDefaultPath。
+	Path string
+}
+
+func (opts APIOptions) enabled() bool {
+	return opts.Action != "" && opts.Action != checkOff
+}
+
+func (opts APIOptions) path() string {
+	if opts.Path == "" {
+		return apiDefaultPath
+	}
+	return opts.Path
+}
+
+// ParseAPIOptions 解析 -api-check / -api-path。
+func ParseAPIOptions(action, path string) (APIOptions, error) {
+	opts := APIOptions{Path: strings.TrimSpace(path)}
+	var err error
+	if opts.Action, err = parseCheckAction("api check", action); err != nil {
+		return APIOptions{}, err
+	}
+	if opts.Path != "" && !strings.HasPrefix(opts.Path, "/") {
+		return APIOptions{}, fmt.Errorf("invalid api path %q: must start with /", path)
+	}
+	return opts, nil
+}
+
+// APIResult is the outcome of one HTTP request to the WARP API over the probed connection.
+type APIResult struct {
+	Outcome string
+	// Status 为 HTTP 状态码，没有响应时为 0。
+	Status int
+	// Response 为请求发出到响应头到达的耗时。
+	Response time.Duration
+	Err      error
+}
+
+func (result APIResult) String() string {
+	text := "api=" + result.Outcome
+	if result.Status != 0 {
+		text += fmt.Sprintf(" status=%d response=%s", result.Status, result.Response.Round(time.Microsecond))
+	}
+	if result.Err != nil {
+		text += fmt.Sprintf(" err=%v", result.Err)
+	}
+	return text
+}
+
+// apiEnvelope 为 Cloudflare API 的统一响应格式 ({"result":..,"success":..,"errors":[..]})，
+// 错误响应 (如 404) 同样带 success 字段，也算 API 有回应。
+type apiEnvelope struct {
+	Success *bool `json:"success"`
+}
+
+// requestWARPAPI 在已完成握手的连接上发送 GET path 并归类响应。Host 固定为 api.cloudflareclient.com，
+// 与握手所用的 SNI (api 地址池为 zero-trust-client) 无关。
+func requestWARPAPI(ctx context.Context, conn *utls.UConn, path string) APIResult {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://"+DefaultSNI+path, nil)
+	if err != nil {
+		return APIResult{Outcome: apiWrongBackend, Err: err}
+	}
+	req.Header.Set("User-Agent", apiUserAgent)
+	req.Header.Set("CF-Client-Version", apiClientVersion)
+	req.Header.Set("Accept", "application/json")
+
+	start := time.Now()
+	var resp *http.Response
+	if conn.ConnectionState().NegotiatedProtocol == http2.NextProtoTLS {
+		var clientConn *http2.ClientConn
+		if clientConn, err = (&http2.Transport{}).NewClientConn(conn); err == nil {
+			defer clientConn.Close()
+			resp, err = clientConn.RoundTrip(req)
+		}
+	} else {
+		req.Header.Set("Connection", "close")
+		if err = req.Write(conn); err == nil {
+			resp, err = http.ReadResponse(bufio.NewReader(conn), req)
+		}
+	}
+	if err != nil {
+		return APIResult{Outcome: classifyAPIError(err), Err: err}
+	}
+	defer resp.Body.Close()
+	result := APIResult{Status: resp.StatusCode, Response: time.Since(start)}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, apiMaxBody))
+	var envelope apiEnvelope
+	switch {
+	case err != nil:
+		result.Outcome, result.Err = apiWrongBackend, fmt.Errorf("read body: %w", err)
+	case json.Unmarshal(body, &envelope) != nil || envelope.Success == nil:
+		result.Outcome, result.Err = apiWrongBackend, fmt.Errorf("not a warp api response (content-type %q)", resp.Header.Get("Content-Type"))
+	default:
+		result.Outcome = apiOK
+	}
+	return result
+}
+
+// classifyAPIError 区分请求后的重置、超时与非 HTTP 应答。
+func classifyAPIError(err error) string {
+	var streamErr http2.StreamError
+	var goAway http2.GoAwayError
+	switch {
+	case isTimeoutError(err):
+		return apiTimeout
+	case isResetError(err), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF),
+		errors.As(err, &streamErr), errors.As(err, &goAway):
+		return apiReset
+	default:
+		return apiWrongBackend
+	}
+}
+
+// bestAPIResult 在多轮结果中取最可信的一次；没有任何一轮发出请求时为 no-tls。
+func bestAPIResult(results []APIResult) *APIResult {
+	best := APIResult{Outcome: apiNoTLS}
+	for _, result := range results {
+		if apiOutcomeRank[result.Outcome] >= apiOutcomeRank[best.Outcome] {
+			best = result
+		}
+	}
+	return &best
+}
+
+// ExcludeNonAPI 剔除做过 API 校验但未返回 WARP API 响应的结果。
+func ExcludeNonAPI(results []ProbeResult) []ProbeResult {
+	kept := results[:0]
+	for _, result := range results {
+		if result.API == nil || result.API.Outcome == apiOK {
+			kept = append(kept, result)
+		}
+	}
+	return kept
+}
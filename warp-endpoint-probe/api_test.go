@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParseAPIOptions(t *testing.T) {
+	testCases := []struct {
+		action  string
+		path    string
+		want    APIOptions
+		wantErr bool
+	}{
+		{action: "", want: APIOptions{Action: checkOff}},
+		{action: "Exclude", path: apiDefaultPath, want: APIOptions{Action: checkExclude, Path: apiDefaultPath}},
+		{action: "mark", path: " /cdn-cgi/trace ", want: APIOptions{Action: checkMark, Path: "/cdn-cgi/trace"}},
+		{action: "drop", wantErr: true},
+		{action: "mark", path: "client_config", wantErr: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.action+tc.path, func(t *testing.T) {
+			opts, err := ParseAPIOptions(tc.action, tc.path)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got %+v", opts)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if opts != tc.want {
+				t.Fatalf("unexpected options: got=%+v want=%+v", opts, tc.want)
+			}
+		})
+	}
+}
+
+func TestProbeHTTPSAPI(t *testing.T) {
+	var edges []SimEdge
+	for _, spec := range []string{
+		"https@127.0.0.1:0",
+		"https@127.0.0.1:0,mode=wrong-backend",
+		"https@127.0.0.1:0,mode=hangup",
+		"https@127.0.0.1:0,mode=stall",
+	} {
+		edge, err := ParseSimEdge(spec, SimEdge{})
+		if err != nil {
+			t.Fatalf("parse %s: %v", spec, err)
+		}
+		edges = append(edges, edge)
+	}
+	var wgKey [32]byte
+	sim, err := StartSimulator(edges, wgKey)
+	if err != nil {
+		t.Fatalf("start simulator: %v", err)
+	}
+	defer sim.Close()
+
+	// Chrome 指纹协商 h2，Go 指纹不带 ALPN，走 HTTP/1.1
+	goFingerprint, _ := ParseFingerprint(fingerprintGo)
+	check := APIOptions{Action: checkExclude}
+	testCases := []struct {
+		name        string
+		edge        int
+		opts        ProbeOptions
+		wantOutcome string
+		wantStatus  int
+	}{
+		{name: "api_h2", edge: 0, opts: ProbeOptions{API: check}, wantOutcome: apiOK, wantStatus: 200},
+		{name: "api_http1", edge: 0, opts: ProbeOptions{API: check, Fingerprint: goFingerprint}, wantOutcome: apiOK, wantStatus: 200},
+		{name: "api_not_found", edge: 0, opts: ProbeOptions{API: APIOptions{Action: checkMark, Path: "/v0a2158/reg"}}, wantOutcome: apiOK, wantStatus: 404},
+		{name: "wrong_backend", edge: 1, opts: ProbeOptions{API: check}, wantOutcome: apiWrongBackend, wantStatus: 403},
+		{name: "wrong_backend_http1", edge: 1, opts: ProbeOptions{API: check, Fingerprint: goFingerprint}, wantOutcome: apiWrongBackend, wantStatus: 403},
+		{name: "hangup", edge: 2, opts: ProbeOptions{API: check}, wantOutcome: apiReset},
+		{name: "hangup_http1", edge: 2, opts: ProbeOptions{API: check, Fingerprint: goFingerprint}, wantOutcome: apiReset},
+		{name: "stall", edge: 3, opts: ProbeOptions{API: check}, wantOutcome: apiNoTLS},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result := probeWithRounds(context.Background(), simEndpoint(t, sim.Edges[tc.edge]), 500*time.Millisecond, 2, tc.opts)
+			if result.API == nil || result.API.Outcome != tc.wantOutcome || result.API.Status != tc.wantStatus {
+				t.Fatalf("unexpected api result: %v", result.API)
+			}
+			if !slices.Contains(result.Tags(), "api="+tc.wantOutcome) {
+				t.Fatalf("missing api tag: %v", result.Tags())
+			}
+		})
+	}
+
+	// 未开启校验时不发送请求
+	if result := probeWithRounds(context.Background(), simEndpoint(t, sim.Edges[1]), 500*time.Millisecond, 1, ProbeOptions{}); result.API != nil {
+		t.Fatalf("api checked while off: %v", result.API)
+	}
+}
+
+func TestBestAPIResult(t *testing.T) {
+	best := bestAPIResult([]APIResult{{Outcome: apiOK, Status: 200}, {Outcome: apiReset}, {Outcome: apiWrongBackend, Status: 403}})
+	if best.Outcome != apiOK || best.Status != 200 {
+		t.Fatalf("unexpected best result: %v", best)
+	}
+	if best := bestAPIResult(nil); best.Outcome != apiNoTLS {
+		t.Fatalf("unexpected empty result: %v", best)
+	}
+}
@@ -0,0 +1,428 @@
+package main
+
+// 对最终几个候选建立用户态 WireGuard 隧道 (wireguard-go + gVisor netstack，无需 TUN 与特权；
+// MASQUE 候选见 masque_tunnel.go)，
+// 经隧道下载或上传配置的 URL，测量吞吐、首字节时间，并在传输期间发送 ICMP echo 统计丢包。
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun/netstack"
+)
+
+const (
+	// benchmarkMTU 与 WARP 客户端默认 MTU 一致。
+	benchmarkMTU = 1280
+	// 传输期间发送的 ICMP echo 数量与间隔。
+	benchmarkPings        = 10
+	benchmarkPingInterval = 200 * time.Millisecond
+	// benchmarkDefaultDuration 用于未设置 Duration 的调用方。
+	benchmarkDefaultDuration = 10 * time.Second
+	// benchmarkSetupTimeout 限制握手、建连与等待首字节 (上传时为请求体首次被读取，以及上传结束后等待响应)，
+	// 不占用传输窗口。
+	benchmarkSetupTimeout = 10 * time.Second
+	// benchmarkDrainDelay 为截断下载后拆除隧道前的等待：对端收到 RST 前仍在发送，
+	// 迟到的数据段由 netstack 回复 RST，等其停止后再关闭 tun。
+	benchmarkDrainDelay = 500 * time.Millisecond
+)
+
+// BenchmarkOptions configures the tunnel throughput benchmark.
+type BenchmarkOptions struct {
+	URL string
+	// UploadBytes > 0 时以 POST 上传该大小的数据，否则 GET 下载。
+	UploadBytes int64
+	// Duration 为传输窗口：从首字节 (上传时为请求体首次被读取) 起算，超时后按已传输字节计算。
+	// <= 0 时使用 benchmarkDefaultDuration。
+	Duration time.Duration
+	// PingTarget 为隧道内 ICMP echo 目标，用于统计丢包。
+	PingTarget netip.Addr
+	// DNS 为 netstack 解析 URL 主机名使用的服务器。
+	DNS netip.Addr
+}
+
+// BenchmarkResult is the outcome of one tunnel benchmark.
+type BenchmarkResult struct {
+	Endpoint string
+	Upload   bool
+	// TTFB 仅下载：请求发出到响应首字节。
+	TTFB time.Duration
+	// FirstRead 仅上传：请求发出到请求体首次被读取 (握手与建连已完成)。
+	FirstRead time.Duration
+	// Bytes 为实际传输的字节数，上传时为请求体实际被读出的字节数。
+	Bytes        int64
+	Transfer     time.Duration
+	PingSent     int
+	PingReceived int
+}
+
+// Mbps returns the transfer rate in megabits per second.
+func (r BenchmarkResult) Mbps() float64 {
+	if r.Transfer <= 0 {
+		return 0
+	}
+	return float64(r.Bytes) * 8 / r.Transfer.Seconds() / 1e6
+}
+
+// Loss returns the fraction of in-tunnel echoes without a reply.
+func (r BenchmarkResult) Loss() float64 {
+	if r.PingSent == 0 {
+		return 0
+	}
+	return float64(r.PingSent-r.PingReceived) / float64(r.PingSent)
+}
+
+func (r BenchmarkResult) String() string {
+	if r.Upload {
+		return fmt.Sprintf("up=%.1fMbps first-read=%s bytes=%d loss=%.0f%%",
+			r.Mbps(), r.FirstRead.Round(time.Millisecond), r.Bytes, r.Loss()*100)
+	}
+	return fmt.Sprintf("down=%.1fMbps ttfb=%s bytes=%d loss=%.0f%%",
+		r.Mbps(), r.TTFB.Round(time.Millisecond), r.Bytes, r.Loss()*100)
+}
+
+// RunTunnelBenchmark 建立到 endpoint 的用户态隧道并执行一次传输测试。
+func RunTunnelBenchmark(ctx context.Context, endpoint Endpoint, identity WireGuardIdentity, opts BenchmarkOptions) (BenchmarkResult, error) {
+	result := BenchmarkResult{Endpoint: endpoint.Address(), Upload: opts.UploadBytes > 0}
+	if identity.PrivateKey == nil {
+		return result, errDataPlaneNoKey
+	}
+	if len(identity.Addresses) == 0 {
+		return result, errDataPlaneNoAddress
+	}
+
+	var dns []netip.Addr
+	if opts.DNS.IsValid() {
+		dns = append(dns, opts.DNS)
+	}
+	tunDevice, tnet, err := netstack.CreateNetTUN(identity.Addresses, dns, benchmarkMTU)
+	if err != nil {
+		return result, fmt.Errorf("create netstack: %w", err)
+	}
+	bind := &reservedBind{Bind: conn.NewDefaultBind(), reserved: identity.Reserved}
+	dev := device.NewDevice(tunDevice, bind, device.NewLogger(device.LogLevelSilent, ""))
+	defer func() {
+		// 先 Down 停止收包再关闭 tun，避免 netstack 在 Close 后继续写入已关闭的 channel
+		_ = dev.Down()
+		dev.Close()
+	}()
+
+	if err := dev.IpcSet(benchmarkIpcConfig(endpoint, identity)); err != nil {
+		return result, fmt.Errorf("configure wireguard device: %w", err)
+	}
+	if err := dev.Up(); err != nil {
+		return result, fmt.Errorf("bring up wireguard device: %w", err)
+	}
+
+	err = runNetstackBenchmark(ctx, tnet, identity.Addresses, opts, &result)
+	return result, err
+}
+
+// runNetstackBenchmark 在已连通的 netstack 上执行传输测试，并在传输期间发送 ICMP echo。
+func runNetstackBenchmark(ctx context.Context, tnet *netstack.Net, addresses []netip.Addr, opts BenchmarkOptions, result *BenchmarkResult) error {
+	if opts.Duration <= 0 {
+		opts.Duration = benchmarkDefaultDuration
+	}
+
+	var wg sync.WaitGroup
+	transferDone := make(chan struct{})
+	if source, ok := sourceAddressFor(addresses, opts.PingTarget); ok && opts.PingTarget.IsValid() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result.PingSent, result.PingReceived = benchmarkPing(ctx, tnet, source, opts.PingTarget, transferDone)
+		}()
+	}
+
+	transferErr := benchmarkTransfer(ctx, tnet, opts, result)
+	close(transferDone)
+	wg.Wait()
+	return transferErr
+}
+
+// benchmarkIpcConfig 生成 wireguard-go UAPI 配置 (key 为 hex 编码)。
+func benchmarkIpcConfig(endpoint Endpoint, identity WireGuardIdentity) string {
+	var config strings.Builder
+	fmt.Fprintf(&config, "private_key=%s\n", hex.EncodeToString(identity.PrivateKey[:]))
+	fmt.Fprintf(&config, "public_key=%s\n", hex.EncodeToString(identity.PeerPublic[:]))
+	if identity.PresharedKey != ([32]byte{}) {
+		fmt.Fprintf(&config, "preshared_key=%s\n", hex.EncodeToString(identity.PresharedKey[:]))
+	}
+	fmt.Fprintf(&config, "endpoint=%s\n", endpoint.Address())
+	config.WriteString("allowed_ip=0.0.0.0/0\nallowed_ip=::/0\n")
+	return config.String()
+}
+
+func benchmarkTransfer(ctx context.Context, tnet *netstack.Net, opts BenchmarkOptions, result *BenchmarkResult) error {
+	client := &http.Client{Transport: &http.Transport{
+		DialContext:       tnet.DialContext,
+		DisableKeepAlives: true,
+	}}
+
+	transferCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	window := newTransferWindow(cancel)
+	defer window.stop()
+
+	method := http.MethodGet
+	var upload *uploadBody
+	var body io.Reader
+	if result.Upload {
+		method = http.MethodPost
+		// 上传窗口到期后请求体提前结束，因此不设置 ContentLength (chunked)；
+		// 之后再留出 benchmarkSetupTimeout 等待服务端响应。
+		upload = &uploadBody{
+			Reader: io.LimitReader(zeroReader{}, opts.UploadBytes),
+			limit:  opts.Duration,
+			onFirst: func() {
+				window.start(opts.Duration + benchmarkSetupTimeout)
+			},
+		}
+		body = upload
+	}
+	request, err := http.NewRequestWithContext(transferCtx, method, opts.URL, body)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	response, err := client.Do(request)
+	if result.Upload {
+		first, read := upload.stats()
+		if first.IsZero() {
+			first = start
+		}
+		result.Bytes, result.FirstRead = read, first.Sub(start)
+		result.Transfer = time.Since(first)
+		// 等待响应超时：保留已发送的字节数
+		if err != nil && window.expired() && read > 0 {
+			return nil
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("benchmark request: %w", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= 400 {
+		return fmt.Errorf("benchmark request: HTTP %s", response.Status)
+	}
+	if result.Upload {
+		return nil
+	}
+
+	buf := make([]byte, 64*1024)
+	n, err := response.Body.Read(buf)
+	firstByte := time.Now()
+	window.start(opts.Duration)
+	result.TTFB = firstByte.Sub(start)
+	result.Bytes = int64(n)
+	for err == nil {
+		n, err = response.Body.Read(buf)
+		result.Bytes += int64(n)
+	}
+	result.Transfer = time.Since(firstByte)
+	if window.expired() {
+		_ = response.Body.Close()
+		select {
+		case <-ctx.Done():
+		case <-time.After(benchmarkDrainDelay):
+		}
+		return nil
+	}
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+	return fmt.Errorf("benchmark download: %w", err)
+}
+
+// transferWindow 在建连阶段最长等待 benchmarkSetupTimeout，start 之后改为传输窗口；
+// 到期时取消请求，expired 区分传输窗口到期 (保留已传输字节) 与建连超时。
+type transferWindow struct {
+	timer    *time.Timer
+	started  atomic.Bool
+	finished atomic.Bool
+}
+
+func newTransferWindow(cancel context.CancelFunc) *transferWindow {
+	window := &transferWindow{}
+	window.timer = time.AfterFunc(benchmarkSetupTimeout, func() {
+		window.finished.Store(window.started.Load())
+		cancel()
+	})
+	return window
+}
+
+// start 开始传输窗口，只有第一次调用生效。
+func (w *transferWindow) start(d time.Duration) {
+	if w.started.CompareAndSwap(false, true) {
+		w.timer.Reset(d)
+	}
+}
+
+func (w *transferWindow) expired() bool { return w.finished.Load() }
+
+func (w *transferWindow) stop() { w.timer.Stop() }
+
+// benchmarkPing 在传输期间按间隔发送 ICMP echo，返回发送与收到的数量。
+func benchmarkPing(ctx context.Context, tnet *netstack.Net, source, target netip.Addr, transferDone <-chan struct{}) (sent, received int) {
+	network := "ping4"
+	if target.Is6() {
+		network = "ping6"
+	}
+	socket, err := tnet.DialContext(ctx, network, target.String())
+	if err != nil {
+		return 0, 0
+	}
+	defer socket.Close()
+
+	buf := make([]byte, 1500)
+	for seq := 1; seq <= benchmarkPings; seq++ {
+		if ctx.Err() != nil {
+			break
+		}
+		start := time.Now()
+		// netstack 的 ping socket 只收发 ICMP 报文本身
+		request := buildEchoRequest(source, target, 0, uint16(seq))
+		if _, err := socket.Write(request[len(request)-echoSegmentSize:]); err != nil {
+			break
+		}
+		sent++
+		_ = socket.SetDeadline(start.Add(benchmarkPingInterval * 5))
+		for {
+			n, err := socket.Read(buf)
+			if err != nil {
+				break
+			}
+			if n >= 8 && (buf[0] == 0 || buf[0] == 129) && binary.BigEndian.Uint16(buf[6:8]) == uint16(seq) {
+				received++
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return sent, received
+		case <-transferDone:
+			if seq >= 3 {
+				return sent, received
+			}
+		case <-time.After(time.Until(start.Add(benchmarkPingInterval))):
+		}
+	}
+	return sent, received
+}
+
+// reservedBind 在发出的 WireGuard 报文中写入 WARP client ID (bytes 1-3)，
+// 并在收到的报文交给 wireguard-go 前清零，以兼容其严格的消息头校验。
+type reservedBind struct {
+	conn.Bind
+	reserved [3]byte
+}
+
+func (b *reservedBind) Open(port uint16) ([]conn.ReceiveFunc, uint16, error) {
+	fns, actual, err := b.Bind.Open(port)
+	if err != nil {
+		return nil, 0, err
+	}
+	wrapped := make([]conn.ReceiveFunc, len(fns))
+	for i, fn := range fns {
+		wrapped[i] = func(packets [][]byte, sizes []int, eps []conn.Endpoint) (int, error) {
+			n, err := fn(packets, sizes, eps)
+			for j := 0; j < n; j++ {
+				if sizes[j] >= 4 {
+					packets[j][1], packets[j][2], packets[j][3] = 0, 0, 0
+				}
+			}
+			return n, err
+		}
+	}
+	return wrapped, actual, nil
+}
+
+func (b *reservedBind) Send(bufs [][]byte, ep conn.Endpoint) error {
+	if b.reserved != ([3]byte{}) {
+		for _, buf := range bufs {
+			if len(buf) >= 4 {
+				copy(buf[1:4], b.reserved[:])
+			}
+		}
+	}
+	return b.Bind.Send(bufs, ep)
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// uploadBody 记录请求体第一次被读取的时间与实际读出的字节数，读取超过 limit 后提前结束。
+// http.Transport 在自己的 goroutine 中读取请求体，因此加锁。
+type uploadBody struct {
+	io.Reader
+	limit   time.Duration
+	onFirst func()
+	mu      sync.Mutex
+	first   time.Time
+	read    int64
+}
+
+func (b *uploadBody) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	if b.first.IsZero() {
+		b.first = time.Now()
+		if b.onFirst != nil {
+			b.onFirst()
+		}
+	}
+	if time.Since(b.first) >= b.limit {
+		b.mu.Unlock()
+		return 0, io.EOF
+	}
+	b.mu.Unlock()
+	n, err := b.Reader.Read(p)
+	b.mu.Lock()
+	b.read += int64(n)
+	b.mu.Unlock()
+	return n, err
+}
+
+func (b *uploadBody) stats() (first time.Time, read int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.first, b.read
+}
+
+// BenchmarkTop 依次对前 topN 个结果做吞吐测试，结果写入 ProbeResult.Throughput 并逐行输出。
+// WireGuard 与 MASQUE endpoint 分别经各自的用户态隧道测试；吞吐测试只作报告，不改变排序。
+func BenchmarkTop(ctx context.Context, results []ProbeResult, endpoints []Endpoint, topN int, probeOpts ProbeOptions, opts BenchmarkOptions, w io.Writer) []ProbeResult {
+	eachTopResult(results, endpoints, topN, func(result *ProbeResult, endpoint Endpoint) {
+		var bench BenchmarkResult
+		var err error
+		if endpoint.Probe == ProbeQUIC {
+			bench, err = RunMASQUEBenchmark(ctx, endpoint, probeOpts, opts)
+		} else {
+			bench, err = RunTunnelBenchmark(ctx, endpoint, probeOpts.WireGuard.identity(), opts)
+		}
+		if err != nil {
+			fmt.Fprintf(w, "Benchmark: %s failed: %v\n", endpoint.Address(), err)
+			return
+		}
+		fmt.Fprintf(w, "Benchmark: %s %s\n", endpoint.Address(), bench)
+		result.Throughput = &bench
+	})
+	return results
+}
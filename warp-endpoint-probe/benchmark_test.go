@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun/netstack"
+)
+
+// startTestPeer 启动一个本地 wireguard-go + netstack 对端，在隧道内 10.9.0.1:80 提供 HTTP。
+func startTestPeer(t *testing.T, clientPub [32]byte, reserved [3]byte) (Endpoint, [32]byte) {
+	t.Helper()
+	serverPriv, _ := randomKey(t)
+	var serverPub [32]byte
+	curve25519.ScalarBaseMult(&serverPub, &serverPriv)
+
+	tunDevice, tnet, err := netstack.CreateNetTUN([]netip.Addr{netip.MustParseAddr("10.9.0.1")}, nil, benchmarkMTU)
+	if err != nil {
+		t.Fatalf("create server netstack: %v", err)
+	}
+	bind := &reservedBind{Bind: conn.NewDefaultBind(), reserved: reserved}
+	dev := device.NewDevice(tunDevice, bind, device.NewLogger(device.LogLevelSilent, ""))
+	t.Cleanup(dev.Close)
+
+	config := fmt.Sprintf("private_key=%s\nlisten_port=0\npublic_key=%s\nallowed_ip=10.9.0.2/32\n",
+		hex.EncodeToString(serverPriv[:]), hex.EncodeToString(clientPub[:]))
+	if err := dev.IpcSet(config); err != nil {
+		t.Fatalf("configure server: %v", err)
+	}
+	if err := dev.Up(); err != nil {
+		t.Fatalf("bring up server: %v", err)
+	}
+	state, err := dev.IpcGet()
+	if err != nil {
+		t.Fatalf("read server state: %v", err)
+	}
+	port := 0
+	for _, line := range strings.Split(state, "\n") {
+		if value, ok := strings.CutPrefix(line, "listen_port="); ok {
+			port, _ = strconv.Atoi(value)
+		}
+	}
+	if port == 0 {
+		t.Fatalf("server has no listen port: %q", state)
+	}
+
+	server, err := serveTunnelHTTP(tnet)
+	if err != nil {
+		t.Fatalf("listen in tunnel: %v", err)
+	}
+	t.Cleanup(func() { _ = server.Close() })
+
+	return Endpoint{IP: "127.0.0.1", Port: port, Probe: ProbeWireGuard}, serverPub
+}
+
+// serveTunnelHTTP 在隧道内 10.9.0.1:80 提供 /down (2 MiB)、/stream (持续下发直到客户端断开)
+// 与 /up (返回收到的字节数)。
+func serveTunnelHTTP(tnet *netstack.Net) (*http.Server, error) {
+	listener, err := tnet.ListenTCPAddrPort(netip.MustParseAddrPort("10.9.0.1:80"))
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/down", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.CopyN(w, zeroReader{}, 2<<20)
+	})
+	mux.HandleFunc("/stream", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(w, zeroReader{})
+	})
+	mux.HandleFunc("/up", func(w http.ResponseWriter, r *http.Request) {
+		n, _ := io.Copy(io.Discard, r.Body)
+		fmt.Fprintf(w, "%d", n)
+	})
+	server := &http.Server{Handler: mux}
+	go func() { _ = server.Serve(listener) }()
+	return server, nil
+}
+
+func TestRunTunnelBenchmark(t *testing.T) {
+	clientPriv, _ := randomKey(t)
+	reserved := [3]byte{7, 8, 9}
+	identity := WireGuardIdentity{PrivateKey: &clientPriv, Reserved: reserved,
+		Addresses: []netip.Addr{netip.MustParseAddr("10.9.0.2")}}
+	clientPub, _ := identity.PublicKey()
+
+	endpoint, serverPub := startTestPeer(t, clientPub, reserved)
+	identity.PeerPublic = serverPub
+
+	testCases := []struct {
+		name     string
+		url      string
+		upload   int64
+		duration time.Duration
+		// partial 表示传输窗口先于传输结束到期，只检查已传输的部分。
+		partial bool
+	}{
+		{name: "download", url: "http://10.9.0.1/down", duration: 5 * time.Second},
+		{name: "upload", url: "http://10.9.0.1/up", upload: 1 << 20, duration: 5 * time.Second},
+		{name: "download window", url: "http://10.9.0.1/stream", duration: 500 * time.Millisecond, partial: true},
+		{name: "upload window", url: "http://10.9.0.1/up", upload: 1 << 40, duration: 500 * time.Millisecond, partial: true},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+			defer cancel()
+			opts := BenchmarkOptions{
+				URL:         testCase.url,
+				UploadBytes: testCase.upload,
+				Duration:    testCase.duration,
+				PingTarget:  netip.MustParseAddr("10.9.0.1"),
+			}
+			result, err := RunTunnelBenchmark(ctx, endpoint, identity, opts)
+			if err != nil {
+				t.Fatalf("benchmark failed: %v", err)
+			}
+			if testCase.partial {
+				if result.Bytes <= 0 || (testCase.upload > 0 && result.Bytes >= testCase.upload) ||
+					result.Transfer > testCase.duration+benchmarkSetupTimeout {
+					t.Fatalf("transfer not cut at the window: %+v", result)
+				}
+			} else {
+				wantBytes := int64(2 << 20)
+				if testCase.upload > 0 {
+					wantBytes = testCase.upload
+				}
+				if result.Bytes != wantBytes {
+					t.Fatalf("unexpected bytes: got=%d want=%d", result.Bytes, wantBytes)
+				}
+			}
+			if result.Mbps() <= 0 || (testCase.upload == 0) != (result.TTFB > 0) || (testCase.upload > 0) != (result.FirstRead > 0) {
+				t.Fatalf("missing measurements: %+v", result)
+			}
+			if result.PingSent == 0 || result.PingReceived == 0 {
+				t.Fatalf("no in-tunnel echo replies: %+v", result)
+			}
+		})
+	}
+}
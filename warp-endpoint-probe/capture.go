@@ -0,0 +1,445 @@
+package main
+
+// pcapng 抓包输出：容器里通常没有 tcpdump，这里在用户态为探测报文
+// 合成 IP/UDP/TCP 头部，写成 Wireshark 可直接打开的 pcapng 文件。
+//
+// Reference: https://www.ietf.org/archive/id/draft-ietf-opsawg-pcapng-03.html
+// 使用 LINKTYPE_RAW (101)，每个报文以 IPv4/IPv6 头开始，
+// 时间戳精度为纳秒，并在 opt_comment 中附带 endpoint 元数据。
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	pcapngBlockSHB = 0x0A0D0D0A
+	pcapngBlockIDB = 0x00000001
+	pcapngBlockEPB = 0x00000006
+
+	pcapngByteOrderMagic = 0x1A2B3C4D
+	pcapngLinkTypeRaw    = 101
+
+	pcapngOptEnd       = 0
+	pcapngOptComment   = 1
+	pcapngOptIfName    = 2
+	pcapngOptIfTsresol = 9
+	pcapngOptUserAppl  = 4
+
+	ipProtoTCP = 6
+	ipProtoUDP = 17
+
+	tcpFlagFIN = 0x01
+	tcpFlagSYN = 0x02
+	tcpFlagRST = 0x04
+	tcpFlagPSH = 0x08
+	tcpFlagACK = 0x10
+)
+
+// PcapWriter records probe traffic into a pcapng file.
+// A nil *PcapWriter is valid and discards everything.
+type PcapWriter struct {
+	mu     sync.Mutex
+	file   *os.File
+	w      *bufio.Writer
+	ipID   uint16
+	err    error
+	closed bool
+}
+
+// CreatePcap creates path and writes the pcapng section and interface headers.
+func CreatePcap(path string) (*PcapWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	p := &PcapWriter{file: f, w: bufio.NewWriter(f)}
+
+	shb := make([]byte, 16)
+	binary.LittleEndian.PutUint32(shb[0:4], pcapngByteOrderMagic)
+	binary.LittleEndian.PutUint16(shb[4:6], 1) // major
+	binary.LittleEndian.PutUint16(shb[6:8], 0) // minor
+	binary.LittleEndian.PutUint64(shb[8:16], ^uint64(0))
+	shb = appendPcapngOption(shb, pcapngOptUserAppl, []byte("warp-endpoint-probe"))
+	shb = appendPcapngOption(shb, pcapngOptEnd, nil)
+	p.writeBlock(pcapngBlockSHB, shb)
+
+	idb := make([]byte, 8)
+	binary.LittleEndian.PutUint16(idb[0:2], pcapngLinkTypeRaw)
+	binary.LittleEndian.PutUint32(idb[4:8], 0) // snaplen: unlimited
+	idb = appendPcapngOption(idb, pcapngOptIfName, []byte("probe"))
+	idb = appendPcapngOption(idb, pcapngOptIfTsresol, []byte{9}) // 10^-9 s
+	idb = appendPcapngOption(idb, pcapngOptEnd, nil)
+	p.writeBlock(pcapngBlockIDB, idb)
+
+	if p.err != nil {
+		_ = f.Close()
+		return nil, p.err
+	}
+	return p, nil
+}
+
+// Close flushes buffered packets and closes the file.
+func (p *PcapWriter) Close() error {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.w.Flush(); err != nil && p.err == nil {
+		p.err = err
+	}
+	if err := p.file.Close(); err != nil && p.err == nil {
+		p.err = err
+	}
+	p.closed = true
+	return p.err
+}
+
+// WriteUDP records one UDP datagram from src to dst.
+func (p *PcapWriter) WriteUDP(ts time.Time, src, dst netip.AddrPort, payload []byte, comment string) {
+	if p == nil {
+		return
+	}
+	src, dst = normalizeAddrPair(src, dst)
+
+	segment := make([]byte, 8+len(payload))
+	binary.BigEndian.PutUint16(segment[0:2], src.Port())
+	binary.BigEndian.PutUint16(segment[2:4], dst.Port())
+	binary.BigEndian.PutUint16(segment[4:6], uint16(len(segment)))
+	copy(segment[8:], payload)
+	checksum := transportChecksum(src.Addr(), dst.Addr(), ipProtoUDP, segment)
+	if checksum == 0 {
+		checksum = 0xffff
+	}
+	binary.BigEndian.PutUint16(segment[6:8], checksum)
+
+	p.writePacket(ts, src.Addr(), dst.Addr(), ipProtoUDP, segment, comment)
+}
+
+func (p *PcapWriter) writeTCP(ts time.Time, src, dst netip.AddrPort, seq, ack uint32, flags uint8, payload []byte, comment string) {
+	if p == nil {
+		return
+	}
+	src, dst = normalizeAddrPair(src, dst)
+
+	segment := make([]byte, 20+len(payload))
+	binary.BigEndian.PutUint16(segment[0:2], src.Port())
+	binary.BigEndian.PutUint16(segment[2:4], dst.Port())
+	binary.BigEndian.PutUint32(segment[4:8], seq)
+	binary.BigEndian.PutUint32(segment[8:12], ack)
+	segment[12] = 5 << 4 // data offset: 20 bytes
+	segment[13] = flags
+	binary.BigEndian.PutUint16(segment[14:16], 65535) // window
+	copy(segment[20:], payload)
+	binary.BigEndian.PutUint16(segment[16:18], transportChecksum(src.Addr(), dst.Addr(), ipProtoTCP, segment))
+
+	p.writePacket(ts, src.Addr(), dst.Addr(), ipProtoTCP, segment, comment)
+}
+
+func (p *PcapWriter) writePacket(ts time.Time, src, dst netip.Addr, proto uint8, segment []byte, comment string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.ipID++
+	packet := buildIPPacket(src, dst, proto, p.ipID, segment)
+
+	nanos := uint64(ts.UnixNano())
+	body := make([]byte, 20, 20+len(packet)+len(comment)+16)
+	binary.LittleEndian.PutUint32(body[0:4], 0) // interface id
+	binary.LittleEndian.PutUint32(body[4:8], uint32(nanos>>32))
+	binary.LittleEndian.PutUint32(body[8:12], uint32(nanos))
+	binary.LittleEndian.PutUint32(body[12:16], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(body[16:20], uint32(len(packet)))
+	body = append(body, packet...)
+	body = append(body, make([]byte, pad4(len(packet)))...)
+	if comment != "" {
+		body = appendPcapngOption(body, pcapngOptComment, []byte(comment))
+		body = appendPcapngOption(body, pcapngOptEnd, nil)
+	}
+	p.writeBlock(pcapngBlockEPB, body)
+}
+
+// buildIPPacket 在 segment 前加上最小的 IPv4 (DF) 或 IPv6 头。
+func buildIPPacket(src, dst netip.Addr, proto uint8, id uint16, segment []byte) []byte {
+	var packet []byte
+	if src.Is4() {
+		packet = make([]byte, 20+len(segment))
+		packet[0] = 0x45
+		binary.BigEndian.PutUint16(packet[2:4], uint16(len(packet)))
+		binary.BigEndian.PutUint16(packet[4:6], id)
+		binary.BigEndian.PutUint16(packet[6:8], 0x4000) // DF
+		packet[8] = 64
+		packet[9] = proto
+		srcBytes, dstBytes := src.As4(), dst.As4()
+		copy(packet[12:16], srcBytes[:])
+		copy(packet[16:20], dstBytes[:])
+		binary.BigEndian.PutUint16(packet[10:12], internetChecksum(0, packet[:20]))
+		copy(packet[20:], segment)
+	} else {
+		packet = make([]byte, 40+len(segment))
+		packet[0] = 0x60
+		binary.BigEndian.PutUint16(packet[4:6], uint16(len(segment)))
+		packet[6] = proto
+		packet[7] = 64
+		srcBytes, dstBytes := src.As16(), dst.As16()
+		copy(packet[8:24], srcBytes[:])
+		copy(packet[24:40], dstBytes[:])
+		copy(packet[40:], segment)
+	}
+	return packet
+}
+
+// writeBlock 写入 type + length + body + length，调用方需持有锁或处于初始化阶段。
+func (p *PcapWriter) writeBlock(blockType uint32, body []byte) {
+	if p.err != nil || p.closed {
+		return
+	}
+	total := uint32(12 + len(body))
+	var header [8]byte
+	binary.LittleEndian.PutUint32(header[0:4], blockType)
+	binary.LittleEndian.PutUint32(header[4:8], total)
+	var trailer [4]byte
+	binary.LittleEndian.PutUint32(trailer[:], total)
+
+	for _, chunk := range [][]byte{header[:], body, trailer[:]} {
+		if _, err := p.w.Write(chunk); err != nil {
+			p.err = err
+			return
+		}
+	}
+}
+
+func appendPcapngOption(buf []byte, code uint16, value []byte) []byte {
+	var header [4]byte
+	binary.LittleEndian.PutUint16(header[0:2], code)
+	binary.LittleEndian.PutUint16(header[2:4], uint16(len(value)))
+	buf = append(buf, header[:]...)
+	buf = append(buf, value...)
+	return append(buf, make([]byte, pad4(len(value)))...)
+}
+
+func pad4(n int) int {
+	return (4 - n%4) % 4
+}
+
+// normalizeAddrPair 去掉 v4-mapped 前缀，并在本地地址族未知
+// (如监听 [::]) 时用对端地址族的零地址代替。
+func normalizeAddrPair(src, dst netip.AddrPort) (netip.AddrPort, netip.AddrPort) {
+	src = netip.AddrPortFrom(src.Addr().Unmap(), src.Port())
+	dst = netip.AddrPortFrom(dst.Addr().Unmap(), dst.Port())
+	if src.Addr().Is4() == dst.Addr().Is4() && src.Addr().IsValid() && dst.Addr().IsValid() {
+		return src, dst
+	}
+	if !src.Addr().IsValid() || src.Addr().IsUnspecified() {
+		src = unspecifiedLike(dst, src.Port())
+	} else {
+		dst = unspecifiedLike(src, dst.Port())
+	}
+	return src, dst
+}
+
+func unspecifiedLike(peer netip.AddrPort, port uint16) netip.AddrPort {
+	if peer.Addr().Is4() {
+		return netip.AddrPortFrom(netip.IPv4Unspecified(), port)
+	}
+	return netip.AddrPortFrom(netip.IPv6Unspecified(), port)
+}
+
+func transportChecksum(src, dst netip.Addr, proto uint8, segment []byte) uint16 {
+	var sum uint32
+	if src.Is4() {
+		srcBytes, dstBytes := src.As4(), dst.As4()
+		sum = checksumAdd(sum, srcBytes[:])
+		sum = checksumAdd(sum, dstBytes[:])
+	} else {
+		srcBytes, dstBytes := src.As16(), dst.As16()
+		sum = checksumAdd(sum, srcBytes[:])
+		sum = checksumAdd(sum, dstBytes[:])
+	}
+	sum += uint32(proto)
+	sum += uint32(len(segment))
+	return internetChecksum(sum, segment)
+}
+
+func checksumAdd(sum uint32, data []byte) uint32 {
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(data[i : i+2]))
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	return sum
+}
+
+func internetChecksum(initial uint32, data []byte) uint16 {
+	sum := checksumAdd(initial, data)
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
+
+// addrPortOf 将 net.Addr 转为 netip.AddrPort，未知类型返回零值。
+func addrPortOf(addr net.Addr) netip.AddrPort {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.AddrPort()
+	case *net.TCPAddr:
+		return a.AddrPort()
+	default:
+		if addr == nil {
+			return netip.AddrPort{}
+		}
+		parsed, _ := netip.ParseAddrPort(addr.String())
+		return parsed
+	}
+}
+
+// captureComment 生成附加在每个报文上的 endpoint 元数据。
+func captureComment(endpoint Endpoint, direction string) string {
+	comment := fmt.Sprintf("%s endpoint=%s probe=%s pool=%s", direction, endpoint.Address(), endpoint.Probe, endpoint.PoolName)
+	if endpoint.PoolCIDR != "" {
+		comment += " cidr=" + endpoint.PoolCIDR
+	}
+	if endpoint.SNI != "" {
+		comment += " sni=" + endpoint.SNI
+	}
+	return comment
+}
+
+// capturePacketConn 包装 UDP socket，记录经过的每个数据报（用于 QUIC）。
+// 刻意只嵌入 net.PacketConn：若暴露 *net.UDPConn 的 ReadMsgUDP，
+// quic-go 会绕过 ReadFrom/WriteTo 直接收发。
+type capturePacketConn struct {
+	net.PacketConn
+	udp      *net.UDPConn
+	capture  *PcapWriter
+	endpoint Endpoint
+}
+
+// 以下方法让 quic-go 仍能调整缓冲区并设置 DF 位。
+
+func (c *capturePacketConn) SetReadBuffer(bytes int) error {
+	return c.udp.SetReadBuffer(bytes)
+}
+
+func (c *capturePacketConn) SetWriteBuffer(bytes int) error {
+	return c.udp.SetWriteBuffer(bytes)
+}
+
+func (c *capturePacketConn) SyscallConn() (syscall.RawConn, error) {
+	return c.udp.SyscallConn()
+}
+
+func (c *capturePacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	if n > 0 {
+		c.capture.WriteUDP(time.Now(), addrPortOf(addr), addrPortOf(c.LocalAddr()), b[:n], captureComment(c.endpoint, "in"))
+	}
+	return n, addr, err
+}
+
+func (c *capturePacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.capture.WriteUDP(time.Now(), addrPortOf(c.LocalAddr()), addrPortOf(addr), b, captureComment(c.endpoint, "out"))
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+// captureConn 包装 TCP 连接，按读写内容合成带序号的 TCP 报文段。
+type captureConn struct {
+	net.Conn
+	capture   *PcapWriter
+	endpoint  Endpoint
+	local     netip.AddrPort
+	remote    netip.AddrPort
+	mu        sync.Mutex
+	localSeq  uint32
+	remoteSeq uint32
+	closed    bool
+}
+
+// 合成三次握手使用的初始序号，固定值便于在 Wireshark 中对比。
+const (
+	captureLocalISN  = 0x1000
+	captureRemoteISN = 0x8000
+)
+
+// dialTCPCaptured 拨号 TCP 并记录合成的 SYN / SYN-ACK / ACK（或 RST）。
+func dialTCPCaptured(dial func() (net.Conn, error), capture *PcapWriter, endpoint Endpoint) (net.Conn, error) {
+	start := time.Now()
+	conn, err := dial()
+	if capture == nil {
+		return conn, err
+	}
+
+	remote := netip.AddrPort{}
+	if addr, parseErr := netip.ParseAddrPort(endpoint.Address()); parseErr == nil {
+		remote = addr
+	}
+	local := netip.AddrPortFrom(netip.IPv4Unspecified(), 0)
+	if conn != nil {
+		local = addrPortOf(conn.LocalAddr())
+		remote = addrPortOf(conn.RemoteAddr())
+	}
+
+	capture.writeTCP(start, local, remote, captureLocalISN, 0, tcpFlagSYN, nil, captureComment(endpoint, "out"))
+	if err != nil {
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			capture.writeTCP(time.Now(), remote, local, 0, captureLocalISN+1, tcpFlagRST|tcpFlagACK, nil, captureComment(endpoint, "in"))
+		}
+		return nil, err
+	}
+	now := time.Now()
+	capture.writeTCP(now, remote, local, captureRemoteISN, captureLocalISN+1, tcpFlagSYN|tcpFlagACK, nil, captureComment(endpoint, "in"))
+	capture.writeTCP(now, local, remote, captureLocalISN+1, captureRemoteISN+1, tcpFlagACK, nil, captureComment(endpoint, "out"))
+
+	return &captureConn{
+		Conn:      conn,
+		capture:   capture,
+		endpoint:  endpoint,
+		local:     local,
+		remote:    remote,
+		localSeq:  captureLocalISN + 1,
+		remoteSeq: captureRemoteISN + 1,
+	}, nil
+}
+
+func (c *captureConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.mu.Lock()
+		c.capture.writeTCP(time.Now(), c.remote, c.local, c.remoteSeq, c.localSeq, tcpFlagPSH|tcpFlagACK, b[:n], captureComment(c.endpoint, "in"))
+		c.remoteSeq += uint32(n)
+		c.mu.Unlock()
+	}
+	return n, err
+}
+
+func (c *captureConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.mu.Lock()
+		c.capture.writeTCP(time.Now(), c.local, c.remote, c.localSeq, c.remoteSeq, tcpFlagPSH|tcpFlagACK, b[:n], captureComment(c.endpoint, "out"))
+		c.localSeq += uint32(n)
+		c.mu.Unlock()
+	}
+	return n, err
+}
+
+func (c *captureConn) Close() error {
+	c.mu.Lock()
+	if !c.closed {
+		c.closed = true
+		c.capture.writeTCP(time.Now(), c.local, c.remote, c.localSeq, c.remoteSeq, tcpFlagFIN|tcpFlagACK, nil, captureComment(c.endpoint, "out"))
+	}
+	c.mu.Unlock()
+	return c.Conn.Close()
+}
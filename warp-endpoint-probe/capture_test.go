@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readPcapngBlocks 解析 pcapng 文件，返回 (blockType, body) 列表。
+func readPcapngBlocks(t *testing.T, path string) [][2]interface{} {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read pcap: %v", err)
+	}
+	var blocks [][2]interface{}
+	for len(data) > 0 {
+		if len(data) < 12 {
+			t.Fatalf("truncated block: %d bytes left", len(data))
+		}
+		blockType := binary.LittleEndian.Uint32(data[0:4])
+		total := int(binary.LittleEndian.Uint32(data[4:8]))
+		if total%4 != 0 || total > len(data) {
+			t.Fatalf("bad block length %d", total)
+		}
+		if trailer := int(binary.LittleEndian.Uint32(data[total-4 : total])); trailer != total {
+			t.Fatalf("block length mismatch: head=%d tail=%d", total, trailer)
+		}
+		blocks = append(blocks, [2]interface{}{blockType, data[8 : total-4]})
+		data = data[total:]
+	}
+	return blocks
+}
+
+func TestPcapWriterUDPAndTCP(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "probe.pcapng")
+	capture, err := CreatePcap(path)
+	if err != nil {
+		t.Fatalf("create pcap: %v", err)
+	}
+
+	local := netip.MustParseAddrPort("10.0.0.2:40000")
+	remote := netip.MustParseAddrPort("162.159.192.1:2408")
+	ts := time.Unix(1700000000, 123456789)
+	capture.WriteUDP(ts, local, remote, []byte("hello"), "out endpoint=162.159.192.1:2408")
+	capture.writeTCP(ts, local, remote, 1, 0, tcpFlagSYN, nil, "")
+	capture.WriteUDP(ts, netip.MustParseAddrPort("[::]:40000"), netip.MustParseAddrPort("[2606:4700:102::1]:443"), []byte("v6"), "")
+	if err := capture.Close(); err != nil {
+		t.Fatalf("close pcap: %v", err)
+	}
+
+	blocks := readPcapngBlocks(t, path)
+	if len(blocks) != 5 {
+		t.Fatalf("unexpected block count: got=%d want=5", len(blocks))
+	}
+	if blocks[0][0].(uint32) != pcapngBlockSHB || blocks[1][0].(uint32) != pcapngBlockIDB {
+		t.Fatalf("missing section/interface header")
+	}
+	if linkType := binary.LittleEndian.Uint16(blocks[1][1].([]byte)[0:2]); linkType != pcapngLinkTypeRaw {
+		t.Fatalf("unexpected link type: %d", linkType)
+	}
+
+	// IPv4/UDP
+	body := blocks[2][1].([]byte)
+	nanos := uint64(binary.LittleEndian.Uint32(body[4:8]))<<32 | uint64(binary.LittleEndian.Uint32(body[8:12]))
+	if int64(nanos) != ts.UnixNano() {
+		t.Fatalf("unexpected timestamp: got=%d want=%d", nanos, ts.UnixNano())
+	}
+	capLen := int(binary.LittleEndian.Uint32(body[12:16]))
+	packet := body[20 : 20+capLen]
+	if capLen != 20+8+5 {
+		t.Fatalf("unexpected ipv4/udp length: %d", capLen)
+	}
+	if internetChecksum(0, packet[:20]) != 0 {
+		t.Fatal("bad ipv4 header checksum")
+	}
+	if sum := transportChecksum(local.Addr(), remote.Addr(), ipProtoUDP, packet[20:]); sum != 0 {
+		t.Fatalf("bad udp checksum: residual=%#x", sum)
+	}
+	if !strings.Contains(string(body[20+capLen:]), "endpoint=162.159.192.1:2408") {
+		t.Fatal("missing endpoint comment")
+	}
+
+	// IPv4/TCP SYN
+	body = blocks[3][1].([]byte)
+	packet = body[20 : 20+int(binary.LittleEndian.Uint32(body[12:16]))]
+	if packet[20+13] != tcpFlagSYN {
+		t.Fatalf("unexpected tcp flags: %#x", packet[20+13])
+	}
+	if sum := transportChecksum(local.Addr(), remote.Addr(), ipProtoTCP, packet[20:]); sum != 0 {
+		t.Fatalf("bad tcp checksum: residual=%#x", sum)
+	}
+
+	// IPv6/UDP
+	body = blocks[4][1].([]byte)
+	if body[20]>>4 != 6 {
+		t.Fatalf("expected ipv6 packet, got version %d", body[20]>>4)
+	}
+}
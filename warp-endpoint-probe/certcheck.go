@@ -0,0 +1,188 @@
+package main
+
+// 服务端证书采集与校验：探测仍以 InsecureSkipVerify 握手 (MASQUE 节点会在 mTLS 阶段拒绝)，
+// 但通过 VerifyPeerCertificate 记录证书链，再按可配置的签发者、SAN、有效期与 SPKI pin 判断
+// 是否为真实的 Cloudflare edge，用于识别被劫持的 endpoint。
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 证书不符合预期的原因。
+const (
+	certProblemExpired  = "expired"
+	certProblemNotYet   = "not-yet-valid"
+	certProblemSAN      = "san-mismatch"
+	certProblemIssuer   = "issuer-mismatch"
+	certProblemPin      = "pin-mismatch"
+	certProblemUnparsed = "unparsable"
+)
+
+// ServerCert is the certificate chain presented by an endpoint.
+type ServerCert struct {
+	// Fingerprint 为叶子证书 DER 的 SHA-256 (hex)。
+	Fingerprint string
+	Leaf        *x509.Certificate
+	// Chain 为叶子之后的中间证书，顺序与服务端发送一致。
+	Chain []*x509.Certificate
+	// Problem 非空表示证书不符合 CertPolicy。
+	Problem string
+}
+
+// spkiPin 返回 SubjectPublicKeyInfo 的 SHA-256 (base64)，与 HPKP / curl --pinnedpubkey 格式一致。
+func spkiPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func (cert *ServerCert) String() string {
+	if cert.Leaf == nil {
+		return fmt.Sprintf("sha256=%s (unparsable)", cert.Fingerprint)
+	}
+	text := fmt.Sprintf("sha256=%s subject=%q issuer=%q not-after=%s",
+		cert.Fingerprint, cert.Leaf.Subject.CommonName, cert.Leaf.Issuer.String(), cert.Leaf.NotAfter.Format(time.DateOnly))
+	if cert.Problem != "" {
+		text += " unexpected=" + cert.Problem
+	}
+	return text
+}
+
+// certCapture 通过 VerifyPeerCertificate 记录服务端证书链。InsecureSkipVerify 时该回调仍会被调用，
+// 且早于客户端证书的发送，因此在 mTLS 阶段被拒绝的握手同样能拿到证书。
+type certCapture struct {
+	mu  sync.Mutex
+	raw [][]byte
+}
+
+func (capture *certCapture) verify(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	capture.mu.Lock()
+	defer capture.mu.Unlock()
+	capture.raw = rawCerts
+	return nil
+}
+
+// cert 解析记录的证书链，未收到证书时返回 nil；解析失败时 Leaf 为 nil。
+func (capture *certCapture) cert() *ServerCert {
+	capture.mu.Lock()
+	defer capture.mu.Unlock()
+	if len(capture.raw) == 0 {
+		return nil
+	}
+	sum := sha256.Sum256(capture.raw[0])
+	cert := &ServerCert{Fingerprint: hex.EncodeToString(sum[:])}
+	for i, der := range capture.raw {
+		parsed, err := x509.ParseCertificate(der)
+		if err != nil {
+			return cert
+		}
+		if i == 0 {
+			cert.Leaf = parsed
+		} else {
+			cert.Chain = append(cert.Chain, parsed)
+		}
+	}
+	return cert
+}
+
+// CertPolicy describes what a genuine edge certificate looks like.
+type CertPolicy struct {
+	Action checkAction
+	// Issuers 非空时，叶子证书签发者的 O 或 CN 须包含其中之一 (不区分大小写)。
+	Issuers []string
+	// Pins 非空时，证书链中须有一个证书的 SPKI pin 在其中。
+	Pins []string
+}
+
+// ParseCertPolicy 解析 -cert-check / -cert-issuer / -cert-pin。
+func ParseCertPolicy(action, issuers, pins string) (CertPolicy, error) {
+	var policy CertPolicy
+	var err error
+	if policy.Action, err = parseCheckAction("cert check", action); err != nil {
+		return CertPolicy{}, err
+	}
+	split := func(value string) []string {
+		var items []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		return items
+	}
+	policy.Issuers = split(issuers)
+	policy.Pins = split(pins)
+	for _, pin := range policy.Pins {
+		if raw, err := base64.StdEncoding.DecodeString(pin); err != nil || len(raw) != sha256.Size {
+			return CertPolicy{}, fmt.Errorf("invalid cert pin %q: want base64 SHA-256 of the SPKI", pin)
+		}
+	}
+	return policy, nil
+}
+
+// Check 返回证书不符合预期的原因，符合或未开启校验时返回空串。
+func (policy CertPolicy) Check(cert *ServerCert, serverName string, now time.Time) string {
+	if policy.Action == checkOff || policy.Action == "" || cert == nil {
+		return ""
+	}
+	if cert.Leaf == nil {
+		return certProblemUnparsed
+	}
+	leaf := cert.Leaf
+	switch {
+	case now.After(leaf.NotAfter):
+		return certProblemExpired
+	case now.Before(leaf.NotBefore):
+		return certProblemNotYet
+	case leaf.VerifyHostname(serverName) != nil:
+		return certProblemSAN
+	}
+	if len(policy.Issuers) > 0 && !policy.issuerAllowed(leaf.Issuer.Organization, leaf.Issuer.CommonName) {
+		return certProblemIssuer
+	}
+	if len(policy.Pins) > 0 && !policy.pinned(append([]*x509.Certificate{leaf}, cert.Chain...)) {
+		return certProblemPin
+	}
+	return ""
+}
+
+func (policy CertPolicy) issuerAllowed(organizations []string, commonName string) bool {
+	names := append([]string{commonName}, organizations...)
+	for _, expected := range policy.Issuers {
+		for _, name := range names {
+			if strings.Contains(strings.ToLower(name), strings.ToLower(expected)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (policy CertPolicy) pinned(chain []*x509.Certificate) bool {
+	for _, cert := range chain {
+		pin := spkiPin(cert)
+		for _, expected := range policy.Pins {
+			if pin == expected {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ExcludeUnexpectedCerts 剔除证书不符合预期的结果；未采集到证书的结果保留。
+func ExcludeUnexpectedCerts(results []ProbeResult) []ProbeResult {
+	kept := results[:0]
+	for _, result := range results {
+		if result.Cert == nil || result.Cert.Problem == "" {
+			kept = append(kept, result)
+		}
+	}
+	return kept
+}
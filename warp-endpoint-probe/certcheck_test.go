@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func testServerCert(t *testing.T, names []string, issuer string, notBefore, notAfter time.Time) *ServerCert {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: issuer + " CA", Organization: []string{issuer}},
+		DNSNames:     names,
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	capture := &certCapture{}
+	_ = capture.verify([][]byte{der}, nil)
+	return capture.cert()
+}
+
+func TestParseCertPolicy(t *testing.T) {
+	testCases := []struct {
+		name    string
+		action  string
+		pins    string
+		want    checkAction
+		wantErr bool
+	}{
+		{name: "default_off", want: checkOff},
+		{name: "mark", action: "Mark", want: checkMark},
+		{name: "exclude_with_pin", action: "exclude", pins: "47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=", want: checkExclude},
+		{name: "invalid_action", action: "drop", wantErr: true},
+		{name: "invalid_pin", action: "mark", pins: "not-a-pin", wantErr: true},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			policy, err := ParseCertPolicy(testCase.action, "Cloudflare, ", testCase.pins)
+			if testCase.wantErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil || policy.Action != testCase.want || len(policy.Issuers) != 1 {
+				t.Fatalf("unexpected policy: %+v err=%v", policy, err)
+			}
+		})
+	}
+}
+
+func TestCertPolicyCheck(t *testing.T) {
+	now := time.Now()
+	valid := testServerCert(t, []string{"*.cloudflareclient.com"}, "Cloudflare, Inc.", now.Add(-time.Hour), now.Add(time.Hour))
+	expired := testServerCert(t, []string{"*.cloudflareclient.com"}, "Cloudflare, Inc.", now.Add(-2*time.Hour), now.Add(-time.Hour))
+	future := testServerCert(t, []string{"*.cloudflareclient.com"}, "Cloudflare, Inc.", now.Add(time.Hour), now.Add(2*time.Hour))
+	hijacked := testServerCert(t, []string{"example.com"}, "Evil Proxy", now.Add(-time.Hour), now.Add(time.Hour))
+	otherIssuer := testServerCert(t, []string{"*.cloudflareclient.com"}, "Evil Proxy", now.Add(-time.Hour), now.Add(time.Hour))
+
+	testCases := []struct {
+		name   string
+		policy CertPolicy
+		cert   *ServerCert
+		want   string
+	}{
+		{name: "off_ignores_problems", policy: CertPolicy{Action: checkOff}, cert: hijacked},
+		{name: "valid", policy: CertPolicy{Action: checkMark}, cert: valid},
+		{name: "no_cert", policy: CertPolicy{Action: checkMark}},
+		{name: "expired", policy: CertPolicy{Action: checkMark}, cert: expired, want: certProblemExpired},
+		{name: "not_yet_valid", policy: CertPolicy{Action: checkMark}, cert: future, want: certProblemNotYet},
+		{name: "san_mismatch", policy: CertPolicy{Action: checkMark}, cert: hijacked, want: certProblemSAN},
+		{name: "issuer_ok", policy: CertPolicy{Action: checkMark, Issuers: []string{"cloudflare"}}, cert: valid},
+		{name: "issuer_mismatch", policy: CertPolicy{Action: checkMark, Issuers: []string{"cloudflare"}}, cert: otherIssuer, want: certProblemIssuer},
+		{name: "pin_ok", policy: CertPolicy{Action: checkMark, Pins: []string{spkiPin(valid.Leaf)}}, cert: valid},
+		{name: "pin_mismatch", policy: CertPolicy{Action: checkMark, Pins: []string{spkiPin(valid.Leaf)}}, cert: otherIssuer, want: certProblemPin},
+		{name: "unparsable", policy: CertPolicy{Action: checkExclude}, cert: &ServerCert{Fingerprint: "00"}, want: certProblemUnparsed},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			if actual := testCase.policy.Check(testCase.cert, "zt-masque.cloudflareclient.com", now); actual != testCase.want {
+				t.Fatalf("unexpected problem: got=%q want=%q", actual, testCase.want)
+			}
+		})
+	}
+}
+
+func TestProbeCapturesCertificate(t *testing.T) {
+	var edges []SimEdge
+	for _, spec := range []string{"https@127.0.0.1:0", "quic@127.0.0.1:0,mode=accept", "h2@127.0.0.1:0"} {
+		edge, err := ParseSimEdge(spec, SimEdge{})
+		if err != nil {
+			t.Fatalf("parse %s: %v", spec, err)
+		}
+		edges = append(edges, edge)
+	}
+	var wgKey [32]byte
+	sim, err := StartSimulator(edges, wgKey)
+	if err != nil {
+		t.Fatalf("start simulator: %v", err)
+	}
+	defer sim.Close()
+
+	policy := CertPolicy{Action: checkMark}
+	var fingerprint string
+	for _, edge := range sim.Edges {
+		t.Run(string(edge.Probe), func(t *testing.T) {
+			endpoint := simEndpoint(t, edge)
+			endpoint.SNI = MasqueSNI
+			sample, err := probeSingleEndpoint(context.Background(), endpoint, time.Second, ProbeOptions{})
+			if err != nil || sample.Cert == nil || sample.Cert.Leaf == nil {
+				t.Fatalf("no certificate captured: %+v err=%v", sample, err)
+			}
+			if fingerprint == "" {
+				fingerprint = sample.Cert.Fingerprint
+			} else if sample.Cert.Fingerprint != fingerprint {
+				t.Fatalf("edges share one certificate: got=%s want=%s", sample.Cert.Fingerprint, fingerprint)
+			}
+			if problem := policy.Check(sample.Cert, MasqueSNI, time.Now()); problem != "" {
+				t.Fatalf("simulator certificate rejected: %s", problem)
+			}
+			if problem := policy.Check(sample.Cert, "example.com", time.Now()); problem != certProblemSAN {
+				t.Fatalf("foreign name accepted: %q", problem)
+			}
+		})
+	}
+}
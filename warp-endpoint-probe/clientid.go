@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// clientIDCheckTopN 为配置了 client ID 时做匿名对照的候选数量。
+const clientIDCheckTopN = 3
+
+// ParseClientID parses a WARP client ID into the three reserved bytes of the
+// handshake initiation. It accepts the base64 `client_id` from a registration
+// (e.g. "AbCd") or a decimal triple (e.g. "1,2,3").
+func ParseClientID(value string) ([3]byte, error) {
+	var id [3]byte
+	value = strings.TrimSpace(value)
+
+	if parts := strings.Split(value, ","); len(parts) == 3 {
+		for i, part := range parts {
+			n, err := strconv.Atoi(strings.TrimSpace(part))
+			if err != nil || n < 0 || n > 255 {
+				return id, fmt.Errorf("invalid client id %q: byte %d out of range", value, i)
+			}
+			id[i] = byte(n)
+		}
+		return id, nil
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return id, fmt.Errorf("invalid client id %q: %w", value, err)
+	}
+	if len(raw) != len(id) {
+		return id, fmt.Errorf("invalid client id %q: %d bytes, want 3", value, len(raw))
+	}
+	copy(id[:], raw)
+	return id, nil
+}
+
+// LoadRegistrationClientID reads `client_id` from a WARP registration JSON,
+// either at the top level or under "config" as returned by the registration API.
+func LoadRegistrationClientID(path string) ([3]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return [3]byte{}, err
+	}
+	var registration struct {
+		ClientID string `json:"client_id"`
+		Config   struct {
+			ClientID string `json:"client_id"`
+		} `json:"config"`
+	}
+	if err := json.Unmarshal(data, &registration); err != nil {
+		return [3]byte{}, fmt.Errorf("parse registration %s: %w", path, err)
+	}
+	clientID := registration.Config.ClientID
+	if clientID == "" {
+		clientID = registration.ClientID
+	}
+	if clientID == "" {
+		return [3]byte{}, fmt.Errorf("registration %s has no client_id", path)
+	}
+	return ParseClientID(clientID)
+}
+
+// ResolveClientID 显式 client ID 优先，否则从 registration 文件派生；都为空时返回零值。
+func ResolveClientID(value, registrationPath string) ([3]byte, error) {
+	if value != "" {
+		return ParseClientID(value)
+	}
+	if registrationPath != "" {
+		return LoadRegistrationClientID(registrationPath)
+	}
+	return [3]byte{}, nil
+}
+
+func formatClientID(id [3]byte) string {
+	return fmt.Sprintf("%d,%d,%d (%s)", id[0], id[1], id[2], base64.StdEncoding.EncodeToString(id[:]))
+}
+
+// ClientIDCheck compares one endpoint's answer with and without the client ID.
+type ClientIDCheck struct {
+	Endpoint  string
+	WithID    error
+	Anonymous error
+}
+
+// CheckClientID 对每个候选分别带 client ID 与匿名各握手一次，
+// 用于确认 endpoint 接受的是真实账户而不只是匿名握手。
+func CheckClientID(ctx context.Context, candidates []Endpoint, timeout time.Duration, opts ProbeOptions) []ClientIDCheck {
+	anonymous := opts
+	anonymous.WireGuard.Identity.Reserved = [3]byte{}
+
+	checks := make([]ClientIDCheck, 0, len(candidates))
+	for _, endpoint := range candidates {
+		check := ClientIDCheck{Endpoint: endpoint.Address()}
+		_, check.WithID = ProbeWireGuardHandshake(ctx, endpoint, timeout, opts)
+		_, check.Anonymous = ProbeWireGuardHandshake(ctx, endpoint, timeout, anonymous)
+		checks = append(checks, check)
+	}
+	return checks
+}
+
+// PrintClientIDChecks writes one line per check.
+func PrintClientIDChecks(w io.Writer, checks []ClientIDCheck) {
+	status := func(err error) string {
+		if err != nil {
+			return "no-answer"
+		}
+		return "ok"
+	}
+	for _, check := range checks {
+		fmt.Fprintf(w, "ClientID check: %s client-id=%s anonymous=%s\n",
+			check.Endpoint, status(check.WithID), status(check.Anonymous))
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseClientID(t *testing.T) {
+	testCases := []struct {
+		name     string
+		value    string
+		expected [3]byte
+		wantErr  bool
+	}{
+		{name: "base64", value: "AQID", expected: [3]byte{1, 2, 3}},
+		{name: "decimal", value: "1, 2, 255", expected: [3]byte{1, 2, 255}},
+		{name: "decimal_overflow", value: "1,2,256", wantErr: true},
+		{name: "base64_too_long", value: "AQIDBA==", wantErr: true},
+		{name: "garbage", value: "not-an-id", wantErr: true},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			actual, err := ParseClientID(testCase.value)
+			if testCase.wantErr {
+				if err == nil {
+					t.Fatalf("expected error for %q", testCase.value)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if actual != testCase.expected {
+				t.Fatalf("unexpected client id: got=%v want=%v", actual, testCase.expected)
+			}
+		})
+	}
+}
+
+func TestLoadRegistrationClientID(t *testing.T) {
+	dir := t.TempDir()
+	nested := filepath.Join(dir, "reg.json")
+	if err := os.WriteFile(nested, []byte(`{"id":"t.1","config":{"client_id":"CgsM","peers":[]}}`), 0o600); err != nil {
+		t.Fatalf("write registration: %v", err)
+	}
+	id, err := ResolveClientID("", nested)
+	if err != nil {
+		t.Fatalf("load registration: %v", err)
+	}
+	if id != [3]byte{10, 11, 12} {
+		t.Fatalf("unexpected client id: %v", id)
+	}
+
+	// 显式 client ID 优先于 registration 文件
+	if id, err := ResolveClientID("7,8,9", nested); err != nil || id != [3]byte{7, 8, 9} {
+		t.Fatalf("explicit client id not preferred: id=%v err=%v", id, err)
+	}
+
+	empty := filepath.Join(dir, "empty.json")
+	if err := os.WriteFile(empty, []byte(`{"config":{}}`), 0o600); err != nil {
+		t.Fatalf("write registration: %v", err)
+	}
+	if _, err := ResolveClientID("", empty); err == nil {
+		t.Fatal("expected error for registration without client_id")
+	}
+}
+
+func TestCheckClientID(t *testing.T) {
+	responder := newTestResponder(t)
+	clientID := [3]byte{0x2a, 0x17, 0x05}
+
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer server.Close()
+
+	addr := server.LocalAddr().(*net.UDPAddr)
+	endpoint := Endpoint{IP: addr.IP.String(), Port: addr.Port, Probe: ProbeWireGuard}
+	opts := ProbeOptions{WireGuard: WireGuardOptions{
+		Identity: WireGuardIdentity{PeerPublic: responder.pub, Reserved: clientID},
+	}}
+
+	done := make(chan []ClientIDCheck, 1)
+	go func() {
+		candidates := topCandidates(nil, []Endpoint{endpoint}, clientIDCheckTopN, true)
+		done <- CheckClientID(context.Background(), candidates, 300*time.Millisecond, opts)
+	}()
+
+	// 模拟只接受已注册账户的 edge：reserved bytes 不匹配的 initiation 直接丢弃
+	buf := make([]byte, 256)
+	for i := 0; i < 2; i++ {
+		_ = server.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, from, err := server.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatalf("read initiation: %v", err)
+		}
+		if [3]byte(buf[1:4]) != clientID {
+			continue
+		}
+		if _, err := server.WriteToUDP(responder.respond(t, buf[:n]), from); err != nil {
+			t.Fatalf("write response: %v", err)
+		}
+	}
+
+	checks := <-done
+	if len(checks) != 1 {
+		t.Fatalf("unexpected checks: %+v", checks)
+	}
+	if checks[0].WithID != nil {
+		t.Fatalf("client id handshake failed: %v", checks[0].WithID)
+	}
+	if checks[0].Anonymous == nil {
+		t.Fatal("anonymous handshake unexpectedly answered")
+	}
+}
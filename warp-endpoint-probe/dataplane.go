@@ -0,0 +1,272 @@
+package main
+
+// 握手成功只说明 edge 可达，不代表流量能通过。这里用已注册的私钥和隧道地址
+// 完成握手、派生 transport key，然后在隧道内发送 ICMP echo，测量隧道内 RTT 与丢包。
+//
+// Transport Data format:
+//   - Type (4 bytes): 0x04 + 3 reserved bytes (WARP client ID)
+//   - Receiver Index (4 bytes): responder's sender index
+//   - Counter (8 bytes, little endian): AEAD nonce
+//   - Encrypted Packet: AEAD(key, counter, inner IP packet padded to 16, empty)
+
+import (
+	"context"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"sort"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	wgTransportHeaderSize = 16
+	ipProtoICMP           = 1
+	ipProtoICMPv6         = 58
+	// echoSegmentSize 为 ICMP 头 (8) + 时间戳 payload (16)。
+	echoSegmentSize = 24
+
+	// dataPlaneTopN 为做隧道内校验的候选数量。
+	dataPlaneTopN = 3
+)
+
+var (
+	errDataPlaneNoKey     = errors.New("data-plane check requires a registered private key")
+	errDataPlaneNoAddress = errors.New("data-plane check requires a tunnel address of the target family")
+)
+
+// DataPlaneResult is the outcome of in-tunnel echoes to one endpoint.
+type DataPlaneResult struct {
+	Handshake time.Duration
+	RTT       time.Duration
+	Sent      int
+	Received  int
+}
+
+// Loss returns the fraction of echoes without a reply.
+func (r DataPlaneResult) Loss() float64 {
+	if r.Sent == 0 {
+		return 1
+	}
+	return float64(r.Sent-r.Received) / float64(r.Sent)
+}
+
+// ProbeWireGuardDataPlane 握手后在隧道内向 target 发送 count 个 ICMP echo，
+// 每个 echo 最多等待 timeout。
+func ProbeWireGuardDataPlane(ctx context.Context, endpoint Endpoint, target netip.Addr, count int, timeout time.Duration, opts ProbeOptions) (DataPlaneResult, error) {
+	identity := opts.WireGuard.identity()
+	if identity.PrivateKey == nil {
+		return DataPlaneResult{}, errDataPlaneNoKey
+	}
+	source, ok := identity.sourceAddress(target)
+	if !ok {
+		return DataPlaneResult{}, fmt.Errorf("%w: %s", errDataPlaneNoAddress, target)
+	}
+
+	handshakeCtx, cancel := context.WithTimeout(ctx, timeout)
+	transport, err := openWGTransport(handshakeCtx, endpoint, opts)
+	if err != nil {
+		cancel()
+		return DataPlaneResult{}, err
+	}
+	defer transport.Close()
+
+	handshake, sample, err := handshakeWireGuard(handshakeCtx, endpoint, transport, identity, opts.Capture)
+	cancel()
+	if err != nil {
+		return DataPlaneResult{}, err
+	}
+	session, err := handshake.deriveSession(identity.Reserved)
+	if err != nil {
+		return DataPlaneResult{}, err
+	}
+
+	result := DataPlaneResult{Handshake: sample.Latency}
+	var totalRTT time.Duration
+	echoID := uint16(handshake.senderIndex)
+	for seq := 1; seq <= count; seq++ {
+		if ctx.Err() != nil {
+			break
+		}
+		request := buildEchoRequest(source, target, echoID, uint16(seq))
+		accept := func(reply []byte) bool {
+			inner, err := session.open(reply)
+			return err == nil && isEchoReply(inner, target, source, echoID, uint16(seq))
+		}
+
+		echoCtx, cancel := context.WithTimeout(ctx, timeout)
+		exchange, err := transport.roundTrip(echoCtx, session.seal(request), accept)
+		cancel()
+		exchange.record(opts.Capture, endpoint)
+		result.Sent++
+		if err != nil {
+			continue
+		}
+		result.Received++
+		totalRTT += exchange.latency
+	}
+	if result.Received > 0 {
+		result.RTT = totalRTT / time.Duration(result.Received)
+	}
+	return result, nil
+}
+
+// wgSession 是握手完成后的 transport 状态。
+type wgSession struct {
+	peerIndex uint32
+	reserved  [3]byte
+	send      cipher.AEAD
+	recv      cipher.AEAD
+	counter   uint64
+}
+
+// deriveSession 派生 transport key：T_send, T_recv = KDF2(ck, empty)。
+func (hs *wgHandshake) deriveSession(reserved [3]byte) (*wgSession, error) {
+	sendKey, recvKey := hkdf2(hs.ck[:], nil)
+	send, err := chacha20poly1305.New(sendKey[:])
+	if err != nil {
+		return nil, err
+	}
+	recv, err := chacha20poly1305.New(recvKey[:])
+	if err != nil {
+		return nil, err
+	}
+	return &wgSession{peerIndex: hs.peerIndex, reserved: reserved, send: send, recv: recv}, nil
+}
+
+// seal 将内层 IP 报文封装为 Transport Data 消息。
+func (session *wgSession) seal(packet []byte) []byte {
+	padded := make([]byte, len(packet)+(16-len(packet)%16)%16)
+	copy(padded, packet)
+
+	msg := make([]byte, wgTransportHeaderSize, wgTransportHeaderSize+len(padded)+chacha20poly1305.Overhead)
+	msg[0] = wgMessageTypeTransportData
+	copy(msg[1:4], session.reserved[:])
+	binary.LittleEndian.PutUint32(msg[4:8], session.peerIndex)
+	binary.LittleEndian.PutUint64(msg[8:16], session.counter)
+
+	var nonce [12]byte
+	binary.LittleEndian.PutUint64(nonce[4:], session.counter)
+	session.counter++
+	return session.send.Seal(msg, nonce[:], padded, nil)
+}
+
+// open 解密 Transport Data 消息，返回内层报文 (含填充)。
+func (session *wgSession) open(msg []byte) ([]byte, error) {
+	if len(msg) < wgTransportHeaderSize+chacha20poly1305.Overhead || msg[0] != wgMessageTypeTransportData {
+		return nil, io.ErrUnexpectedEOF
+	}
+	var nonce [12]byte
+	copy(nonce[4:], msg[8:16])
+	return session.recv.Open(nil, nonce[:], msg[wgTransportHeaderSize:], nil)
+}
+
+// buildEchoRequest 构造 ICMP / ICMPv6 echo request，payload 为发送时间戳。
+func buildEchoRequest(src, dst netip.Addr, id, seq uint16) []byte {
+	segment := make([]byte, echoSegmentSize)
+	segment[0], segment[1] = 8, 0
+	proto := uint8(ipProtoICMP)
+	if dst.Is6() {
+		segment[0], proto = 128, ipProtoICMPv6
+	}
+	binary.BigEndian.PutUint16(segment[4:6], id)
+	binary.BigEndian.PutUint16(segment[6:8], seq)
+	binary.BigEndian.PutUint64(segment[8:16], uint64(time.Now().UnixNano()))
+	if proto == ipProtoICMPv6 {
+		binary.BigEndian.PutUint16(segment[2:4], transportChecksum(src, dst, proto, segment))
+	} else {
+		binary.BigEndian.PutUint16(segment[2:4], internetChecksum(0, segment))
+	}
+	return buildIPPacket(src, dst, proto, seq, segment)
+}
+
+// isEchoReply 判断内层报文是否为来自 src、匹配 id/seq 的 echo reply。
+func isEchoReply(packet []byte, src, dst netip.Addr, id, seq uint16) bool {
+	var proto uint8
+	var from, to netip.Addr
+	var icmp []byte
+	switch {
+	case len(packet) >= 20 && packet[0]>>4 == 4:
+		headerLen := int(packet[0]&0x0f) * 4
+		total := int(binary.BigEndian.Uint16(packet[2:4]))
+		if headerLen < 20 || total > len(packet) || total < headerLen+8 {
+			return false
+		}
+		proto = packet[9]
+		from, _ = netip.AddrFromSlice(packet[12:16])
+		to, _ = netip.AddrFromSlice(packet[16:20])
+		icmp = packet[headerLen:total]
+	case len(packet) >= 48 && packet[0]>>4 == 6:
+		total := 40 + int(binary.BigEndian.Uint16(packet[4:6]))
+		if total > len(packet) {
+			return false
+		}
+		proto = packet[6]
+		from, _ = netip.AddrFromSlice(packet[8:24])
+		to, _ = netip.AddrFromSlice(packet[24:40])
+		icmp = packet[40:total]
+	default:
+		return false
+	}
+
+	wantType := uint8(0)
+	if proto == ipProtoICMPv6 {
+		wantType = 129
+	} else if proto != ipProtoICMP {
+		return false
+	}
+	return from == src && to == dst && len(icmp) >= 8 && icmp[0] == wantType &&
+		binary.BigEndian.Uint16(icmp[4:6]) == id && binary.BigEndian.Uint16(icmp[6:8]) == seq
+}
+
+// VerifyDataPlane 对前 topN 个结果做隧道内校验 (WireGuard 或 MASQUE datagram) 并据此重新排序。
+func VerifyDataPlane(ctx context.Context, results []ProbeResult, endpoints []Endpoint, topN int, target netip.Addr, count int, timeout time.Duration, opts ProbeOptions) []ProbeResult {
+	eachTopResult(results, endpoints, topN, func(result *ProbeResult, endpoint Endpoint) {
+		var tunnel DataPlaneResult
+		var err error
+		if endpoint.Probe == ProbeQUIC {
+			tunnel, err = ProbeMASQUEDataPlane(ctx, endpoint, target, count, timeout, opts)
+		} else {
+			tunnel, err = ProbeWireGuardDataPlane(ctx, endpoint, target, count, timeout, opts)
+		}
+		if err != nil {
+			tunnel = DataPlaneResult{Sent: count}
+		}
+		result.Tunnel = &tunnel
+	})
+	RankByDataPlane(results)
+	return results
+}
+
+// RankByDataPlane 在 probePenalty 相同的结果内按隧道内结果重新排序：隧道可用的 (按丢包、RTT) 在前，
+// 未校验的保持原有顺序居中，隧道不通的排到最后。
+func RankByDataPlane(results []ProbeResult) {
+	tier := func(r ProbeResult) int {
+		switch {
+		case r.Tunnel == nil:
+			return 1
+		case r.Tunnel.Received > 0:
+			return 0
+		default:
+			return 2
+		}
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		if pi, pj := probePenalty(results[i]), probePenalty(results[j]); pi != pj {
+			return pi < pj
+		}
+		ti, tj := tier(results[i]), tier(results[j])
+		if ti != tj || ti != 0 {
+			return ti < tj
+		}
+		a, b := results[i].Tunnel, results[j].Tunnel
+		if a.Loss() != b.Loss() {
+			return a.Loss() < b.Loss()
+		}
+		return a.RTT < b.RTT
+	})
+}
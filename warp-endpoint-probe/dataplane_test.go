@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestProbeWireGuardDataPlane(t *testing.T) {
+	responder := newTestResponder(t)
+	priv, _ := randomKey(t)
+	clientID := [3]byte{1, 2, 3}
+	target := netip.MustParseAddr("1.1.1.1")
+	identity := WireGuardIdentity{
+		PeerPublic: responder.pub,
+		PrivateKey: &priv,
+		Reserved:   clientID,
+		Addresses:  []netip.Addr{netip.MustParseAddr("172.16.0.2")},
+	}
+
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer server.Close()
+	addr := server.LocalAddr().(*net.UDPAddr)
+	endpoint := Endpoint{IP: addr.IP.String(), Port: addr.Port, Probe: ProbeWireGuard}
+
+	done := make(chan DataPlaneResult, 1)
+	go func() {
+		opts := ProbeOptions{WireGuard: WireGuardOptions{Identity: identity}}
+		result, err := ProbeWireGuardDataPlane(context.Background(), endpoint, target, 3, 300*time.Millisecond, opts)
+		if err != nil {
+			result = DataPlaneResult{}
+		}
+		done <- result
+	}()
+
+	// 1 个 initiation + 3 个 echo；第 2 个 echo 丢弃以模拟丢包
+	buf := make([]byte, 2048)
+	for i := 0; i < 4; i++ {
+		_ = server.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, from, err := server.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		msg := buf[:n]
+		if [3]byte(msg[1:4]) != clientID {
+			t.Fatalf("message type %d missing client id: % x", msg[0], msg[1:4])
+		}
+
+		var reply []byte
+		switch msg[0] {
+		case wgMessageTypeHandshakeInitiation:
+			reply = responder.respond(t, msg)
+		case wgMessageTypeTransportData:
+			if reply = responder.echo(msg); reply == nil {
+				t.Fatalf("transport data is not a valid echo request: % x", msg)
+			}
+			if i == 2 {
+				continue
+			}
+		default:
+			t.Fatalf("unexpected message type %d", msg[0])
+		}
+		if _, err := server.WriteToUDP(reply, from); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+
+	result := <-done
+	if result.Sent != 3 || result.Received != 2 {
+		t.Fatalf("unexpected counts: %+v", result)
+	}
+	if result.RTT <= 0 || result.Handshake <= 0 {
+		t.Fatalf("missing timings: %+v", result)
+	}
+}
+
+// TestProbeWireGuardReserved 以 wireguard-go 对端 (reservedBind 在 MAC 计算后写入 client ID)
+// 校验探针的 MAC 计算与 reserved bytes 的处理。wireguard-go 限制同一 peer 20ms 内的重复握手，
+// 因此两次探测各用一个对端。
+func TestProbeWireGuardReserved(t *testing.T) {
+	reserved := [3]byte{1, 2, 3}
+	setup := func(t *testing.T) (Endpoint, ProbeOptions) {
+		clientPriv, _ := randomKey(t)
+		identity := WireGuardIdentity{PrivateKey: &clientPriv, Reserved: reserved,
+			Addresses: []netip.Addr{netip.MustParseAddr("10.9.0.2")}}
+		clientPub, _ := identity.PublicKey()
+		endpoint, serverPub := startTestPeer(t, clientPub, reserved)
+		identity.PeerPublic = serverPub
+		return endpoint, ProbeOptions{WireGuard: WireGuardOptions{Identity: identity}}
+	}
+
+	t.Run("handshake", func(t *testing.T) {
+		endpoint, opts := setup(t)
+		if _, err := ProbeWireGuardHandshake(context.Background(), endpoint, 2*time.Second, opts); err != nil {
+			t.Fatalf("handshake with client id failed: %v", err)
+		}
+	})
+	t.Run("data plane", func(t *testing.T) {
+		endpoint, opts := setup(t)
+		result, err := ProbeWireGuardDataPlane(context.Background(), endpoint, netip.MustParseAddr("10.9.0.1"), 3, 2*time.Second, opts)
+		if err != nil {
+			t.Fatalf("data plane with client id failed: %v", err)
+		}
+		if result.Received == 0 {
+			t.Fatalf("no in-tunnel echo replies: %+v", result)
+		}
+	})
+}
+
+func TestRankByDataPlane(t *testing.T) {
+	results := []ProbeResult{
+		{Endpoint: "a", Latency: 10 * time.Millisecond, Tunnel: &DataPlaneResult{Sent: 3}},
+		{Endpoint: "b", Latency: 20 * time.Millisecond, Tunnel: &DataPlaneResult{Sent: 3, Received: 2, RTT: 30 * time.Millisecond}},
+		{Endpoint: "c", Latency: 30 * time.Millisecond, Tunnel: &DataPlaneResult{Sent: 3, Received: 3, RTT: 50 * time.Millisecond}},
+		{Endpoint: "d", Latency: 40 * time.Millisecond},
+		{Endpoint: "e", Latency: 50 * time.Millisecond, Tunnel: &DataPlaneResult{Sent: 3, Received: 3, RTT: 40 * time.Millisecond}},
+	}
+	RankByDataPlane(results)
+
+	expected := []string{"e", "c", "b", "d", "a"}
+	for i, endpoint := range expected {
+		if results[i].Endpoint != endpoint {
+			t.Fatalf("unexpected order at %d: got=%s want=%s", i, results[i].Endpoint, endpoint)
+		}
+	}
+	if tags := results[4].Tags(); len(tags) != 1 || tags[0] != "tunnel-down" {
+		t.Fatalf("unexpected tags for failed tunnel: %v", tags)
+	}
+
+	// -cert-check / -api-check mark 与 under-load：被标记的 endpoint 即使隧道可用也保持在后
+	up := &DataPlaneResult{Sent: 3, Received: 3, RTT: 10 * time.Millisecond}
+	results = []ProbeResult{
+		{Endpoint: "bad-cert", Latency: 10 * time.Millisecond, Cert: &ServerCert{Problem: certProblemSAN}, Tunnel: up},
+		{Endpoint: "api-fail", Latency: 20 * time.Millisecond, API: &APIResult{Outcome: apiWrongBackend}, Tunnel: up},
+		{Endpoint: "loaded", Latency: 30 * time.Millisecond, UnderLoad: true, Tunnel: up},
+		{Endpoint: "down", Latency: 40 * time.Millisecond, Tunnel: &DataPlaneResult{Sent: 3}},
+		{Endpoint: "unchecked", Latency: 50 * time.Millisecond},
+	}
+	RankByDataPlane(results)
+	expected = []string{"unchecked", "down", "loaded", "api-fail", "bad-cert"}
+	for i, endpoint := range expected {
+		if results[i].Endpoint != endpoint {
+			t.Fatalf("unexpected order with flags at %d: got=%s want=%s", i, results[i].Endpoint, endpoint)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+// Encrypted Client Hello (draft-ietf-tls-esni)：按 SNI 过滤的网络只能看到外层 ClientHello 中的
+// public_name (Cloudflare 为 cloudflare-ech.com)，真实 SNI 加密在内层 ClientHello 中。
+// ECHConfigList 取自 DNS HTTPS 记录的 ech= 参数，由 -ech (base64) 或 -ech-file 提供。
+// 对前几名分别以明文 SNI 与 ECH 握手，判断哪些 edge 接受 ECH、路径是否阻断 ECH。
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	utls "github.com/refraction-networking/utls"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// echCheckTopN 为做 ECH 对照的候选数量。
+const echCheckTopN = 5
+
+// echConfigVersion 为 ECHConfig 的版本号 (draft-ietf-tls-esni-13 起不变)。
+const echConfigVersion = 0xfe0d
+
+// ECH 对照结论。
+const (
+	echVerdictOK          = "ok"          // 服务端接受 ECH 并完成握手
+	echVerdictRejected    = "rejected"    // 服务端有回应但拒绝 ECH (没有对应私钥或配置已轮换)
+	echVerdictBlocked     = "blocked"     // 明文 SNI 有回应，ECH 握手超时或被重置
+	echVerdictAnswered    = "answered"    // ECH 握手在 ServerHello 之前被拒绝，无法判断是否支持 ECH
+	echVerdictUnreachable = "unreachable" // 明文 SNI 也无回应
+)
+
+// errECHRejected 标记服务端拒绝了 ECH 的握手。
+var errECHRejected = errors.New("server rejected encrypted client hello")
+
+// ParseECHConfigList 解析 -ech (base64) 或 -ech-file (原始字节或 base64 文本)，都为空时返回 nil。
+func ParseECHConfigList(value, path string) ([]byte, error) {
+	value = strings.TrimSpace(value)
+	var list []byte
+	switch {
+	case value != "" && path != "":
+		return nil, errors.New("-ech and -ech-file are mutually exclusive")
+	case path != "":
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read ech config list: %w", err)
+		}
+		if decoded, err := base64.StdEncoding.DecodeString(string(bytes.Join(bytes.Fields(raw), nil))); err == nil {
+			raw = decoded
+		}
+		list = raw
+	case value != "":
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ech config list: %w", err)
+		}
+		list = decoded
+	default:
+		return nil, nil
+	}
+	if _, err := echPublicNames(list); err != nil {
+		return nil, fmt.Errorf("invalid ech config list: %w", err)
+	}
+	return list, nil
+}
+
+// echPublicNames 返回 ECHConfigList 中各个受支持版本配置的 public_name，即外层 ClientHello 的 SNI。
+func echPublicNames(list []byte) ([]string, error) {
+	input := cryptobyte.String(list)
+	var configs cryptobyte.String
+	if !input.ReadUint16LengthPrefixed(&configs) || !input.Empty() {
+		return nil, errors.New("malformed list length")
+	}
+	var names []string
+	for !configs.Empty() {
+		var version uint16
+		var contents cryptobyte.String
+		if !configs.ReadUint16(&version) || !configs.ReadUint16LengthPrefixed(&contents) {
+			return nil, errors.New("malformed config")
+		}
+		if version != echConfigVersion {
+			// 未知版本按规范跳过
+			continue
+		}
+		// config_id 1 + kem_id 2 + public_key + cipher_suites + maximum_name_length 1 + public_name
+		var publicKey, suites, publicName cryptobyte.String
+		if !contents.Skip(3) || !contents.ReadUint16LengthPrefixed(&publicKey) || !contents.ReadUint16LengthPrefixed(&suites) ||
+			!contents.Skip(1) || !contents.ReadUint8LengthPrefixed(&publicName) || len(publicName) == 0 {
+			return nil, errors.New("malformed config contents")
+		}
+		names = append(names, string(publicName))
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no config with version %#04x", echConfigVersion)
+	}
+	return names, nil
+}
+
+// echRejection 记录一次握手中服务端是否拒绝了 ECH。拒绝时 crypto/tls 与 uTLS 默认以 public_name
+// 校验外层证书，探测只需记录结果；握手随后以 ECHRejectionError 失败，但 quic-go 会把它转成
+// CRYPTO_ERROR，因此不依赖错误类型。
+type echRejection struct {
+	rejected atomic.Bool
+}
+
+func (r *echRejection) record() error {
+	r.rejected.Store(true)
+	return nil
+}
+
+// applyTLS 为 crypto/tls 配置 ECH；list 为 nil 时不做改动。
+func (r *echRejection) applyTLS(config *tls.Config, list []byte) {
+	if list == nil {
+		return
+	}
+	config.EncryptedClientHelloConfigList = list
+	config.MinVersion = tls.VersionTLS13
+	config.EncryptedClientHelloRejectionVerify = func(tls.ConnectionState) error { return r.record() }
+}
+
+// applyUTLS 为 uTLS 配置 ECH；list 为 nil 时不做改动。
+func (r *echRejection) applyUTLS(config *utls.Config, list []byte) {
+	if list == nil {
+		return
+	}
+	config.EncryptedClientHelloConfigList = list
+	config.MinVersion = utls.VersionTLS13
+	config.EncryptedClientHelloRejectionVerify = func(utls.ConnectionState) error { return r.record() }
+}
+
+// ECHCheck compares a plaintext-SNI and an ECH handshake on one endpoint.
+type ECHCheck struct {
+	Plain SNIResult
+	ECH   SNIResult
+}
+
+// Verdict 汇总两次握手的结果。
+func (check ECHCheck) Verdict() string {
+	switch {
+	case !check.Plain.answered():
+		return echVerdictUnreachable
+	case !check.ECH.answered():
+		return echVerdictBlocked
+	case check.ECH.Outcome == SNIECHRejected:
+		return echVerdictRejected
+	case check.ECH.Outcome == SNIServerHello:
+		return echVerdictOK
+	default:
+		return echVerdictAnswered
+	}
+}
+
+func (check ECHCheck) String() string {
+	return fmt.Sprintf("ech=%s plaintext=%s encrypted=%s", check.Verdict(), check.Plain.Outcome, check.ECH.Outcome)
+}
+
+// ProbeECH 对同一 endpoint 先以明文 SNI 握手，再以 opts.ECH 握手。
+func ProbeECH(ctx context.Context, endpoint Endpoint, timeout time.Duration, opts ProbeOptions) ECHCheck {
+	serverName := endpoint.SNI
+	if serverName == "" {
+		serverName = DefaultSNI
+	}
+	plain := opts
+	plain.ECH = nil
+	return ECHCheck{
+		Plain: ProbeSNI(ctx, endpoint, serverName, timeout, plain),
+		ECH:   ProbeSNI(ctx, endpoint, serverName, timeout, opts),
+	}
+}
+
+// CheckECH 对前 topN 名做明文 SNI 与 ECH 对照。
+func CheckECH(ctx context.Context, results []ProbeResult, endpoints []Endpoint, topN int, timeout time.Duration, opts ProbeOptions) []ProbeResult {
+	eachTopResult(results, endpoints, topN, func(result *ProbeResult, endpoint Endpoint) {
+		check := ProbeECH(ctx, endpoint, timeout, opts)
+		result.ECH = &check
+	})
+	return results
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParseECHConfigList(t *testing.T) {
+	_, list, err := simECHKey(simECHPublicName)
+	if err != nil {
+		t.Fatalf("generate ech key: %v", err)
+	}
+	encoded := base64.StdEncoding.EncodeToString(list)
+	dir := t.TempDir()
+	rawFile, textFile := filepath.Join(dir, "ech.bin"), filepath.Join(dir, "ech.txt")
+	if err := os.WriteFile(rawFile, list, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(textFile, []byte(encoded[:20]+"\n"+encoded[20:]+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// 未知版本的配置被跳过，只剩未知版本时报错
+	unknown := []byte{0x00, 0x06, 0xfe, 0x0a, 0x00, 0x02, 0x00, 0x00}
+
+	testCases := []struct {
+		name    string
+		value   string
+		path    string
+		want    []byte
+		wantErr bool
+	}{
+		{name: "empty"},
+		{name: "base64", value: " " + encoded + " ", want: list},
+		{name: "raw_file", path: rawFile, want: list},
+		{name: "text_file", path: textFile, want: list},
+		{name: "both", value: encoded, path: rawFile, wantErr: true},
+		{name: "not_base64", value: "not base64!", wantErr: true},
+		{name: "truncated", value: base64.StdEncoding.EncodeToString(list[:len(list)-1]), wantErr: true},
+		{name: "unknown_version", value: base64.StdEncoding.EncodeToString(unknown), wantErr: true},
+		{name: "missing_file", path: filepath.Join(dir, "missing"), wantErr: true},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			actual, err := ParseECHConfigList(testCase.value, testCase.path)
+			if (err != nil) != testCase.wantErr || !slices.Equal(actual, testCase.want) {
+				t.Fatalf("ParseECHConfigList(%q, %q) = %x, %v; want %x", testCase.value, testCase.path, actual, err, testCase.want)
+			}
+		})
+	}
+
+	names, err := echPublicNames(list)
+	if err != nil || !slices.Equal(names, []string{simECHPublicName}) {
+		t.Fatalf("echPublicNames = %v, %v; want [%s]", names, err, simECHPublicName)
+	}
+}
+
+func TestFingerprintECHCapable(t *testing.T) {
+	testCases := []struct {
+		name string
+		want bool
+	}{
+		{name: fingerprintChrome, want: true},
+		{name: fingerprintFirefox, want: true},
+		{name: fingerprintGo, want: true},
+		{name: fingerprintSafari, want: false},
+		{name: fingerprintRandom, want: false},
+	}
+	for _, testCase := range testCases {
+		fingerprint, err := ParseFingerprint(testCase.name)
+		if err != nil {
+			t.Fatalf("parse %s: %v", testCase.name, err)
+		}
+		if actual := fingerprint.echCapable(); actual != testCase.want {
+			t.Fatalf("%s.echCapable() = %t; want %t", testCase.name, actual, testCase.want)
+		}
+	}
+}
+
+func TestECHCheckVerdict(t *testing.T) {
+	testCases := []struct {
+		name  string
+		plain string
+		ech   string
+		want  string
+	}{
+		{name: "ok", plain: SNIServerHello, ech: SNIServerHello, want: echVerdictOK},
+		{name: "rejected", plain: SNIServerHello, ech: SNIECHRejected, want: echVerdictRejected},
+		{name: "blocked", plain: SNIServerHello, ech: SNITimeout, want: echVerdictBlocked},
+		{name: "reset", plain: SNIAlert, ech: SNIReset, want: echVerdictBlocked},
+		{name: "answered", plain: SNIAlert, ech: SNIAlert, want: echVerdictAnswered},
+		{name: "unreachable", plain: SNITimeout, ech: SNIServerHello, want: echVerdictUnreachable},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			check := ECHCheck{Plain: SNIResult{Outcome: testCase.plain}, ECH: SNIResult{Outcome: testCase.ech}}
+			if actual := check.Verdict(); actual != testCase.want {
+				t.Fatalf("unexpected verdict: got=%s want=%s", actual, testCase.want)
+			}
+		})
+	}
+}
+
+func TestProbeECH(t *testing.T) {
+	specs := []struct {
+		spec        string
+		fingerprint string
+		want        string
+	}{
+		{spec: "https@127.0.0.1:0,ech=on", want: echVerdictOK},
+		{spec: "https@127.0.0.1:0,ech=on", fingerprint: fingerprintGo, want: echVerdictOK},
+		{spec: "https@127.0.0.1:0,ech=off", want: echVerdictRejected},
+		{spec: "https@127.0.0.1:0,ech=drop", want: echVerdictBlocked},
+		{spec: "https@127.0.0.1:0,mode=stall", want: echVerdictUnreachable},
+		{spec: "quic@127.0.0.1:0,mode=accept,ech=on", want: echVerdictOK},
+		{spec: "quic@127.0.0.1:0,mode=accept,ech=off", want: echVerdictRejected},
+		{spec: "quic@127.0.0.1:0,mode=accept,ech=drop", want: echVerdictBlocked},
+		{spec: "quic@127.0.0.1:0,ech=on", want: echVerdictOK},
+	}
+	var edges []SimEdge
+	for _, spec := range specs {
+		edge, err := ParseSimEdge(spec.spec, SimEdge{})
+		if err != nil {
+			t.Fatalf("parse %s: %v", spec.spec, err)
+		}
+		edges = append(edges, edge)
+	}
+	var wgKey [32]byte
+	sim, err := StartSimulator(edges, wgKey)
+	if err != nil {
+		t.Fatalf("start simulator: %v", err)
+	}
+	defer sim.Close()
+
+	for i, spec := range specs {
+		t.Run(spec.spec+"/"+spec.fingerprint, func(t *testing.T) {
+			fingerprint, err := ParseFingerprint(spec.fingerprint)
+			if err != nil {
+				t.Fatalf("parse fingerprint: %v", err)
+			}
+			opts := ProbeOptions{ECH: sim.ECHConfigList, Fingerprint: fingerprint}
+			check := ProbeECH(context.Background(), simEndpoint(t, sim.Edges[i]), 300*time.Millisecond, opts)
+			if actual := check.Verdict(); actual != spec.want {
+				t.Fatalf("unexpected verdict: got=%s want=%s (%s, err=%v)", actual, spec.want, check, check.ECH.Err)
+			}
+		})
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+// uTLS ClientHello 指纹：DPI 对不同指纹的处理不同，HTTPS / H2 探测应使用与实际流量一致的指纹。
+// 内置 Chrome、Firefox、Safari、iOS、Edge、随机与原生 Go TLS，也可从文件加载自定义 ClientHello
+// (抓包得到的原始字节 / hex，或 uTLS 的 JSON spec)。
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+// fingerprintMatrixTopN 为做指纹矩阵探测的候选数量。
+const fingerprintMatrixTopN = 5
+
+// TLS 记录类型与握手消息类型 (RFC 8446 §5.1, §4)。
+const (
+	tlsRecordHandshake      = 0x16
+	tlsHandshakeClientHello = 0x01
+)
+
+// 内置指纹名。
+const (
+	fingerprintChrome  = "chrome"
+	fingerprintFirefox = "firefox"
+	fingerprintSafari  = "safari"
+	fingerprintIOS     = "ios"
+	fingerprintEdge    = "edge"
+	fingerprintRandom  = "random" // 每个连接随机生成
+	fingerprintGo      = "go"     // crypto/tls 原生 ClientHello
+	fingerprintCustom  = "custom:"
+)
+
+var builtinFingerprints = map[string]utls.ClientHelloID{
+	fingerprintChrome:  utls.HelloChrome_Auto,
+	fingerprintFirefox: utls.HelloFirefox_Auto,
+	fingerprintSafari:  utls.HelloSafari_Auto,
+	fingerprintIOS:     utls.HelloIOS_Auto,
+	fingerprintEdge:    utls.HelloEdge_Auto,
+	fingerprintRandom:  utls.HelloRandomized,
+	fingerprintGo:      utls.HelloGolang,
+}
+
+// allFingerprints 为 -fingerprint-matrix all 的顺序。
+var allFingerprints = []string{
+	fingerprintChrome, fingerprintFirefox, fingerprintSafari, fingerprintIOS,
+	fingerprintEdge, fingerprintRandom, fingerprintGo,
+}
+
+// Fingerprint selects the ClientHello sent by the uTLS based probes.
+type Fingerprint struct {
+	Name string
+	id   utls.ClientHelloID
+	// custom 为自定义 ClientHello (原始字节或 JSON)。ApplyPreset 会改写 spec，
+	// 因此每个连接都重新解析。
+	custom []byte
+}
+
+func (fingerprint Fingerprint) String() string {
+	if fingerprint.Name == "" {
+		return fingerprintChrome
+	}
+	return fingerprint.Name
+}
+
+// ParseFingerprint 解析 -fingerprint：内置名或 custom:<文件>。
+func ParseFingerprint(value string) (Fingerprint, error) {
+	value = strings.TrimSpace(value)
+	if path, ok := strings.CutPrefix(value, fingerprintCustom); ok {
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return Fingerprint{}, fmt.Errorf("read custom fingerprint: %w", err)
+		}
+		fingerprint := Fingerprint{Name: value, custom: decodeClientHello(raw)}
+		if _, err := fingerprint.customSpec(); err != nil {
+			return Fingerprint{}, fmt.Errorf("invalid custom fingerprint %s: %w", path, err)
+		}
+		return fingerprint, nil
+	}
+	name := strings.ToLower(value)
+	if name == "" {
+		name = fingerprintChrome
+	}
+	id, ok := builtinFingerprints[name]
+	if !ok {
+		return Fingerprint{}, fmt.Errorf("invalid fingerprint %q: want %s | custom:<file>", value, strings.Join(allFingerprints, " | "))
+	}
+	return Fingerprint{Name: name, id: id}, nil
+}
+
+// ParseFingerprintList 解析 -fingerprint-matrix：逗号分隔的指纹列表，all 展开为全部内置指纹。
+func ParseFingerprintList(value string) ([]Fingerprint, error) {
+	var names []string
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name == "all" {
+			names = append(names, allFingerprints...)
+		} else if name != "" {
+			names = append(names, name)
+		}
+	}
+	var fingerprints []Fingerprint
+	for _, name := range names {
+		fingerprint, err := ParseFingerprint(name)
+		if err != nil {
+			return nil, err
+		}
+		fingerprints = append(fingerprints, fingerprint)
+	}
+	if len(fingerprints) == 0 {
+		return nil, fmt.Errorf("invalid fingerprint list %q: no fingerprints", value)
+	}
+	return fingerprints, nil
+}
+
+// joinFingerprints 用于 dry-run 输出。
+func joinFingerprints(fingerprints []Fingerprint) string {
+	names := make([]string, 0, len(fingerprints))
+	for _, fingerprint := range fingerprints {
+		names = append(names, fingerprint.String())
+	}
+	return strings.Join(names, ", ")
+}
+
+// decodeClientHello 接受 JSON、hex 文本或原始字节；只有 Handshake 消息 (没有 TLS 记录头)
+// 时补上记录头，Fingerprinter 只解析完整记录。
+func decodeClientHello(raw []byte) []byte {
+	trimmed := bytes.TrimSpace(raw)
+	if bytes.HasPrefix(trimmed, []byte("{")) {
+		return trimmed
+	}
+	if decoded, err := hex.DecodeString(string(bytes.Join(bytes.Fields(trimmed), nil))); err == nil {
+		raw = decoded
+	}
+	if len(raw) > 0 && raw[0] == tlsHandshakeClientHello && len(raw) <= 0xffff {
+		record := []byte{tlsRecordHandshake, 0x03, 0x01, byte(len(raw) >> 8), byte(len(raw))}
+		raw = append(record, raw...)
+	}
+	return raw
+}
+
+func (fingerprint Fingerprint) customSpec() (*utls.ClientHelloSpec, error) {
+	fingerprinter := &utls.Fingerprinter{}
+	if bytes.HasPrefix(fingerprint.custom, []byte("{")) {
+		return fingerprinter.UnmarshalJSONClientHello(fingerprint.custom)
+	}
+	return fingerprinter.FingerprintClientHello(fingerprint.custom)
+}
+
+// echCapable 报告指纹的 ClientHello 是否带 encrypted_client_hello 扩展：uTLS 只在 spec 中
+// 存在该扩展时发送 ECH，否则在本地构造外层 ClientHello 时失败。随机指纹不保证带该扩展。
+func (fingerprint Fingerprint) echCapable() bool {
+	var spec *utls.ClientHelloSpec
+	switch id := fingerprint.clientHelloID(); {
+	case fingerprint.custom != nil:
+		var err error
+		if spec, err = fingerprint.customSpec(); err != nil {
+			return false
+		}
+	case id == utls.HelloGolang:
+		return true
+	case id == utls.HelloRandomized:
+		return false
+	default:
+		fixed, err := utls.UTLSIdToSpec(id)
+		if err != nil {
+			return false
+		}
+		spec = &fixed
+	}
+	return slices.ContainsFunc(spec.Extensions, func(extension utls.TLSExtension) bool {
+		_, ok := extension.(utls.EncryptedClientHelloExtension)
+		return ok
+	})
+}
+
+func (fingerprint Fingerprint) clientHelloID() utls.ClientHelloID {
+	if fingerprint.id == (utls.ClientHelloID{}) {
+		return utls.HelloChrome_Auto
+	}
+	return fingerprint.id
+}
+
+// newUClient 以所选指纹包装连接；keyShare 非 default 时裁剪 key_share 与
+// supported_groups 扩展，只保留对应的组 (及 GREASE)，其余扩展保持不变。
+func newUClient(conn net.Conn, config *utls.Config, fingerprint Fingerprint, keyShare string) (*utls.UConn, error) {
+	if config.EncryptedClientHelloConfigList != nil && !fingerprint.echCapable() {
+		return nil, fmt.Errorf("fingerprint %s has no encrypted_client_hello extension", fingerprint)
+	}
+	groups := utlsKeyShareGroups(keyShare)
+	var spec *utls.ClientHelloSpec
+	switch id := fingerprint.clientHelloID(); {
+	case fingerprint.custom != nil:
+		var err error
+		if spec, err = fingerprint.customSpec(); err != nil {
+			return nil, fmt.Errorf("custom client hello spec: %w", err)
+		}
+	case groups == nil:
+		return utls.UClient(conn, config, id), nil
+	case id == utls.HelloGolang:
+		// 原生 Go ClientHello 按 CurvePreferences 生成 key share
+		config = config.Clone()
+		config.CurvePreferences = groups
+		return utls.UClient(conn, config, id), nil
+	case id == utls.HelloRandomized:
+		return nil, fmt.Errorf("key share %s needs a fixed fingerprint, not %s", keyShare, fingerprint)
+	default:
+		fixed, err := utls.UTLSIdToSpec(id)
+		if err != nil {
+			return nil, fmt.Errorf("%s client hello spec: %w", fingerprint, err)
+		}
+		spec = &fixed
+	}
+	if groups != nil {
+		trimKeyShares(spec, groups)
+	}
+
+	uConn := utls.UClient(conn, config, utls.HelloCustom)
+	if err := uConn.ApplyPreset(spec); err != nil {
+		return nil, fmt.Errorf("apply client hello spec: %w", err)
+	}
+	// uTLS 握手要求存在经典 ECDHE 私钥，仅 PQ 时借用混合 key share 中的 X25519 部分
+	if keys := uConn.HandshakeState.State13.KeyShareKeys; keys != nil && keys.Ecdhe == nil {
+		keys.Ecdhe = keys.MlkemEcdhe
+	}
+	return uConn, nil
+}
+
+// trimKeyShares 只保留 groups 中的组与 GREASE；key share 被删空时补上 groups[0]。
+func trimKeyShares(spec *utls.ClientHelloSpec, groups []utls.CurveID) {
+	keep := func(group utls.CurveID) bool {
+		return group == utls.GREASE_PLACEHOLDER || slices.Contains(groups, group)
+	}
+	for _, extension := range spec.Extensions {
+		switch extension := extension.(type) {
+		case *utls.KeyShareExtension:
+			extension.KeyShares = slices.DeleteFunc(extension.KeyShares, func(share utls.KeyShare) bool { return !keep(share.Group) })
+			if len(extension.KeyShares) == 0 || (len(extension.KeyShares) == 1 && extension.KeyShares[0].Group == utls.GREASE_PLACEHOLDER) {
+				extension.KeyShares = append(extension.KeyShares, utls.KeyShare{Group: groups[0]})
+			}
+		case *utls.SupportedCurvesExtension:
+			extension.Curves = slices.DeleteFunc(extension.Curves, func(group utls.CurveID) bool { return !keep(group) })
+		}
+	}
+}
+
+// FingerprintResult is the outcome of one handshake with a given fingerprint.
+type FingerprintResult struct {
+	Fingerprint string
+	Outcome     string
+	Latency     time.Duration
+	Err         error
+}
+
+func (result FingerprintResult) String() string {
+	if result.Outcome == SNIServerHello || result.Outcome == SNIAlert {
+		return fmt.Sprintf("%s=%s(%dms)", result.Fingerprint, result.Outcome, result.Latency.Milliseconds())
+	}
+	return result.Fingerprint + "=" + result.Outcome
+}
+
+// FingerprintMatrix holds the per-fingerprint outcomes of one endpoint.
+type FingerprintMatrix struct {
+	Endpoint string
+	Results  []FingerprintResult
+}
+
+// CheckFingerprintMatrix 对每个候选依次以每个指纹握手一次，结果归类与 SNI 矩阵相同。
+func CheckFingerprintMatrix(ctx context.Context, candidates []Endpoint, fingerprints []Fingerprint, timeout time.Duration, opts ProbeOptions) []FingerprintMatrix {
+	matrices := make([]FingerprintMatrix, 0, len(candidates))
+	for _, endpoint := range candidates {
+		if endpoint.SNI == "" {
+			endpoint.SNI = DefaultSNI
+		}
+		matrix := FingerprintMatrix{Endpoint: endpoint.Address()}
+		for _, fingerprint := range fingerprints {
+			opts.Fingerprint = fingerprint
+			outcome, latency, err := probeHTTPSServerHello(ctx, endpoint, timeout, opts)
+			matrix.Results = append(matrix.Results, FingerprintResult{Fingerprint: fingerprint.String(), Outcome: outcome, Latency: latency, Err: err})
+		}
+		matrices = append(matrices, matrix)
+	}
+	return matrices
+}
+
+// PrintFingerprintMatrix 每个 endpoint 输出一行，最后按指纹汇总完成握手的比例。
+func PrintFingerprintMatrix(w io.Writer, fingerprints []Fingerprint, matrices []FingerprintMatrix) {
+	serverHellos := make(map[string]int, len(fingerprints))
+	for _, matrix := range matrices {
+		cells := make([]string, 0, len(matrix.Results))
+		for _, result := range matrix.Results {
+			cells = append(cells, result.String())
+			if result.Outcome == SNIServerHello {
+				serverHellos[result.Fingerprint]++
+			}
+		}
+		fmt.Fprintf(w, "Fingerprint: %s %s\n", matrix.Endpoint, strings.Join(cells, " "))
+	}
+	for _, fingerprint := range fingerprints {
+		fmt.Fprintf(w, "Fingerprint summary: %s server-hello=%d/%d\n", fingerprint, serverHellos[fingerprint.String()], len(matrices))
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+// captureClientHello 返回 Chrome 指纹 ClientHello 的原始字节，用作自定义指纹。
+func captureClientHello(t *testing.T) []byte {
+	t.Helper()
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	uConn := utls.UClient(client, &utls.Config{ServerName: DefaultSNI}, utls.HelloChrome_Auto)
+	if err := uConn.BuildHandshakeState(); err != nil {
+		t.Fatalf("build client hello: %v", err)
+	}
+	return uConn.HandshakeState.Hello.Raw
+}
+
+func TestParseFingerprint(t *testing.T) {
+	dir := t.TempDir()
+	hexFile := filepath.Join(dir, "chrome.hex")
+	if err := os.WriteFile(hexFile, []byte(hex.EncodeToString(captureClientHello(t))+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	badFile := filepath.Join(dir, "bad.bin")
+	if err := os.WriteFile(badFile, []byte("not a client hello"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{value: "", want: "chrome"},
+		{value: "chrome", want: "chrome"},
+		{value: "Firefox", want: "firefox"},
+		{value: " go ", want: "go"},
+		{value: "random", want: "random"},
+		{value: "custom:" + hexFile, want: "custom:" + hexFile},
+		{value: "opera", wantErr: true},
+		{value: "custom:" + badFile, wantErr: true},
+		{value: "custom:" + filepath.Join(dir, "missing"), wantErr: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.value, func(t *testing.T) {
+			fingerprint, err := ParseFingerprint(tc.value)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got %s", fingerprint)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if fingerprint.String() != tc.want {
+				t.Fatalf("unexpected fingerprint: got=%s want=%s", fingerprint, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseFingerprintList(t *testing.T) {
+	testCases := []struct {
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{value: "all", want: strings.Join(allFingerprints, ", ")},
+		{value: "chrome, firefox,,go", want: "chrome, firefox, go"},
+		{value: ",", wantErr: true},
+		{value: "chrome,opera", wantErr: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.value, func(t *testing.T) {
+			fingerprints, err := ParseFingerprintList(tc.value)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got %v", fingerprints)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if actual := joinFingerprints(fingerprints); actual != tc.want {
+				t.Fatalf("unexpected list: got=%s want=%s", actual, tc.want)
+			}
+		})
+	}
+}
+
+func TestNewUClientKeyShare(t *testing.T) {
+	testCases := []struct {
+		fingerprint string
+		keyShare    string
+		wantErr     bool
+	}{
+		{fingerprint: "firefox", keyShare: keySharePQ},
+		{fingerprint: "safari", keyShare: keyShareClassical},
+		{fingerprint: "go", keyShare: keySharePQ},
+		{fingerprint: "random", keyShare: keyShareDefault},
+		{fingerprint: "random", keyShare: keySharePQ, wantErr: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.fingerprint+"/"+tc.keyShare, func(t *testing.T) {
+			fingerprint, err := ParseFingerprint(tc.fingerprint)
+			if err != nil {
+				t.Fatal(err)
+			}
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+			_, err = newUClient(client, &utls.Config{ServerName: DefaultSNI}, fingerprint, tc.keyShare)
+			if tc.wantErr != (err != nil) {
+				t.Fatalf("unexpected error: %v (wantErr=%t)", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckFingerprintMatrix(t *testing.T) {
+	edge, err := ParseSimEdge("https@127.0.0.1:0,pq=off", SimEdge{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wgKey [32]byte
+	sim, err := StartSimulator([]SimEdge{edge}, wgKey)
+	if err != nil {
+		t.Fatalf("start simulator: %v", err)
+	}
+	defer sim.Close()
+
+	customFile := filepath.Join(t.TempDir(), "chrome.bin")
+	if err := os.WriteFile(customFile, captureClientHello(t), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	fingerprints, err := ParseFingerprintList("all,custom:" + customFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoint := simEndpoint(t, sim.Edges[0])
+
+	matrices := CheckFingerprintMatrix(context.Background(), []Endpoint{endpoint}, fingerprints, time.Second, ProbeOptions{})
+	if len(matrices) != 1 || len(matrices[0].Results) != len(fingerprints) {
+		t.Fatalf("unexpected matrix shape: %+v", matrices)
+	}
+	for _, result := range matrices[0].Results {
+		if result.Outcome != SNIServerHello {
+			t.Errorf("%s: unexpected outcome %s (%v)", result.Fingerprint, result.Outcome, result.Err)
+		}
+	}
+
+	// 服务端不支持 PQ：只发 X25519MLKEM768 时应在 ServerHello 前被拒绝
+	pq := ProbeOptions{KeyShare: keySharePQ}
+	for _, name := range []string{"firefox", "go"} {
+		fingerprint, _ := ParseFingerprint(name)
+		pq.Fingerprint = fingerprint
+		outcome, _, err := probeHTTPSServerHello(context.Background(), endpoint, time.Second, pq)
+		if outcome != SNIAlert {
+			t.Errorf("%s pq: unexpected outcome %s (%v)", name, outcome, err)
+		}
+	}
+
+	var out bytes.Buffer
+	PrintFingerprintMatrix(&out, fingerprints, matrices)
+	want := "Fingerprint summary: chrome server-hello=1/1\n"
+	if !strings.Contains(out.String(), want) || !strings.HasPrefix(out.String(), "Fingerprint: "+endpoint.Address()+" chrome=server-hello(") {
+		t.Fatalf("unexpected output:\n%s", out.String())
+	}
+}
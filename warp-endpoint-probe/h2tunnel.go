@@ -0,0 +1,210 @@
+package main
+
+// H2Tunnel 回退探测：warp-svc 在 UDP/443 不通时改走 TCP/443 上的 HTTP/2，
+// SNI 为 *-masque-proxy.cloudflareclient.com。探针分别记录 TCP 建连、TLS 握手，
+// 以及可选的 extended CONNECT (RFC 8441, :protocol cf-connect-ip) 响应耗时。
+// x/net 的 http2.Transport 默认关闭 extended CONNECT，这里直接用 Framer 收发帧。
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	utls "github.com/refraction-networking/utls"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+var (
+	errH2NotNegotiated     = errors.New("server did not negotiate h2")
+	errH2NoExtendedConnect = errors.New("server does not advertise SETTINGS_ENABLE_CONNECT_PROTOCOL")
+)
+
+// H2Options controls the HTTP/2 tunnel probe.
+type H2Options struct {
+	// Connect 为 true 时在握手后发送 extended CONNECT 并等待响应头。
+	Connect bool
+}
+
+// H2Timing 为一次 H2Tunnel 探测的分阶段耗时。
+type H2Timing struct {
+	Connect time.Duration
+	TLS     time.Duration
+	// Response 为 CONNECT 发出到响应头到达的耗时，未发送 CONNECT 时为 0。
+	Response time.Duration
+	Status   int
+}
+
+func (timing H2Timing) String() string {
+	text := fmt.Sprintf("connect=%s tls=%s", timing.Connect.Round(time.Microsecond), timing.TLS.Round(time.Microsecond))
+	if timing.Status != 0 {
+		text += fmt.Sprintf(" status=%d response=%s", timing.Status, timing.Response.Round(time.Microsecond))
+	}
+	return text
+}
+
+// ProbeH2Tunnel 以 ALPN h2 完成 TLS 握手，延迟为 TCP 建连 + TLS 握手。
+// 与 HTTPS 探测不同，TLS 失败或未协商出 h2 都视为不可用：回退路径必须真正能承载 HTTP/2。
+func ProbeH2Tunnel(ctx context.Context, endpoint Endpoint, timeout time.Duration, opts ProbeOptions) (ProbeSample, error) {
+	if timeout <= 0 {
+		timeout = 2 * time.Second
+	}
+	probeCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	serverName := endpoint.SNI
+	if serverName == "" {
+		serverName = DefaultSNI
+	}
+
+	dialer := &net.Dialer{Timeout: timeout}
+	start := time.Now()
+	tcpConn, err := dialTCPCaptured(func() (net.Conn, error) {
+		return dialer.DialContext(probeCtx, "tcp", endpoint.Address())
+	}, opts.Capture, endpoint)
+	if err != nil {
+		return ProbeSample{}, fmt.Errorf("tcp dial %s: %w", endpoint.Address(), err)
+	}
+	defer tcpConn.Close()
+	timing := H2Timing{Connect: time.Since(start)}
+
+	certs := &certCapture{}
+	tlsConfig := &utls.Config{
+		ServerName:            serverName,
+		InsecureSkipVerify:    true,
+		NextProtos:            []string{http2.NextProtoTLS},
+		VerifyPeerCertificate: certs.verify,
+	}
+	(&echRejection{}).applyUTLS(tlsConfig, opts.ECH)
+	if cert := opts.MASQUE.Certificate; cert != nil {
+		tlsConfig.Certificates = []utls.Certificate{{Certificate: cert.Certificate, PrivateKey: cert.PrivateKey, Leaf: cert.Leaf}}
+	}
+	uConn, err := newUClient(tcpConn, tlsConfig, opts.Fingerprint, opts.KeyShare)
+	if err != nil {
+		return ProbeSample{}, err
+	}
+	tlsStart := time.Now()
+	if err := uConn.HandshakeContext(probeCtx); err != nil {
+		return ProbeSample{}, fmt.Errorf("utls handshake %s: %w", endpoint.Address(), err)
+	}
+	timing.TLS = time.Since(tlsStart)
+	if proto := uConn.ConnectionState().NegotiatedProtocol; proto != http2.NextProtoTLS {
+		return ProbeSample{}, fmt.Errorf("%s: %w (alpn=%q)", endpoint.Address(), errH2NotNegotiated, proto)
+	}
+	sample := ProbeSample{Latency: timing.Connect + timing.TLS, H2: &timing, Cert: certs.cert()}
+
+	if opts.H2.Connect {
+		deadline, _ := probeCtx.Deadline()
+		_ = uConn.SetDeadline(deadline)
+		timing.Status, timing.Response, err = h2ExtendedConnect(uConn, serverName, opts.MASQUE.PostQuantum)
+		if err != nil {
+			err = fmt.Errorf("h2 connect %s: %w", endpoint.Address(), err)
+		}
+	}
+	return sample, err
+}
+
+// h2ExtendedConnect 在 stream 1 上发送 CF-CONNECT-IP extended CONNECT，
+// 返回响应状态码与从发送 HEADERS 到收到响应头的耗时。
+func h2ExtendedConnect(conn net.Conn, authority string, postQuantum bool) (int, time.Duration, error) {
+	if _, err := conn.Write([]byte(http2.ClientPreface)); err != nil {
+		return 0, 0, err
+	}
+	framer := http2.NewFramer(conn, conn)
+	framer.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+	if err := framer.WriteSettings(); err != nil {
+		return 0, 0, err
+	}
+
+	// 服务端的第一个帧必须是 SETTINGS
+	frame, err := framer.ReadFrame()
+	if err != nil {
+		return 0, 0, err
+	}
+	settings, ok := frame.(*http2.SettingsFrame)
+	if !ok || settings.IsAck() {
+		return 0, 0, fmt.Errorf("unexpected first frame %s", frame.Header().Type)
+	}
+	if value, ok := settings.Value(http2.SettingEnableConnectProtocol); !ok || value != 1 {
+		return 0, 0, errH2NoExtendedConnect
+	}
+	if err := framer.WriteSettingsAck(); err != nil {
+		return 0, 0, err
+	}
+
+	var block bytes.Buffer
+	encoder := hpack.NewEncoder(&block)
+	for _, field := range []hpack.HeaderField{
+		{Name: ":method", Value: "CONNECT"},
+		{Name: ":protocol", Value: masqueConnectProtocol},
+		{Name: ":scheme", Value: "https"},
+		{Name: ":authority", Value: authority},
+		{Name: ":path", Value: "/"},
+		{Name: "cf-connect-proto", Value: masqueConnectProtocol},
+		{Name: "pq-enabled", Value: strconv.FormatBool(postQuantum)},
+	} {
+		_ = encoder.WriteField(field)
+	}
+	start := time.Now()
+	if err := framer.WriteHeaders(http2.HeadersFrameParam{StreamID: 1, BlockFragment: block.Bytes(), EndHeaders: true}); err != nil {
+		return 0, 0, err
+	}
+
+	for {
+		frame, err := framer.ReadFrame()
+		if err != nil {
+			return 0, 0, err
+		}
+		switch frame := frame.(type) {
+		case *http2.MetaHeadersFrame:
+			if frame.StreamID != 1 {
+				continue
+			}
+			status, err := strconv.Atoi(frame.PseudoValue("status"))
+			if err != nil {
+				return 0, 0, fmt.Errorf("invalid :status %q", frame.PseudoValue("status"))
+			}
+			return status, time.Since(start), nil
+		case *http2.RSTStreamFrame:
+			return 0, 0, fmt.Errorf("stream reset: %s", frame.ErrCode)
+		case *http2.GoAwayFrame:
+			return 0, 0, fmt.Errorf("goaway: %s", frame.ErrCode)
+		}
+	}
+}
+
+// averageH2Timing 对多轮耗时逐项取平均 (只统计非零值)，状态码取最后一次。
+func averageH2Timing(timings []H2Timing) *H2Timing {
+	if len(timings) == 0 {
+		return nil
+	}
+	avg := func(field func(H2Timing) time.Duration) time.Duration {
+		var total time.Duration
+		var n int
+		for _, timing := range timings {
+			if value := field(timing); value > 0 {
+				total += value
+				n++
+			}
+		}
+		if n == 0 {
+			return 0
+		}
+		return total / time.Duration(n)
+	}
+	result := &H2Timing{
+		Connect:  avg(func(t H2Timing) time.Duration { return t.Connect }),
+		TLS:      avg(func(t H2Timing) time.Duration { return t.TLS }),
+		Response: avg(func(t H2Timing) time.Duration { return t.Response }),
+	}
+	for _, timing := range timings {
+		if timing.Status != 0 {
+			result.Status = timing.Status
+		}
+	}
+	return result
+}
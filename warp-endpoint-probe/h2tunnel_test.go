@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+	"time"
+)
+
+func TestProbeH2Tunnel(t *testing.T) {
+	var edges []SimEdge
+	for _, spec := range []string{
+		"h2@127.0.0.1:0,latency=5ms",
+		"h2@127.0.0.1:0,mode=refuse,latency=5ms",
+		"h2@127.0.0.1:0,mode=stall",
+		"h2@127.0.0.1:0,mode=reset",
+	} {
+		edge, err := ParseSimEdge(spec, SimEdge{})
+		if err != nil {
+			t.Fatalf("parse %s: %v", spec, err)
+		}
+		edges = append(edges, edge)
+	}
+	var wgKey [32]byte
+	sim, err := StartSimulator(edges, wgKey)
+	if err != nil {
+		t.Fatalf("start simulator: %v", err)
+	}
+	defer sim.Close()
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	cert, err := selfSignedDeviceCertificate(key)
+	if err != nil {
+		t.Fatalf("device certificate: %v", err)
+	}
+	withCert := ProbeOptions{MASQUE: MASQUEOptions{Certificate: cert}, H2: H2Options{Connect: true}}
+	anonymous := ProbeOptions{H2: H2Options{Connect: true}}
+
+	testCases := []struct {
+		name       string
+		edge       int
+		opts       ProbeOptions
+		wantStatus int
+		wantErr    bool
+	}{
+		{name: "connect_200", edge: 0, opts: withCert, wantStatus: 200},
+		{name: "connect_without_cert", edge: 0, opts: anonymous, wantStatus: 403},
+		{name: "handshake_only", edge: 0, opts: ProbeOptions{}},
+		{name: "refuse", edge: 1, opts: withCert, wantStatus: 403},
+		{name: "stall", edge: 2, opts: withCert, wantErr: true},
+		{name: "reset", edge: 3, opts: withCert, wantErr: true},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			endpoint := simEndpoint(t, sim.Edges[testCase.edge])
+			endpoint.SNI = MasqueSNIs[1]
+			sample, err := ProbeH2Tunnel(context.Background(), endpoint, 500*time.Millisecond, testCase.opts)
+			if testCase.wantErr {
+				if err == nil || sample.Latency != 0 {
+					t.Fatalf("expected failure: sample=%+v err=%v", sample, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			timing := sample.H2
+			if timing == nil || timing.Connect <= 0 || timing.TLS <= 0 || sample.Latency != timing.Connect+timing.TLS {
+				t.Fatalf("missing phase timing: %+v", sample)
+			}
+			if timing.Status != testCase.wantStatus {
+				t.Fatalf("unexpected status: got=%d want=%d", timing.Status, testCase.wantStatus)
+			}
+			if testCase.wantStatus != 0 && timing.Response < 5*time.Millisecond {
+				t.Fatalf("response time missing simulated latency: %s", timing)
+			}
+		})
+	}
+}
+
+func TestAverageH2Timing(t *testing.T) {
+	if averageH2Timing(nil) != nil {
+		t.Fatal("expected nil for no samples")
+	}
+	actual := averageH2Timing([]H2Timing{
+		{Connect: 10 * time.Millisecond, TLS: 20 * time.Millisecond},
+		{Connect: 30 * time.Millisecond, TLS: 40 * time.Millisecond, Response: 8 * time.Millisecond, Status: 200},
+	})
+	want := H2Timing{Connect: 20 * time.Millisecond, TLS: 30 * time.Millisecond, Response: 8 * time.Millisecond, Status: 200}
+	if *actual != want {
+		t.Fatalf("unexpected average: got=%+v want=%+v", *actual, want)
+	}
+}
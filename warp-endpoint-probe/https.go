@@ -4,17 +4,87 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"sync"
 	"time"
 
 	utls "github.com/refraction-networking/utls"
 )
 
-// ProbeHTTPSHandshake measures dial + TLS handshake latency on TCP/443.
-// Uses uTLS with Chrome fingerprint to bypass DPI/GFW SNI detection.
-func ProbeHTTPSHandshake(ctx context.Context, endpoint Endpoint, timeout time.Duration) (time.Duration, error) {
+// HTTPS 握手阶段结论。
+const (
+	httpsTLSOK      = "ok"      // 完成握手
+	httpsTLSAlert   = "alert"   // 服务端有回应 (ServerHello 或 alert)，但握手未完成
+	httpsTLSReset   = "reset"   // TCP 已连通，TLS 无回应即被重置或关闭
+	httpsTLSTimeout = "timeout" // TCP 已连通，TLS 无任何回应
+)
+
+const (
+	// TLS 首个回应比 TCP 建连慢 httpsDPIFactor 倍且多出 httpsDPIMinGap 以上时，视为疑似 DPI：
+	// 正常情况下二者都是一个 RTT。
+	httpsDPIFactor = 3
+	httpsDPIMinGap = 100 * time.Millisecond
+)
+
+// HTTPSTiming 为一次 HTTPS 探测的分阶段耗时。
+type HTTPSTiming struct {
+	Connect time.Duration
+	// ServerHello 为 ClientHello 发出到首个服务端 TLS 记录到达的耗时。
+	ServerHello time.Duration
+	// Handshake 为 ClientHello 发出到握手完成的耗时，握手失败时为 0。
+	Handshake time.Duration
+	TLS       string
+	// Split 为让握手得到回应的 ClientHello 分片策略，不分片即有回应时为空。
+	Split string
+}
+
+func (timing HTTPSTiming) String() string {
+	text := fmt.Sprintf("connect=%s server-hello=%s handshake=%s tls=%s", timing.Connect.Round(time.Microsecond),
+		timing.ServerHello.Round(time.Microsecond), timing.Handshake.Round(time.Microsecond), timing.TLS)
+	if timing.Split != "" {
+		text += " split=" + timing.Split
+	}
+	return text
+}
+
+// DPISuspect 报告 TCP 建连正常但 TLS 被重置、无回应、明显变慢，或只有分片后才有回应。
+func (timing HTTPSTiming) DPISuspect() bool {
+	switch {
+	case timing.TLS == httpsTLSReset || timing.TLS == httpsTLSTimeout:
+		return true
+	case timing.Split != "":
+		return true
+	}
+	return timing.ServerHello > httpsDPIFactor*timing.Connect && timing.ServerHello-timing.Connect > httpsDPIMinGap
+}
+
+// ProbeHTTPSHandshake measures TCP connect, ClientHello→ServerHello and full TLS handshake on TCP/443.
+// Uses a uTLS browser fingerprint (Chrome by default, see -fingerprint) to bypass DPI/GFW SNI detection.
+// 延迟取 TCP 建连 + 首个服务端记录：服务端以 alert 拒绝同样有效，TLS 无回应时不计延迟。
+// TLS 被重置或无回应时按 opts.TLSSplit 的顺序换用下一种 ClientHello 分片策略重试，每次重新建连。
+func ProbeHTTPSHandshake(ctx context.Context, endpoint Endpoint, timeout time.Duration, opts ProbeOptions) (ProbeSample, error) {
 	if timeout <= 0 {
 		timeout = 2 * time.Second
 	}
+	strategies := opts.TLSSplit
+	if len(strategies) == 0 {
+		strategies = []string{tlsSplitNone}
+	}
+	var sample ProbeSample
+	var err error
+	for _, strategy := range strategies {
+		sample, err = probeHTTPSOnce(ctx, endpoint, timeout, opts, strategy)
+		if timing := sample.HTTPS; timing == nil || timing.TLS == httpsTLSOK || timing.TLS == httpsTLSAlert {
+			if timing != nil && strategy != tlsSplitNone {
+				timing.Split = strategy
+			}
+			break
+		}
+	}
+	return sample, err
+}
+
+// probeHTTPSOnce 以指定分片策略做一次 HTTPS 探测。
+func probeHTTPSOnce(ctx context.Context, endpoint Endpoint, timeout time.Duration, opts ProbeOptions, strategy string) (ProbeSample, error) {
 
 	probeCtx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
@@ -28,32 +98,150 @@ func ProbeHTTPSHandshake(ctx context.Context, endpoint Endpoint, timeout time.Du
 
 	// 1. 建立底层 TCP 连接
 	start := time.Now()
-	tcpConn, err := dialer.DialContext(probeCtx, "tcp", endpoint.Address())
+	tcpConn, err := dialTCPCaptured(func() (net.Conn, error) {
+		return dialer.DialContext(probeCtx, "tcp", endpoint.Address())
+	}, opts.Capture, endpoint)
 	if err != nil {
-		return 0, fmt.Errorf("tcp dial %s: %w", endpoint.Address(), err)
+		return ProbeSample{}, fmt.Errorf("tcp dial %s: %w", endpoint.Address(), err)
 	}
+	timing := HTTPSTiming{Connect: time.Since(start)}
+	phases := &tlsPhaseConn{Conn: &splitConn{Conn: tcpConn, strategy: strategy}}
+	defer phases.Close()
 
 	// 2. 构造 uTLS 配置并注入目标 SNI
+	certs := &certCapture{}
 	tlsConfig := &utls.Config{
-		ServerName:         serverName,
-		InsecureSkipVerify: true,
+		ServerName:            serverName,
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: certs.verify,
 	}
+	ech := &echRejection{}
+	ech.applyUTLS(tlsConfig, opts.ECH)
 
-	// 3. 包装 TCP 连接，贴上 Chrome 浏览器的 TLS 指纹特征
-	uConn := utls.UClient(tcpConn, tlsConfig, utls.HelloChrome_Auto)
+	// 3. 包装 TCP 连接，贴上所选浏览器的 TLS 指纹特征
+	uConn, err := newUClient(phases, tlsConfig, opts.Fingerprint, opts.KeyShare)
+	if err != nil {
+		return ProbeSample{}, err
+	}
 
 	// 4. 触发伪装握手
-	if err := uConn.HandshakeContext(probeCtx); err != nil {
-		latency := time.Since(start)
-		_ = tcpConn.Close()
-		// TCP 已连通但 TLS 握手失败 → 服务端有回应，RTT 仍然有效
-		if latency < timeout-50*time.Millisecond {
-			return latency, err
+	err = uConn.HandshakeContext(probeCtx)
+	done := time.Now()
+	timing.ServerHello = phases.serverHello()
+	switch {
+	case err == nil:
+		timing.TLS, timing.Handshake = httpsTLSOK, done.Sub(phases.clientHello())
+	case timing.ServerHello > 0:
+		timing.TLS = httpsTLSAlert
+	case isTimeoutError(err):
+		timing.TLS = httpsTLSTimeout
+	default:
+		timing.TLS = httpsTLSReset
+	}
+	if timing.ServerHello == 0 {
+		return ProbeSample{HTTPS: &timing}, fmt.Errorf("utls handshake %s: %w", endpoint.Address(), err)
+	}
+	sample := ProbeSample{Latency: timing.Connect + timing.ServerHello, HTTPS: &timing, Cert: certs.cert()}
+	if ech.rejected.Load() {
+		err = fmt.Errorf("%w: %v", errECHRejected, err)
+	}
+	if err != nil {
+		return sample, fmt.Errorf("utls handshake %s: %w", endpoint.Address(), err)
+	}
+
+	// 5. 可选：在同一连接上请求 WARP API，确认该地址真的承载 API
+	if opts.API.enabled() {
+		api := requestWARPAPI(probeCtx, uConn, opts.API.path())
+		sample.API = &api
+	}
+	return sample, nil
+}
+
+// tlsPhaseConn 记录 ClientHello 发出与首个服务端记录到达的时间。
+// ClientHello 以第一次写返回为准：下层 splitConn 分片时，最后一片写出才算发出。
+type tlsPhaseConn struct {
+	net.Conn
+	mu          sync.Mutex
+	wrote, read time.Time
+	// first 为首个服务端记录的类型 (handshake 即 ServerHello，alert 即握手前被拒绝)
+	first byte
+}
+
+func (c *tlsPhaseConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.mu.Lock()
+	if c.wrote.IsZero() {
+		c.wrote = time.Now()
+	}
+	c.mu.Unlock()
+	return n, err
+}
+
+func (c *tlsPhaseConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.mu.Lock()
+		if c.read.IsZero() {
+			c.read, c.first = time.Now(), b[0]
 		}
-		return 0, fmt.Errorf("utls handshake %s: %w", endpoint.Address(), err)
+		c.mu.Unlock()
+	}
+	return n, err
+}
+
+func (c *tlsPhaseConn) clientHello() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.wrote
+}
+
+// firstRecord 返回首个服务端记录的类型，未收到时为 0。
+func (c *tlsPhaseConn) firstRecord() byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.first
+}
+
+// serverHello 返回 ClientHello 到首个服务端记录的耗时，未收到时为 0。
+func (c *tlsPhaseConn) serverHello() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.wrote.IsZero() || c.read.IsZero() {
+		return 0
 	}
-	latency := time.Since(start)
-	_ = uConn.Close()
+	return c.read.Sub(c.wrote)
+}
 
-	return latency, nil
+// averageHTTPSTiming 对多轮耗时逐项取平均 (只统计非零值)；TLS 结论与分片策略取最后一次有回应的轮次，
+// 全部无回应时取最后一轮。
+func averageHTTPSTiming(timings []HTTPSTiming) *HTTPSTiming {
+	if len(timings) == 0 {
+		return nil
+	}
+	avg := func(field func(HTTPSTiming) time.Duration) time.Duration {
+		var total time.Duration
+		var n int
+		for _, timing := range timings {
+			if value := field(timing); value > 0 {
+				total += value
+				n++
+			}
+		}
+		if n == 0 {
+			return 0
+		}
+		return total / time.Duration(n)
+	}
+	result := &HTTPSTiming{
+		Connect:     avg(func(t HTTPSTiming) time.Duration { return t.Connect }),
+		ServerHello: avg(func(t HTTPSTiming) time.Duration { return t.ServerHello }),
+		Handshake:   avg(func(t HTTPSTiming) time.Duration { return t.Handshake }),
+		TLS:         timings[len(timings)-1].TLS,
+	}
+	for _, timing := range timings {
+		if timing.TLS == httpsTLSOK || timing.TLS == httpsTLSAlert {
+			result.TLS, result.Split = timing.TLS, timing.Split
+		}
+	}
+	return result
 }
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestHTTPSTimingDPISuspect(t *testing.T) {
+	testCases := []struct {
+		name   string
+		timing HTTPSTiming
+		want   bool
+	}{
+		{name: "clean", timing: HTTPSTiming{Connect: 40 * time.Millisecond, ServerHello: 45 * time.Millisecond, TLS: httpsTLSOK}},
+		{name: "alert", timing: HTTPSTiming{Connect: 40 * time.Millisecond, ServerHello: 40 * time.Millisecond, TLS: httpsTLSAlert}},
+		{name: "slow_tls", timing: HTTPSTiming{Connect: 20 * time.Millisecond, ServerHello: 300 * time.Millisecond, TLS: httpsTLSOK}, want: true},
+		{name: "slow_but_far", timing: HTTPSTiming{Connect: 200 * time.Millisecond, ServerHello: 350 * time.Millisecond, TLS: httpsTLSOK}},
+		{name: "small_gap", timing: HTTPSTiming{Connect: time.Millisecond, ServerHello: 50 * time.Millisecond, TLS: httpsTLSOK}},
+		{name: "reset", timing: HTTPSTiming{Connect: 20 * time.Millisecond, TLS: httpsTLSReset}, want: true},
+		{name: "timeout", timing: HTTPSTiming{Connect: 20 * time.Millisecond, TLS: httpsTLSTimeout}, want: true},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			if actual := testCase.timing.DPISuspect(); actual != testCase.want {
+				t.Fatalf("unexpected verdict for %s: got=%t want=%t", testCase.timing, actual, testCase.want)
+			}
+		})
+	}
+}
+
+func TestProbeHTTPSPhases(t *testing.T) {
+	var edges []SimEdge
+	for _, spec := range []string{
+		"https@127.0.0.1:0",
+		"https@127.0.0.1:0,latency=150ms",
+		"https@127.0.0.1:0,mode=reset",
+		"https@127.0.0.1:0,mode=stall",
+		"https@127.0.0.1:0,pq=off",
+	} {
+		edge, err := ParseSimEdge(spec, SimEdge{})
+		if err != nil {
+			t.Fatalf("parse %s: %v", spec, err)
+		}
+		edges = append(edges, edge)
+	}
+	var wgKey [32]byte
+	sim, err := StartSimulator(edges, wgKey)
+	if err != nil {
+		t.Fatalf("start simulator: %v", err)
+	}
+	defer sim.Close()
+
+	testCases := []struct {
+		name        string
+		edge        int
+		opts        ProbeOptions
+		wantTLS     string
+		wantLatency bool
+		wantDPI     bool
+	}{
+		{name: "ok", edge: 0, wantTLS: httpsTLSOK, wantLatency: true},
+		{name: "slow_tls", edge: 1, wantTLS: httpsTLSOK, wantLatency: true, wantDPI: true},
+		{name: "reset", edge: 2, wantTLS: httpsTLSReset, wantDPI: true},
+		{name: "stall", edge: 3, wantTLS: httpsTLSTimeout, wantDPI: true},
+		{name: "alert", edge: 4, opts: ProbeOptions{KeyShare: keySharePQ}, wantTLS: httpsTLSAlert, wantLatency: true},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			sample, err := ProbeHTTPSHandshake(context.Background(), simEndpoint(t, sim.Edges[testCase.edge]), 500*time.Millisecond, testCase.opts)
+			timing := sample.HTTPS
+			if timing == nil || timing.Connect <= 0 {
+				t.Fatalf("missing tcp connect time: sample=%+v err=%v", sample, err)
+			}
+			if timing.TLS != testCase.wantTLS || timing.DPISuspect() != testCase.wantDPI {
+				t.Fatalf("unexpected timing: %s (err=%v)", timing, err)
+			}
+			if (testCase.wantTLS == httpsTLSOK) != (err == nil) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !testCase.wantLatency {
+				if sample.Latency != 0 {
+					t.Fatalf("failed handshake counted as rtt: %s", sample.Latency)
+				}
+				return
+			}
+			if sample.Latency != timing.Connect+timing.ServerHello {
+				t.Fatalf("latency is not connect + server hello: %s vs %s", sample.Latency, timing)
+			}
+			if testCase.wantTLS == httpsTLSOK && timing.Handshake < timing.ServerHello {
+				t.Fatalf("handshake shorter than server hello: %s", timing)
+			}
+		})
+	}
+
+	// TLS 始终无回应时没有 RTT，endpoint 不进入结果而单独返回，TCP 建连耗时仍保留在 HTTPS 中
+	endpoints := []Endpoint{simEndpoint(t, sim.Edges[0]), simEndpoint(t, sim.Edges[2])}
+	results, dpiSuspects := RunProbes(context.Background(), endpoints, 2, 500*time.Millisecond, 2, ProbeOptions{})
+	if len(results) != 1 || results[0].Endpoint != endpoints[0].Address() {
+		t.Fatalf("unexpected results: %+v", results)
+	}
+	if len(dpiSuspects) != 1 || dpiSuspects[0].Endpoint != endpoints[1].Address() ||
+		dpiSuspects[0].Latency != 0 || dpiSuspects[0].HTTPS == nil || !dpiSuspects[0].HTTPS.DPISuspect() {
+		t.Fatalf("reset endpoint kept or not reported: %+v", dpiSuspects)
+	}
+}
@@ -2,31 +2,81 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/base64"
 	"encoding/csv"
 	"flag"
 	"fmt"
+	"net/netip"
 	"os"
 	"runtime"
+	"strings"
 	"time"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "simulate" {
+		runSimulate(os.Args[2:])
+		return
+	}
+
 	mode := flag.String("mode", "tunnel", "Probe mode: tunnel | api")
-	target := flag.String("target", "", "Tunnel target: consumer | wireguard | masque (optional)")
+	target := flag.String("target", "", "Tunnel target: consumer | wireguard | masque | masque-h2 (optional)")
 	ipv6 := flag.Bool("6", false, "Include IPv6 targets")
 	concurrency := flag.Int("n", runtime.NumCPU()*2, "Number of concurrent goroutines")
 	rounds := flag.Int("rounds", 3, "Probe rounds per endpoint (average over N rounds)")
 	sampleN := flag.Int("sample", 0, "IPs to sample per CIDR (0=enumerate all)")
 	cidrOpt := flag.String("cidr", "", "Override or add custom CIDR (e.g. 1.2.3.0/24)")
 	sniOpt := flag.String("sni", "", "Override SNI for TLS proxy probes (e.g. zero-trust-client.cloudflareclient.com)")
+	quicMatrixOpt := flag.String("quic-matrix", "", "Also handshake top QUIC candidates with QUIC v1/v2 x h3 plus this comma-separated ALPN list (h3 alone: -quic-matrix h3)")
+	sniMatrixOpt := flag.String("sni-matrix", "", "Also handshake top QUIC/HTTPS candidates with each SNI: masque (the 4 warp-svc MASQUE names) or a comma list")
 	totalTimeoutStr := flag.String("timeout", "30s", "Hard timeout for all probes")
 	outputFile := flag.String("o", "result.csv", "Output CSV file path")
+	pcapFile := flag.String("pcap", "", "Write probe packets to a pcapng file (synthesized headers)")
+	sourcePortOpt := flag.String("sport", "random", "WireGuard source port: random | <port> | <low>-<high>")
+	progressInterval := flag.Duration("progress", 2*time.Second, "Progress report interval on stderr (0=off)")
+	progressFormatOpt := flag.String("progress-format", "text", "Progress report format: text | json")
+	dryRun := flag.Bool("dry-run", false, "Resolve pool and targets, print the plan and exit without probing")
+	wgPeerKey := flag.String("wg-peer-key", "", "WireGuard peer public key (base64, env WARP_PROBE_WG_PEER_KEY)")
+	wgPrivateKey := flag.String("wg-private-key", "", "WireGuard initiator private key (base64, env WARP_PROBE_WG_PRIVATE_KEY)")
+	wgConfig := flag.String("wg-config", "", "WireGuard config file providing keys (env WARP_PROBE_WG_CONFIG)")
+	wgAddress := flag.String("wg-address", "", "Tunnel addresses for the data-plane check, e.g. 172.16.0.2 (env WARP_PROBE_WG_ADDRESS)")
+	wgDataPlane := flag.Int("wg-dataplane", 0, "In-tunnel ICMP echoes per top candidate after handshake (0=off, needs private key)")
+	wgDataPlaneTarget := flag.String("wg-dataplane-target", "1.1.1.1", "In-tunnel echo target for -wg-dataplane")
+	benchTop := flag.Int("bench", 0, "Userspace WireGuard throughput benchmark on top N candidates (0=off, needs private key)")
+	benchURL := flag.String("bench-url", "https://speed.cloudflare.com/__down?bytes=25000000", "URL fetched (or posted to) through the tunnel for -bench")
+	benchUpload := flag.Int64("bench-upload", 0, "Upload this many bytes via POST instead of downloading (0=download)")
+	benchDuration := flag.Duration("bench-duration", benchmarkDefaultDuration, "Transfer window per -bench candidate, counted from the first byte (setup has its own timeout)")
+	wgClientID := flag.String("wg-client-id", "", "WARP client ID for the reserved bytes: base64 or a,b,c (env WARP_PROBE_WG_CLIENT_ID)")
+	wgRegistration := flag.String("wg-registration", "", "Registration JSON to derive the client ID from (env WARP_PROBE_WG_REGISTRATION)")
+	masqueKey := flag.String("masque-key", "", "MASQUE device private key, EC PEM or base64 DER (env WARP_PROBE_MASQUE_KEY)")
+	masqueCert := flag.String("masque-cert", "", "MASQUE device certificate PEM, self-signed from the key if empty (env WARP_PROBE_MASQUE_CERT)")
+	masquePQ := flag.Bool("masque-pq", false, "Send pq-enabled: true in the MASQUE CONNECT request")
+	fingerprintOpt := flag.String("fingerprint", "chrome", "HTTPS/H2Tunnel uTLS ClientHello: chrome | firefox | safari | ios | edge | random | go | custom:<file> (raw/hex ClientHello or uTLS JSON)")
+	fingerprintMatrixOpt := flag.String("fingerprint-matrix", "", "Also handshake top HTTPS/H2Tunnel candidates with each fingerprint: all or a comma list")
+	tlsSplitOpt := flag.String("tls-split", "none", "HTTPS ClientHello split strategies tried in order while TLS is reset or silent: none | tcp | record | window, a comma list or all")
+	echOpt := flag.String("ech", "", "ECHConfigList (base64, the ech= value of the DNS HTTPS record) to encrypt the QUIC/HTTPS/H2Tunnel ClientHello; top candidates are compared with plaintext SNI")
+	echFile := flag.String("ech-file", "", "Read the ECHConfigList for -ech from a file (raw or base64)")
+	keyShareOpt := flag.String("key-share", "default", "QUIC/HTTPS ClientHello key shares: default (X25519MLKEM768+X25519) | classical | pq (X25519MLKEM768 only)")
+	pqCheck := flag.Bool("pq-check", isEnvTrue("WARP_ENABLE_POST_QUANTUM"), "Compare classical and post-quantum-only handshakes on top QUIC/HTTPS candidates (env WARP_ENABLE_POST_QUANTUM)")
+	pmtuCheck := flag.Bool("pmtu", isEnvTrue("WARP_ENABLE_PMTUD"), "Binary-search the path MTU toward top QUIC/WireGuard candidates with DF probes (env WARP_ENABLE_PMTUD)")
+	certCheck := flag.String("cert-check", "off", "Server certificate check: off (record fingerprint) | mark (tag and rank last) | exclude")
+	certIssuer := flag.String("cert-issuer", "", "Comma-separated issuer O/CN substrings a genuine edge certificate must match (with -cert-check)")
+	certPin := flag.String("cert-pin", "", "Comma-separated base64 SHA-256 SPKI pins; one must appear in the chain (with -cert-check)")
+	apiCheck := flag.String("api-check", "mark", "api mode: GET the WARP API over each completed handshake: off | mark (tag and rank last) | exclude (drop endpoints not serving it)")
+	apiPath := flag.String("api-path", apiDefaultPath, "WARP API path requested by -api-check (Host: api.cloudflareclient.com)")
+	h2Connect := flag.Bool("h2-connect", false, "Send a cf-connect-ip HTTP/2 extended CONNECT on masque-h2 probes and time the response")
+	masqueDataPlane := flag.Int("masque-dataplane", 0, "In-tunnel ICMP echoes over MASQUE datagrams per top candidate (0=off, needs -masque-key and -wg-address)")
 	flag.Parse()
 
 	if *concurrency <= 0 {
 		fmt.Fprintln(os.Stderr, "ERROR: -n must be > 0")
 		os.Exit(2)
 	}
+	if *benchDuration <= 0 {
+		fmt.Fprintln(os.Stderr, "ERROR: -bench-duration must be > 0")
+		os.Exit(2)
+	}
 
 	totalTimeout, err := time.ParseDuration(*totalTimeoutStr)
 	if err != nil {
@@ -34,14 +84,148 @@ func main() {
 		os.Exit(2)
 	}
 
-	pool, err := SelectPool(*mode, *target, os.Getenv("WARP_TUNNEL_PROTOCOL"), isEnvTrue("WARP_MDM_ENABLED"))
+	sourcePolicy, err := ParseSourcePortPolicy(*sourcePortOpt)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		os.Exit(2)
+	}
+
+	progressFormat, err := ParseProgressFormat(*progressFormatOpt)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		os.Exit(2)
+	}
+
+	keyShare, err := ParseKeyShare(*keyShareOpt)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		os.Exit(2)
+	}
+
+	fingerprint, err := ParseFingerprint(*fingerprintOpt)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		os.Exit(2)
+	}
+
+	tlsSplit, err := ParseTLSSplit(*tlsSplitOpt)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		os.Exit(2)
+	}
+
+	echConfigList, err := ParseECHConfigList(*echOpt, *echFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		os.Exit(2)
+	}
+
+	var fingerprintMatrix []Fingerprint
+	if *fingerprintMatrixOpt != "" {
+		if fingerprintMatrix, err = ParseFingerprintList(*fingerprintMatrixOpt); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+			os.Exit(2)
+		}
+	}
+
+	certPolicy, err := ParseCertPolicy(*certCheck, *certIssuer, *certPin)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		os.Exit(2)
+	}
+
+	apiOpts, err := ParseAPIOptions(*apiCheck, *apiPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		os.Exit(2)
+	}
+
+	var sniMatrix []string
+	if *sniMatrixOpt != "" {
+		if sniMatrix, err = ParseSNIList(*sniMatrixOpt); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+			os.Exit(2)
+		}
+	}
+
+	var quicMatrix []string
+	if *quicMatrixOpt != "" {
+		if quicMatrix, err = ParseALPNList(*quicMatrixOpt); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+			os.Exit(2)
+		}
+	}
+
+	// 私钥不作为 flag 默认值，避免出现在 -h 输出中
+	identity, err := ResolveWireGuardIdentity(
+		envOr(*wgPeerKey, "WARP_PROBE_WG_PEER_KEY"),
+		envOr(*wgPrivateKey, "WARP_PROBE_WG_PRIVATE_KEY"),
+		envOr(*wgAddress, "WARP_PROBE_WG_ADDRESS"),
+		envOr(*wgConfig, "WARP_PROBE_WG_CONFIG"),
+	)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		os.Exit(2)
+	}
+	identity.Reserved, err = ResolveClientID(
+		envOr(*wgClientID, "WARP_PROBE_WG_CLIENT_ID"),
+		envOr(*wgRegistration, "WARP_PROBE_WG_REGISTRATION"),
+	)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		os.Exit(2)
+	}
+	hasClientID := identity.Reserved != [3]byte{}
+
+	var dataPlaneTarget netip.Addr
+	if *wgDataPlane > 0 || *masqueDataPlane > 0 || *benchTop > 0 {
+		if dataPlaneTarget, err = netip.ParseAddr(*wgDataPlaneTarget); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: invalid -wg-dataplane-target %q: %v\n", *wgDataPlaneTarget, err)
+			os.Exit(2)
+		}
+	}
+
+	var masqueCertificate *tls.Certificate
+	if keyPath := envOr(*masqueKey, "WARP_PROBE_MASQUE_KEY"); keyPath != "" {
+		if masqueCertificate, err = LoadMASQUECertificate(envOr(*masqueCert, "WARP_PROBE_MASQUE_CERT"), keyPath); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+			os.Exit(2)
+		}
+	}
+
+	protocol := os.Getenv("WARP_TUNNEL_PROTOCOL")
+	mdm := isEnvTrue("WARP_MDM_ENABLED")
+	pool, err := SelectPool(*mode, *target, protocol, mdm)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "ERROR: selecting target pool: %v\n", err)
 		os.Exit(2)
 	}
+	if (pool.Probe == ProbeHTTPS || pool.Probe == ProbeH2) && echConfigList != nil && !fingerprint.echCapable() {
+		fmt.Fprintf(os.Stderr, "ERROR: -ech needs a fingerprint with an encrypted_client_hello extension (chrome | firefox | go), not %s\n", fingerprint)
+		os.Exit(2)
+	}
+
+	// 数据面校验所需的凭据取决于目标池：WireGuard 用私钥，MASQUE 用设备证书
+	wgTunnel := pool.Probe != ProbeQUIC && (*wgDataPlane > 0 || *benchTop > 0)
+	masqueTunnel := pool.Probe == ProbeQUIC && (*masqueDataPlane > 0 || *benchTop > 0)
+	if wgTunnel && identity.PrivateKey == nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", errDataPlaneNoKey)
+		os.Exit(2)
+	}
+	if masqueTunnel && masqueCertificate == nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", errMASQUENoKey)
+		os.Exit(2)
+	}
+	if wgTunnel || masqueTunnel {
+		if _, ok := sourceAddressFor(identity.Addresses, dataPlaneTarget); !ok {
+			fmt.Fprintf(os.Stderr, "ERROR: %v: %s\n", errDataPlaneNoAddress, dataPlaneTarget)
+			os.Exit(2)
+		}
+	}
 
-	if *cidrOpt != "" {
-		pool.CIDRs = []string{*cidrOpt}
+	// WARP_PROBE_CIDR 让 init 脚本可以把探测指向本地 simulate 边缘
+	if cidr := envOr(*cidrOpt, "WARP_PROBE_CIDR"); cidr != "" {
+		pool.CIDRs = []string{cidr}
 		pool.CIDR = ""
 	}
 
@@ -51,20 +235,263 @@ func main() {
 		os.Exit(2)
 	}
 	if *sniOpt != "" {
+		pool.SNI = *sniOpt
 		for i := range endpoints {
 			endpoints[i].SNI = *sniOpt
 		}
 	}
+
+	const perProbeTimeout = time.Second
+	if *dryRun {
+		fmt.Printf("Mode:        %s (target=%q WARP_TUNNEL_PROTOCOL=%q WARP_MDM_ENABLED=%t)\n", *mode, *target, protocol, mdm)
+		BuildScanPlan(pool, endpoints, *concurrency, *rounds, perProbeTimeout, totalTimeout).Print(os.Stdout)
+		if pool.Probe == ProbeWireGuard {
+			fmt.Printf("SourcePort:  %s\n", sourcePolicy)
+			fmt.Printf("PeerKey:     %s\n", base64.StdEncoding.EncodeToString(identity.PeerPublic[:]))
+			fmt.Printf("Initiator:   %s\n", describeInitiator(identity))
+			if hasClientID {
+				fmt.Printf("ClientID:    %s\n", formatClientID(identity.Reserved))
+			}
+			if *wgDataPlane > 0 {
+				fmt.Printf("DataPlane:   top %d x %d ICMP echo to %s\n", dataPlaneTopN, *wgDataPlane, dataPlaneTarget)
+			}
+			if *benchTop > 0 {
+				fmt.Printf("Benchmark:   top %d via %s (<= %s each)\n", *benchTop, *benchURL, *benchDuration)
+			}
+		}
+		if pool.Probe != ProbeWireGuard {
+			fmt.Printf("KeyShare:    %s\n", keyShare)
+			if *pqCheck {
+				fmt.Printf("PQCheck:     top %d classical vs X25519MLKEM768-only\n", pqCheckTopN)
+			}
+		}
+		if pool.Probe == ProbeHTTPS || pool.Probe == ProbeH2 {
+			fmt.Printf("Fingerprint: %s\n", fingerprint)
+			if len(fingerprintMatrix) > 0 {
+				fmt.Printf("FingerprintMatrix: top %d x %s\n", fingerprintMatrixTopN, joinFingerprints(fingerprintMatrix))
+			}
+		}
+		if pool.Probe != ProbeWireGuard && echConfigList != nil {
+			publicNames, _ := echPublicNames(echConfigList)
+			fmt.Printf("ECH:         outer SNI %s, top %d plaintext vs encrypted\n", strings.Join(publicNames, ", "), echCheckTopN)
+		}
+		if *pmtuCheck && (pool.Probe == ProbeQUIC || pool.Probe == ProbeWireGuard) {
+			fmt.Printf("PMTU:        top %d DF probes up to %d-byte packets\n", pmtuTopN, pmtuLinkMTU)
+		}
+		if pool.Probe != ProbeWireGuard && certPolicy.Action != checkOff {
+			fmt.Printf("CertCheck:   %s (issuers=%v pins=%d)\n", certPolicy.Action, certPolicy.Issuers, len(certPolicy.Pins))
+		}
+		if pool.Probe == ProbeHTTPS && len(tlsSplit) > 1 {
+			fmt.Printf("TLSSplit:    %s\n", strings.Join(tlsSplit, " -> "))
+		}
+		if pool.Probe == ProbeHTTPS && apiOpts.enabled() {
+			fmt.Printf("APICheck:    %s GET https://%s%s\n", apiOpts.Action, DefaultSNI, apiOpts.path())
+		}
+		if pool.Probe == ProbeH2 && *h2Connect {
+			fmt.Printf("H2Connect:   %s extended CONNECT per probe\n", masqueConnectProtocol)
+		}
+		if pool.Probe != ProbeWireGuard && len(sniMatrix) > 0 {
+			fmt.Printf("SNIMatrix:   top %d x %s\n", sniMatrixTopN, strings.Join(sniMatrix, ", "))
+		}
+		if pool.Probe == ProbeQUIC && len(quicMatrix) > 0 {
+			fmt.Printf("QUICMatrix:  top %d x %v x %s\n", quicMatrixTopN, quicMatrixVersions, strings.Join(quicMatrix, ", "))
+		}
+		if pool.Probe == ProbeQUIC && masqueCertificate != nil {
+			fmt.Printf("MASQUE:      top %d %s CONNECT (pq-enabled=%t)\n", masqueSessionTopN, masqueConnectProtocol, *masquePQ)
+			if *masqueDataPlane > 0 {
+				fmt.Printf("DataPlane:   top %d x %d ICMP echo to %s via datagrams\n", dataPlaneTopN, *masqueDataPlane, dataPlaneTarget)
+			}
+			if *benchTop > 0 {
+				fmt.Printf("Benchmark:   top %d via %s (<= %s each)\n", *benchTop, *benchURL, *benchDuration)
+			}
+		}
+		return
+	}
 	fmt.Fprintf(os.Stderr, "Mode=%s Pool=%s Targets=%d Rounds=%d\n", *mode, pool.Name, len(endpoints), *rounds)
 
+	opts := ProbeOptions{
+		Progress:    NewProgressReporter(os.Stderr, *progressInterval, progressFormat),
+		MASQUE:      MASQUEOptions{Certificate: masqueCertificate, PostQuantum: *masquePQ, Addresses: identity.Addresses},
+		H2:          H2Options{Connect: *h2Connect},
+		Cert:        certPolicy,
+		KeyShare:    keyShare,
+		Fingerprint: fingerprint,
+	}
+	if pool.Probe == ProbeHTTPS {
+		opts.API = apiOpts
+		opts.TLSSplit = tlsSplit
+	}
+	if pool.Probe != ProbeWireGuard {
+		opts.ECH = echConfigList
+	}
+	if pool.Probe == ProbeWireGuard {
+		sourcePorts, err := OpenSourcePortPool(sourcePolicy)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: opening source ports: %v\n", err)
+			os.Exit(2)
+		}
+		defer sourcePorts.Close()
+		opts.WireGuard.SourcePorts = sourcePorts
+		opts.WireGuard.Identity = identity
+		fmt.Fprintf(os.Stderr, "SourcePort=%s Initiator=%s\n", sourcePolicy, describeInitiator(identity))
+		if hasClientID {
+			fmt.Fprintf(os.Stderr, "ClientID=%s\n", formatClientID(identity.Reserved))
+		}
+	}
+
+	if *pcapFile != "" {
+		capture, err := CreatePcap(*pcapFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: creating pcap: %v\n", err)
+			os.Exit(2)
+		}
+		opts.Capture = capture
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), totalTimeout)
 	defer cancel()
 
-	results := RunProbes(ctx, endpoints, *concurrency, time.Second, *rounds)
+	results, dpiSuspects := RunProbes(ctx, endpoints, *concurrency, perProbeTimeout, *rounds, opts)
+	for _, result := range dpiSuspects {
+		fmt.Fprintf(os.Stderr, "DPI suspect: %s %s\n", result.Endpoint, result.HTTPS)
+	}
 	SortProbeResults(results)
+	for _, result := range results {
+		if result.Cert != nil && result.Cert.Problem != "" {
+			fmt.Fprintf(os.Stderr, "Cert: %s %s\n", result.Endpoint, result.Cert)
+		}
+	}
+	if certPolicy.Action == checkExclude {
+		results = ExcludeUnexpectedCerts(results)
+	}
+	for _, result := range results {
+		if result.API != nil && result.API.Outcome != apiOK {
+			fmt.Fprintf(os.Stderr, "API: %s %s\n", result.Endpoint, result.API)
+		}
+	}
+	if opts.API.Action == checkExclude {
+		results = ExcludeNonAPI(results)
+	}
+
+	// 扫描已带 client ID；对前几名再做一次匿名对照
+	if pool.Probe == ProbeWireGuard && hasClientID {
+		checkCtx, checkCancel := context.WithTimeout(context.Background(), 2*clientIDCheckTopN*perProbeTimeout)
+		// 带 client ID 无任何响应时仍对前几个目标做对照，以区分“账户被拒”与“endpoint 不可达”
+		candidates := topCandidates(results, endpoints, clientIDCheckTopN, true)
+		PrintClientIDChecks(os.Stderr, CheckClientID(checkCtx, candidates, perProbeTimeout, opts))
+		checkCancel()
+	}
+
+	// 各矩阵只做诊断输出，不改变排序；无任何响应时对前几个目标照做，正是排查按 SNI、
+	// 版本或指纹阻断的场景
+	if pool.Probe != ProbeWireGuard && len(sniMatrix) > 0 {
+		matrixCtx, matrixCancel := context.WithTimeout(context.Background(), time.Duration(sniMatrixTopN*len(sniMatrix))*perProbeTimeout)
+		candidates := topCandidates(results, endpoints, sniMatrixTopN, true)
+		PrintSNIMatrix(os.Stderr, sniMatrix, CheckSNIMatrix(matrixCtx, candidates, sniMatrix, perProbeTimeout, opts))
+		matrixCancel()
+	}
+	if pool.Probe == ProbeQUIC && len(quicMatrix) > 0 {
+		combinations := len(quicMatrixVersions) * len(quicMatrix)
+		matrixCtx, matrixCancel := context.WithTimeout(context.Background(), time.Duration(quicMatrixTopN*combinations)*perProbeTimeout)
+		candidates := topCandidates(results, endpoints, quicMatrixTopN, true)
+		PrintQUICMatrix(os.Stderr, CheckQUICMatrix(matrixCtx, candidates, quicMatrix, perProbeTimeout, opts))
+		matrixCancel()
+	}
+	if (pool.Probe == ProbeHTTPS || pool.Probe == ProbeH2) && len(fingerprintMatrix) > 0 {
+		matrixCtx, matrixCancel := context.WithTimeout(context.Background(), time.Duration(fingerprintMatrixTopN*len(fingerprintMatrix))*perProbeTimeout)
+		candidates := topCandidates(results, endpoints, fingerprintMatrixTopN, true)
+		PrintFingerprintMatrix(os.Stderr, fingerprintMatrix, CheckFingerprintMatrix(matrixCtx, candidates, fingerprintMatrix, perProbeTimeout, opts))
+		matrixCancel()
+	}
 
+	if pool.Probe != ProbeWireGuard && *pqCheck {
+		pqCtx, pqCancel := context.WithTimeout(context.Background(), 2*pqCheckTopN*perProbeTimeout)
+		results = CheckPQ(pqCtx, results, endpoints, pqCheckTopN, perProbeTimeout, opts)
+		pqCancel()
+		for _, result := range results {
+			if result.PQ != nil {
+				fmt.Fprintf(os.Stderr, "PQ: %s %s\n", result.Endpoint, result.PQ)
+			}
+		}
+	}
+
+	if pool.Probe != ProbeWireGuard && echConfigList != nil {
+		echCtx, echCancel := context.WithTimeout(context.Background(), 2*echCheckTopN*perProbeTimeout)
+		results = CheckECH(echCtx, results, endpoints, echCheckTopN, perProbeTimeout, opts)
+		echCancel()
+		for _, result := range results {
+			if result.ECH != nil {
+				fmt.Fprintf(os.Stderr, "ECH: %s %s\n", result.Endpoint, result.ECH)
+			}
+		}
+	}
+
+	if *pmtuCheck && (pool.Probe == ProbeQUIC || pool.Probe == ProbeWireGuard) {
+		pmtuCtx, pmtuCancel := context.WithTimeout(context.Background(), pmtuMaxProbes*perProbeTimeout)
+		results = CheckPMTU(pmtuCtx, results, endpoints, pmtuTopN, perProbeTimeout, opts)
+		pmtuCancel()
+		for _, result := range results {
+			if result.PMTU != nil {
+				fmt.Fprintf(os.Stderr, "PMTU: %s %s\n", result.Endpoint, result.PMTU)
+			}
+		}
+	}
+
+	// 隧道内校验比握手 RTT 更能反映真实可用性，通过时不再做 ICMP 校验
+	tunnelVerified := false
+	if pool.Probe == ProbeWireGuard && *wgDataPlane > 0 {
+		tunnelCtx, tunnelCancel := context.WithTimeout(context.Background(), time.Duration(dataPlaneTopN*(*wgDataPlane+1))*perProbeTimeout)
+		results = VerifyDataPlane(tunnelCtx, results, endpoints, dataPlaneTopN, dataPlaneTarget, *wgDataPlane, perProbeTimeout, opts)
+		tunnelCancel()
+		for _, result := range results {
+			if result.Tunnel != nil {
+				fmt.Fprintf(os.Stderr, "Tunnel: %s %s\n", result.Endpoint, strings.Join(result.Tags(), " "))
+			}
+		}
+		tunnelVerified = len(results) > 0 && results[0].Tunnel != nil && results[0].Tunnel.Received > 0
+	}
+	if pool.Probe == ProbeQUIC && masqueCertificate != nil {
+		sessionCtx, sessionCancel := context.WithTimeout(context.Background(), masqueSessionTopN*2*perProbeTimeout)
+		results = VerifyMASQUE(sessionCtx, results, endpoints, masqueSessionTopN, 2*perProbeTimeout, opts)
+		sessionCancel()
+		for _, result := range results {
+			if result.MASQUE != nil {
+				fmt.Fprintf(os.Stderr, "MASQUE: %s %s\n", result.Endpoint, result.MASQUE)
+			}
+		}
+		tunnelVerified = len(results) > 0 && results[0].MASQUE != nil && results[0].MASQUE.OK()
+	}
+	if pool.Probe == ProbeQUIC && *masqueDataPlane > 0 {
+		tunnelCtx, tunnelCancel := context.WithTimeout(context.Background(), time.Duration(dataPlaneTopN*(*masqueDataPlane+2))*perProbeTimeout)
+		results = VerifyDataPlane(tunnelCtx, results, endpoints, dataPlaneTopN, dataPlaneTarget, *masqueDataPlane, perProbeTimeout, opts)
+		tunnelCancel()
+		for _, result := range results {
+			if result.Tunnel != nil {
+				fmt.Fprintf(os.Stderr, "Tunnel: %s %s\n", result.Endpoint, strings.Join(result.Tags(), " "))
+			}
+		}
+		tunnelVerified = len(results) > 0 && results[0].Tunnel != nil && results[0].Tunnel.Received > 0
+	}
 	// ICMP verification: check top 5 candidates, promote the first that responds
-	results = FilterByICMP(results, 5, 2*time.Second)
+	if !tunnelVerified {
+		results = FilterByICMP(results, icmpVerifyTopN, icmpVerifyTimeout)
+	}
+
+	if (pool.Probe == ProbeWireGuard || masqueTunnel) && *benchTop > 0 {
+		benchOpts := BenchmarkOptions{
+			URL:         *benchURL,
+			UploadBytes: *benchUpload,
+			Duration:    *benchDuration,
+			PingTarget:  dataPlaneTarget,
+			DNS:         netip.MustParseAddr("1.1.1.1"),
+		}
+		results = BenchmarkTop(context.Background(), results, endpoints, *benchTop, opts, benchOpts, os.Stderr)
+	}
+
+	// 最后一个联网阶段之后再关闭：MASQUE 吞吐测试同样经 opts.Capture 收发
+	if err := opts.Capture.Close(); err != nil {
+		fmt.Fprintf(os.Stderr, "WARN: writing pcap: %v\n", err)
+	}
 
 	if err := writeCSV(*outputFile, results); err != nil {
 		fmt.Fprintf(os.Stderr, "ERROR: writing CSV: %v\n", err)
@@ -72,8 +499,13 @@ func main() {
 	}
 
 	if len(results) > 0 {
-		fmt.Fprintf(os.Stderr, "Best: %s (%.1fms)\n",
-			results[0].Endpoint, float64(results[0].Latency)/float64(time.Millisecond))
+		best := results[0]
+		note := ""
+		if tags := best.Tags(); len(tags) > 0 {
+			note = " [" + strings.Join(tags, ",") + "]"
+		}
+		fmt.Fprintf(os.Stderr, "Best: %s (%.1fms)%s\n",
+			best.Endpoint, float64(best.Latency)/float64(time.Millisecond), note)
 	} else {
 		fmt.Fprintln(os.Stderr, "No reachable endpoints found")
 		os.Exit(1)
@@ -92,7 +524,7 @@ func writeCSV(path string, results []ProbeResult) error {
 
 	for _, r := range results {
 		latencyMs := fmt.Sprintf("%d", r.Latency.Milliseconds())
-		if err := w.Write([]string{r.Endpoint, latencyMs}); err != nil {
+		if err := w.Write([]string{r.Endpoint, latencyMs, strings.Join(r.Tags(), ";")}); err != nil {
 			return err
 		}
 	}
@@ -109,6 +541,22 @@ func inferTunnelTarget(protocol string, mdm bool) string {
 	return "wireguard"
 }
 
+// describeInitiator 只输出公钥，不打印私钥。
+func describeInitiator(identity WireGuardIdentity) string {
+	pub, ok := identity.PublicKey()
+	if !ok {
+		return "ephemeral"
+	}
+	return base64.StdEncoding.EncodeToString(pub[:])
+}
+
+func envOr(value, name string) string {
+	if value != "" {
+		return value
+	}
+	return os.Getenv(name)
+}
+
 func isEnvTrue(name string) bool {
 	value := os.Getenv(name)
 	return value == "true" || value == "1" || value == "yes"
@@ -1,6 +1,9 @@
 package main
 
-import "testing"
+import (
+	"reflect"
+	"testing"
+)
 
 func TestInferTunnelTarget(t *testing.T) {
 	testCases := []struct {
@@ -23,3 +26,104 @@ func TestInferTunnelTarget(t *testing.T) {
 		})
 	}
 }
+
+func TestTopCandidates(t *testing.T) {
+	endpoints := []Endpoint{{IP: "192.0.2.1", Port: 443}, {IP: "192.0.2.2", Port: 443}, {IP: "192.0.2.3", Port: 443}}
+	results := []ProbeResult{{Endpoint: "192.0.2.3:443"}, {Endpoint: "198.51.100.1:443"}, {Endpoint: "192.0.2.1:443"}}
+
+	testCases := []struct {
+		name     string
+		results  []ProbeResult
+		fallback bool
+		expected []Endpoint
+	}{
+		{name: "ranked", results: results, expected: []Endpoint{endpoints[2], endpoints[0]}},
+		{name: "ranked_ignores_fallback", results: results, fallback: true, expected: []Endpoint{endpoints[2], endpoints[0]}},
+		{name: "no_results", expected: nil},
+		{name: "no_results_fallback", fallback: true, expected: endpoints[:2]},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			actual := topCandidates(testCase.results, endpoints, 2, testCase.fallback)
+			if !reflect.DeepEqual(actual, testCase.expected) {
+				t.Fatalf("unexpected candidates: got=%v want=%v", actual, testCase.expected)
+			}
+		})
+	}
+}
+
+func TestEachTopResult(t *testing.T) {
+	endpoints := []Endpoint{{IP: "192.0.2.1", Port: 443}, {IP: "192.0.2.2", Port: 443}}
+	results := []ProbeResult{{Endpoint: "192.0.2.2:443"}, {Endpoint: "198.51.100.1:443"}, {Endpoint: "192.0.2.1:443"}}
+
+	var probed []string
+	eachTopResult(results, endpoints, 2, func(result *ProbeResult, endpoint Endpoint) {
+		probed = append(probed, endpoint.Address())
+		result.UnderLoad = true
+	})
+	if !reflect.DeepEqual(probed, []string{"192.0.2.2:443"}) {
+		t.Fatalf("unexpected probed endpoints: %v", probed)
+	}
+	if !results[0].UnderLoad || results[1].UnderLoad || results[2].UnderLoad {
+		t.Fatalf("annotation not written in place or beyond top n: %+v", results)
+	}
+}
+
+func TestSortProbeResultsUnderLoadLast(t *testing.T) {
+	results := []ProbeResult{
+		{Endpoint: "a", Latency: 10, UnderLoad: true},
+		{Endpoint: "b", Latency: 30},
+		{Endpoint: "c", Latency: 20},
+	}
+	SortProbeResults(results)
+	order := results[0].Endpoint + results[1].Endpoint + results[2].Endpoint
+	if order != "cba" {
+		t.Fatalf("unexpected order: got=%s want=cba", order)
+	}
+}
+
+func TestSortProbeResultsUnexpectedCertLast(t *testing.T) {
+	results := []ProbeResult{
+		{Endpoint: "a", Latency: 10, Cert: &ServerCert{Problem: certProblemSAN}},
+		{Endpoint: "b", Latency: 30, UnderLoad: true},
+		{Endpoint: "c", Latency: 20, Cert: &ServerCert{}},
+	}
+	SortProbeResults(results)
+	order := results[0].Endpoint + results[1].Endpoint + results[2].Endpoint
+	if order != "cba" {
+		t.Fatalf("unexpected order: got=%s want=cba", order)
+	}
+	if kept := ExcludeUnexpectedCerts(results); len(kept) != 2 || kept[1].Endpoint != "b" {
+		t.Fatalf("unexpected cert kept: %+v", kept)
+	}
+}
+
+func TestSortProbeResultsDPISuspectAfterUnderLoad(t *testing.T) {
+	results := []ProbeResult{
+		{Endpoint: "a", Latency: 5, HTTPS: &HTTPSTiming{Connect: 5, TLS: httpsTLSReset}},
+		{Endpoint: "b", Latency: 30, UnderLoad: true},
+		{Endpoint: "c", Latency: 20, HTTPS: &HTTPSTiming{Connect: 10, ServerHello: 10, TLS: httpsTLSOK}},
+	}
+	SortProbeResults(results)
+	order := results[0].Endpoint + results[1].Endpoint + results[2].Endpoint
+	if order != "cba" {
+		t.Fatalf("unexpected order: got=%s want=cba", order)
+	}
+}
+
+func TestSortProbeResultsNonAPIBeforeUnexpectedCert(t *testing.T) {
+	results := []ProbeResult{
+		{Endpoint: "a", Latency: 5, Cert: &ServerCert{Problem: certProblemSAN}, API: &APIResult{Outcome: apiOK}},
+		{Endpoint: "b", Latency: 10, API: &APIResult{Outcome: apiWrongBackend}},
+		{Endpoint: "c", Latency: 30, UnderLoad: true, API: &APIResult{Outcome: apiOK}},
+		{Endpoint: "d", Latency: 20},
+	}
+	SortProbeResults(results)
+	order := results[0].Endpoint + results[1].Endpoint + results[2].Endpoint + results[3].Endpoint
+	if order != "dcba" {
+		t.Fatalf("unexpected order: got=%s want=dcba", order)
+	}
+	if kept := ExcludeNonAPI(results); len(kept) != 3 || kept[2].Endpoint != "a" {
+		t.Fatalf("unexpected api results kept: %+v", kept)
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// masqueSessionTopN 为完成 MASQUE 会话校验的候选数量。
+const masqueSessionTopN = 3
+
+// masqueInitialPacketSize 使 QUIC datagram 能承载 1280 字节的内层 IP 报文。
+const masqueInitialPacketSize = 1350
+
+// masqueConnectProtocol 为 CF-CONNECT-IP 变体的 :protocol 取值 (见 docs/masque_api_analysis_report.md 2.3)。
+const masqueConnectProtocol = "cf-connect-ip"
+
+var errMASQUENoKey = errors.New("masque session check needs a device key (-masque-key)")
+
+// MASQUEOptions 为 MASQUE 会话探测使用的设备身份。
+type MASQUEOptions struct {
+	// Certificate 为 nil 时不做会话探测。
+	Certificate *tls.Certificate
+	// PostQuantum 对应 pq-enabled 头部。
+	PostQuantum bool
+	// Addresses 为隧道内本端地址，仅隧道内校验与吞吐测试使用。
+	Addresses []netip.Addr
+}
+
+// MASQUESessionResult 为一次 mTLS + extended CONNECT 的结果。
+type MASQUESessionResult struct {
+	// Handshake 为 QUIC + mTLS 握手完成的耗时，0 表示握手失败。
+	Handshake time.Duration
+	// Response 为 CONNECT 发出到收到响应头的耗时。
+	Response time.Duration
+	// Status 为 CONNECT 的响应状态码，0 表示未收到响应。
+	Status int
+	Err    error
+}
+
+// OK reports whether the edge accepted the tunnel.
+func (r MASQUESessionResult) OK() bool { return r.Status == http.StatusOK }
+
+// TimeToOK 为从开始握手到隧道建立 (200) 的总耗时。
+func (r MASQUESessionResult) TimeToOK() time.Duration { return r.Handshake + r.Response }
+
+func (r MASQUESessionResult) String() string {
+	switch {
+	case r.OK():
+		return fmt.Sprintf("status=200 handshake=%s time-to-200=%s", r.Handshake.Round(time.Microsecond), r.TimeToOK().Round(time.Microsecond))
+	case r.Status != 0:
+		return fmt.Sprintf("status=%d handshake=%s", r.Status, r.Handshake.Round(time.Microsecond))
+	case r.Handshake > 0:
+		return fmt.Sprintf("no-response handshake=%s (%v)", r.Handshake.Round(time.Microsecond), r.Err)
+	default:
+		return fmt.Sprintf("handshake-failed (%v)", r.Err)
+	}
+}
+
+// ProbeMASQUESession 以设备证书完成 QUIC mTLS，再发出 CF-CONNECT-IP extended CONNECT，
+// 测量握手与 CONNECT 响应耗时。
+func ProbeMASQUESession(ctx context.Context, endpoint Endpoint, timeout time.Duration, opts ProbeOptions) (MASQUESessionResult, error) {
+	session, result, err := openMASQUESession(ctx, endpoint, timeout, opts)
+	if session != nil {
+		session.Close()
+	}
+	return result, err
+}
+
+// masqueSession 为一个已建立 (200) 的 CF-CONNECT-IP 会话，IP 报文以 HTTP/3 datagram 收发。
+type masqueSession struct {
+	conn    *quic.Conn
+	stream  *http3.RequestStream
+	release func()
+}
+
+func (session *masqueSession) Close() {
+	_ = session.stream.Close()
+	_ = session.conn.CloseWithError(0, "probe")
+	session.release()
+}
+
+// sendPacket 发送一个 IP 报文：datagram payload 为 Context ID (0) + IP 报文 (RFC 9484)。
+func (session *masqueSession) sendPacket(packet []byte) error {
+	return session.stream.SendDatagram(append([]byte{0}, packet...))
+}
+
+// receivePacket 返回下一个 Context ID 为 0 的 IP 报文。
+func (session *masqueSession) receivePacket(ctx context.Context) ([]byte, error) {
+	for {
+		payload, err := session.stream.ReceiveDatagram(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if len(payload) > 1 && payload[0] == 0 {
+			return payload[1:], nil
+		}
+	}
+}
+
+// openMASQUESession 建立会话；仅在 CONNECT 返回 200 时返回非 nil 的 session，
+// 握手超时仅作用于握手与 CONNECT，会话本身随 ctx 结束。
+func openMASQUESession(ctx context.Context, endpoint Endpoint, timeout time.Duration, opts ProbeOptions) (*masqueSession, MASQUESessionResult, error) {
+	if opts.MASQUE.Certificate == nil {
+		return nil, MASQUESessionResult{}, errMASQUENoKey
+	}
+	if timeout <= 0 {
+		timeout = 2 * time.Second
+	}
+
+	serverName := endpoint.SNI
+	if serverName == "" {
+		serverName = DefaultSNI
+	}
+	tlsConf := &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+		NextProtos:         []string{http3.NextProtoH3},
+		Certificates:       []tls.Certificate{*opts.MASQUE.Certificate},
+	}
+	quicConf := &quic.Config{
+		HandshakeIdleTimeout: timeout,
+		EnableDatagrams:      true,
+		// 隧道 MTU 为 1280，datagram 需要容纳完整 IP 报文
+		InitialPacketSize: masqueInitialPacketSize,
+	}
+
+	handshakeCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	start := time.Now()
+	conn, release, err := dialQUIC(handshakeCtx, endpoint, tlsConf, quicConf, opts.Capture)
+	if err != nil {
+		release()
+		result := MASQUESessionResult{Err: fmt.Errorf("masque handshake %s: %w", endpoint.Address(), err)}
+		return nil, result, result.Err
+	}
+	result := MASQUESessionResult{Handshake: time.Since(start)}
+	fail := func(err error) (*masqueSession, MASQUESessionResult, error) {
+		_ = conn.CloseWithError(0, "probe")
+		release()
+		result.Err = err
+		return nil, result, err
+	}
+
+	transport := &http3.Transport{EnableDatagrams: true}
+	clientConn := transport.NewClientConn(conn)
+	// extended CONNECT 只能在收到服务端 SETTINGS 之后发出 (RFC 8441 section 3)
+	select {
+	case <-clientConn.ReceivedSettings():
+	case <-conn.Context().Done():
+		// mTLS 之后服务端不接受证书时连接被关闭，落在这里
+		return fail(fmt.Errorf("masque settings %s: %w", endpoint.Address(), context.Cause(conn.Context())))
+	case <-handshakeCtx.Done():
+		return fail(fmt.Errorf("masque settings %s: %w", endpoint.Address(), handshakeCtx.Err()))
+	}
+	if settings := clientConn.Settings(); !settings.EnableExtendedConnect || !settings.EnableDatagrams {
+		return fail(fmt.Errorf("masque settings %s: extended connect or datagrams not enabled", endpoint.Address()))
+	}
+
+	req, err := newMASQUERequest(ctx, serverName, opts.MASQUE.PostQuantum)
+	if err != nil {
+		return fail(err)
+	}
+	sent := time.Now()
+	stream, err := clientConn.OpenRequestStream(handshakeCtx)
+	if err != nil {
+		return fail(fmt.Errorf("masque connect %s: %w", endpoint.Address(), err))
+	}
+	_ = stream.SetReadDeadline(start.Add(timeout))
+	if err := stream.SendRequestHeader(req); err != nil {
+		return fail(fmt.Errorf("masque connect %s: %w", endpoint.Address(), err))
+	}
+	resp, err := stream.ReadResponse()
+	if err != nil {
+		return fail(fmt.Errorf("masque connect %s: %w", endpoint.Address(), err))
+	}
+	result.Response = time.Since(sent)
+	result.Status = resp.StatusCode
+	if !result.OK() {
+		return fail(fmt.Errorf("masque connect %s: %s", endpoint.Address(), resp.Status))
+	}
+	_ = stream.SetReadDeadline(time.Time{})
+	return &masqueSession{conn: conn, stream: stream, release: release}, result, nil
+}
+
+// newMASQUERequest 构造 CF-CONNECT-IP extended CONNECT 请求：
+// :protocol 为 cf-connect-ip，并附带 cf-connect-proto / pq-enabled 头部。
+func newMASQUERequest(ctx context.Context, serverName string, postQuantum bool) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodConnect, (&url.URL{Scheme: "https", Host: serverName, Path: "/"}).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Proto = masqueConnectProtocol
+	req.Header.Set("cf-connect-proto", masqueConnectProtocol)
+	req.Header.Set("pq-enabled", strconv.FormatBool(postQuantum))
+	return req, nil
+}
+
+// LoadMASQUECertificate 读取设备私钥 (PEM 或 base64 DER，EC / PKCS#8) 与可选的 x509 证书。
+// 未提供证书时与 warp-svc 相同，由私钥现场签发自签名证书。
+func LoadMASQUECertificate(certPath, keyPath string) (*tls.Certificate, error) {
+	keyData, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("read masque key: %w", err)
+	}
+	key, err := parseMASQUEKey(keyData)
+	if err != nil {
+		return nil, fmt.Errorf("masque key %s: %w", keyPath, err)
+	}
+
+	if certPath == "" {
+		return selfSignedDeviceCertificate(key)
+	}
+	certData, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, fmt.Errorf("read masque certificate: %w", err)
+	}
+	cert := &tls.Certificate{PrivateKey: key}
+	for rest := certData; ; {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			cert.Certificate = append(cert.Certificate, block.Bytes)
+		}
+	}
+	if len(cert.Certificate) == 0 {
+		return nil, fmt.Errorf("masque certificate %s: no CERTIFICATE block", certPath)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("masque certificate %s: %w", certPath, err)
+	}
+	if pub, ok := leaf.PublicKey.(interface{ Equal(crypto.PublicKey) bool }); !ok || !pub.Equal(key.Public()) {
+		return nil, fmt.Errorf("masque certificate %s does not match the key", certPath)
+	}
+	cert.Leaf = leaf
+	return cert, nil
+}
+
+func parseMASQUEKey(data []byte) (crypto.Signer, error) {
+	der := data
+	if block, _ := pem.Decode(data); block != nil {
+		der = block.Bytes
+	} else if raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data))); err == nil {
+		der = raw
+	}
+
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, errors.New("unsupported private key (want EC or PKCS#8, PEM or base64 DER)")
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	return signer, nil
+}
+
+func selfSignedDeviceCertificate(key crypto.Signer) (*tls.Certificate, error) {
+	if _, ok := key.(*ecdsa.PrivateKey); !ok {
+		return nil, fmt.Errorf("self-signed device certificate needs an EC key, got %T", key)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(0),
+		Subject:      pkix.Name{},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, fmt.Errorf("create device certificate: %w", err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// VerifyMASQUE 对前 topN 名建立 MASQUE 会话，并按结果重新排序。
+func VerifyMASQUE(ctx context.Context, results []ProbeResult, endpoints []Endpoint, topN int, timeout time.Duration, opts ProbeOptions) []ProbeResult {
+	eachTopResult(results, endpoints, topN, func(result *ProbeResult, endpoint Endpoint) {
+		session, _ := ProbeMASQUESession(ctx, endpoint, timeout, opts)
+		result.MASQUE = &session
+	})
+	RankByMASQUE(results)
+	return results
+}
+
+// RankByMASQUE 在 probePenalty 相同的结果内按会话结果重新排序：隧道建立 (按 time-to-200) 在前，
+// 未校验的保持原有顺序，握手成功但拒绝隧道的其次，握手失败的排到最后。
+func RankByMASQUE(results []ProbeResult) {
+	tier := func(r ProbeResult) int {
+		switch {
+		case r.MASQUE == nil:
+			return 1
+		case r.MASQUE.OK():
+			return 0
+		case r.MASQUE.Handshake > 0:
+			return 2
+		default:
+			return 3
+		}
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		if pi, pj := probePenalty(results[i]), probePenalty(results[j]); pi != pj {
+			return pi < pj
+		}
+		ti, tj := tier(results[i]), tier(results[j])
+		if ti != tj || ti != 0 {
+			return ti < tj
+		}
+		return results[i].MASQUE.TimeToOK() < results[j].MASQUE.TimeToOK()
+	})
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeMASQUEKey(t *testing.T, dir, name string, key *ecdsa.PrivateKey, encode func([]byte) []byte) string {
+	t.Helper()
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, encode(der), 0o600); err != nil {
+		t.Fatalf("write key: %v", err)
+	}
+	return path
+}
+
+func TestLoadMASQUECertificate(t *testing.T) {
+	dir := t.TempDir()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	pemKey := writeMASQUEKey(t, dir, "key.pem", key, func(der []byte) []byte {
+		return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	})
+	b64Key := writeMASQUEKey(t, dir, "key.b64", key, func(der []byte) []byte {
+		return []byte(base64.StdEncoding.EncodeToString(der) + "\n")
+	})
+	selfSigned, err := selfSignedDeviceCertificate(other)
+	if err != nil {
+		t.Fatalf("self-signed: %v", err)
+	}
+	otherCert := filepath.Join(dir, "other.pem")
+	_ = os.WriteFile(otherCert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: selfSigned.Certificate[0]}), 0o600)
+	ownCert, _ := selfSignedDeviceCertificate(key)
+	keyCert := filepath.Join(dir, "cert.pem")
+	_ = os.WriteFile(keyCert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ownCert.Certificate[0]}), 0o600)
+
+	testCases := []struct {
+		name     string
+		certPath string
+		keyPath  string
+		wantErr  bool
+	}{
+		{name: "pem_key_self_signed", keyPath: pemKey},
+		{name: "base64_der_key", keyPath: b64Key},
+		{name: "key_with_cert", keyPath: pemKey, certPath: keyCert},
+		{name: "mismatched_cert", keyPath: pemKey, certPath: otherCert, wantErr: true},
+		{name: "missing_key", keyPath: filepath.Join(dir, "missing"), wantErr: true},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			cert, err := LoadMASQUECertificate(testCase.certPath, testCase.keyPath)
+			if testCase.wantErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !cert.Leaf.PublicKey.(*ecdsa.PublicKey).Equal(key.Public()) {
+				t.Fatal("certificate is not bound to the device key")
+			}
+		})
+	}
+}
+
+func TestProbeMASQUESession(t *testing.T) {
+	edges := []SimEdge{
+		{Probe: ProbeQUIC, Address: "127.0.0.1:0", Latency: 10 * time.Millisecond, Mode: simModeMASQUE},
+		{Probe: ProbeQUIC, Address: "127.0.0.1:0", Mode: simModeRefuse},
+		{Probe: ProbeQUIC, Address: "127.0.0.1:0", Mode: simModeCertRequired},
+	}
+	var wgKey [32]byte
+	sim, err := StartSimulator(edges, wgKey)
+	if err != nil {
+		t.Fatalf("start simulator: %v", err)
+	}
+	defer sim.Close()
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	cert, err := selfSignedDeviceCertificate(key)
+	if err != nil {
+		t.Fatalf("device certificate: %v", err)
+	}
+	opts := ProbeOptions{MASQUE: MASQUEOptions{Certificate: cert}}
+	ctx := context.Background()
+
+	session, err := ProbeMASQUESession(ctx, simEndpoint(t, sim.Edges[0]), time.Second, opts)
+	if err != nil || !session.OK() {
+		t.Fatalf("masque edge: %s err=%v", session, err)
+	}
+	if session.Handshake < 10*time.Millisecond || session.Response < 10*time.Millisecond {
+		t.Fatalf("masque edge: simulated latency missing: %s", session)
+	}
+
+	session, _ = ProbeMASQUESession(ctx, simEndpoint(t, sim.Edges[1]), time.Second, opts)
+	if session.Status != http.StatusForbidden || session.Handshake <= 0 {
+		t.Fatalf("refusing edge: %s", session)
+	}
+
+	// 只要求客户端证书、不提供 MASQUE 的节点：握手完成后连接被关闭
+	session, _ = ProbeMASQUESession(ctx, simEndpoint(t, sim.Edges[2]), time.Second, opts)
+	if session.Handshake <= 0 || session.Err == nil || session.OK() {
+		t.Fatalf("cert-required edge: %s", session)
+	}
+
+	if _, err := ProbeMASQUESession(ctx, simEndpoint(t, sim.Edges[0]), time.Second, ProbeOptions{}); !errors.Is(err, errMASQUENoKey) {
+		t.Fatalf("missing key: %v", err)
+	}
+}
+
+func TestRankByMASQUE(t *testing.T) {
+	ok := func(handshake, response time.Duration) *MASQUESessionResult {
+		return &MASQUESessionResult{Handshake: handshake, Response: response, Status: http.StatusOK}
+	}
+	results := []ProbeResult{
+		{Endpoint: "refused", MASQUE: &MASQUESessionResult{Handshake: time.Millisecond, Status: http.StatusForbidden}},
+		{Endpoint: "down", MASQUE: &MASQUESessionResult{}},
+		{Endpoint: "slow", MASQUE: ok(20*time.Millisecond, 20*time.Millisecond)},
+		{Endpoint: "unchecked"},
+		{Endpoint: "fast", MASQUE: ok(10*time.Millisecond, 5*time.Millisecond)},
+	}
+	RankByMASQUE(results)
+	want := []string{"fast", "slow", "unchecked", "refused", "down"}
+	for i, endpoint := range want {
+		if results[i].Endpoint != endpoint {
+			t.Fatalf("position %d: got=%s want=%s", i, results[i].Endpoint, endpoint)
+		}
+	}
+
+	// -cert-check / -api-check mark：被标记的 endpoint 即使隧道最快也保持在后
+	results = []ProbeResult{
+		{Endpoint: "api-fail", API: &APIResult{Outcome: apiWrongBackend}, MASQUE: ok(time.Millisecond, time.Millisecond)},
+		{Endpoint: "bad-cert", Cert: &ServerCert{Problem: certProblemSAN}, MASQUE: ok(time.Millisecond, time.Millisecond)},
+		{Endpoint: "refused", MASQUE: &MASQUESessionResult{Handshake: time.Millisecond, Status: http.StatusForbidden}},
+		{Endpoint: "fast", MASQUE: ok(10*time.Millisecond, 5*time.Millisecond)},
+	}
+	RankByMASQUE(results)
+	want = []string{"fast", "refused", "api-fail", "bad-cert"}
+	for i, endpoint := range want {
+		if results[i].Endpoint != endpoint {
+			t.Fatalf("position %d: got=%s want=%s", i, results[i].Endpoint, endpoint)
+		}
+	}
+}
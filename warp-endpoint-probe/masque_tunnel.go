@@ -0,0 +1,143 @@
+package main
+
+// MASQUE 的数据面校验：在已建立的 CF-CONNECT-IP 会话中以 HTTP/3 datagram 收发 IP 报文。
+// ICMP echo 测量隧道内 RTT 与丢包；吞吐测试把 gVisor netstack 接到 datagram 上，
+// 复用 WireGuard 吞吐测试的下载/上传流程，找出握手快但转发慢的 edge。
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+
+	"golang.zx2c4.com/wireguard/tun"
+	"golang.zx2c4.com/wireguard/tun/netstack"
+)
+
+var errMASQUENoAddress = errors.New("masque data-plane check requires a tunnel address of the target family (-wg-address)")
+
+// ProbeMASQUEDataPlane 建立 MASQUE 会话后在隧道内向 target 发送 count 个 ICMP echo，
+// 每个 echo 最多等待 timeout。Handshake 为握手到 CONNECT 200 的耗时。
+func ProbeMASQUEDataPlane(ctx context.Context, endpoint Endpoint, target netip.Addr, count int, timeout time.Duration, opts ProbeOptions) (DataPlaneResult, error) {
+	source, ok := sourceAddressFor(opts.MASQUE.Addresses, target)
+	if !ok {
+		return DataPlaneResult{}, fmt.Errorf("%w: %s", errMASQUENoAddress, target)
+	}
+	session, established, err := openMASQUESession(ctx, endpoint, timeout, opts)
+	if err != nil {
+		return DataPlaneResult{}, err
+	}
+	defer session.Close()
+
+	result := DataPlaneResult{Handshake: established.TimeToOK()}
+	var totalRTT time.Duration
+	echoID := uint16(time.Now().UnixNano())
+	for seq := 1; seq <= count; seq++ {
+		if ctx.Err() != nil {
+			break
+		}
+		result.Sent++
+		start := time.Now()
+		if err := session.sendPacket(buildEchoRequest(source, target, echoID, uint16(seq))); err != nil {
+			continue
+		}
+		echoCtx, cancel := context.WithTimeout(ctx, timeout)
+		for {
+			packet, err := session.receivePacket(echoCtx)
+			if err != nil {
+				break
+			}
+			if isEchoReply(packet, target, source, echoID, uint16(seq)) {
+				result.Received++
+				totalRTT += time.Since(start)
+				break
+			}
+		}
+		cancel()
+	}
+	if result.Received > 0 {
+		result.RTT = totalRTT / time.Duration(result.Received)
+	}
+	return result, nil
+}
+
+// RunMASQUEBenchmark 建立 MASQUE 会话，将 netstack 的 IP 报文经 datagram 转发，
+// 并执行一次与 WireGuard 吞吐测试相同的传输测试。
+func RunMASQUEBenchmark(ctx context.Context, endpoint Endpoint, probeOpts ProbeOptions, opts BenchmarkOptions) (BenchmarkResult, error) {
+	result := BenchmarkResult{Endpoint: endpoint.Address(), Upload: opts.UploadBytes > 0}
+	if len(probeOpts.MASQUE.Addresses) == 0 {
+		return result, errMASQUENoAddress
+	}
+
+	sessionCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	session, _, err := openMASQUESession(sessionCtx, endpoint, 2*time.Second, probeOpts)
+	if err != nil {
+		return result, err
+	}
+	defer session.Close()
+
+	var dns []netip.Addr
+	if opts.DNS.IsValid() {
+		dns = append(dns, opts.DNS)
+	}
+	tunDevice, tnet, err := netstack.CreateNetTUN(probeOpts.MASQUE.Addresses, dns, benchmarkMTU)
+	if err != nil {
+		return result, fmt.Errorf("create netstack: %w", err)
+	}
+	var outbound, inbound sync.WaitGroup
+	outbound.Add(1)
+	go func() {
+		defer outbound.Done()
+		pumpTunToMASQUE(tunDevice, session)
+	}()
+	inbound.Add(1)
+	go func() {
+		defer inbound.Done()
+		pumpMASQUEToTun(sessionCtx, session, tunDevice)
+	}()
+	defer func() {
+		// 先停止写入 netstack 再关闭 tun (见 RunTunnelBenchmark)
+		cancel()
+		inbound.Wait()
+		_ = tunDevice.Close()
+		outbound.Wait()
+	}()
+
+	err = runNetstackBenchmark(ctx, tnet, probeOpts.MASQUE.Addresses, opts, &result)
+	return result, err
+}
+
+// pumpTunToMASQUE 将 netstack 发出的 IP 报文作为 datagram 发送，直到 tun 关闭。
+func pumpTunToMASQUE(device tun.Device, session *masqueSession) {
+	bufs := make([][]byte, device.BatchSize())
+	for i := range bufs {
+		bufs[i] = make([]byte, benchmarkMTU)
+	}
+	sizes := make([]int, len(bufs))
+	for {
+		n, err := device.Read(bufs, sizes, 0)
+		if err != nil {
+			return
+		}
+		for i := 0; i < n; i++ {
+			// datagram 不可靠，发送失败与丢包同样交给 TCP 重传
+			_ = session.sendPacket(bufs[i][:sizes[i]])
+		}
+	}
+}
+
+// pumpMASQUEToTun 将收到的 datagram 写入 netstack，直到会话结束。
+func pumpMASQUEToTun(ctx context.Context, session *masqueSession, device tun.Device) {
+	for {
+		packet, err := session.receivePacket(ctx)
+		if err != nil {
+			return
+		}
+		if _, err := device.Write([][]byte{packet}, 0); err != nil {
+			return
+		}
+	}
+}
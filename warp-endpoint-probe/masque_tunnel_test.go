@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"golang.zx2c4.com/wireguard/tun/netstack"
+)
+
+func testMASQUEOptions(t *testing.T, addresses ...string) ProbeOptions {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	cert, err := selfSignedDeviceCertificate(key)
+	if err != nil {
+		t.Fatalf("device certificate: %v", err)
+	}
+	opts := ProbeOptions{MASQUE: MASQUEOptions{Certificate: cert}}
+	for _, address := range addresses {
+		opts.MASQUE.Addresses = append(opts.MASQUE.Addresses, netip.MustParseAddr(address))
+	}
+	return opts
+}
+
+func TestProbeMASQUEDataPlane(t *testing.T) {
+	edges := []SimEdge{
+		{Probe: ProbeQUIC, Address: "127.0.0.1:0", Latency: 5 * time.Millisecond, Mode: simModeMASQUE},
+		{Probe: ProbeQUIC, Address: "127.0.0.1:0", Mode: simModeRefuse},
+	}
+	var wgKey [32]byte
+	sim, err := StartSimulator(edges, wgKey)
+	if err != nil {
+		t.Fatalf("start simulator: %v", err)
+	}
+	defer sim.Close()
+
+	ctx := context.Background()
+	target := netip.MustParseAddr("1.1.1.1")
+	opts := testMASQUEOptions(t, "172.16.0.2", "2606:4700:110:8a36::2")
+
+	result, err := ProbeMASQUEDataPlane(ctx, simEndpoint(t, sim.Edges[0]), target, 3, time.Second, opts)
+	if err != nil {
+		t.Fatalf("masque edge: %v", err)
+	}
+	if result.Sent != 3 || result.Received != 3 || result.RTT < 5*time.Millisecond || result.Handshake <= 0 {
+		t.Fatalf("masque edge: unexpected result %+v", result)
+	}
+
+	result, err = ProbeMASQUEDataPlane(ctx, simEndpoint(t, sim.Edges[0]), netip.MustParseAddr("2606:4700:4700::1111"), 2, time.Second, opts)
+	if err != nil || result.Received != 2 {
+		t.Fatalf("masque edge ipv6: %+v err=%v", result, err)
+	}
+
+	if _, err := ProbeMASQUEDataPlane(ctx, simEndpoint(t, sim.Edges[1]), target, 1, time.Second, opts); err == nil {
+		t.Fatal("refusing edge: expected error")
+	}
+
+	noAddress := testMASQUEOptions(t, "2606:4700:110:8a36::2")
+	if _, err := ProbeMASQUEDataPlane(ctx, simEndpoint(t, sim.Edges[0]), target, 1, time.Second, noAddress); !errors.Is(err, errMASQUENoAddress) {
+		t.Fatalf("missing address: %v", err)
+	}
+}
+
+// startTestMASQUEPeer 启动一个 HTTP/3 CF-CONNECT-IP 对端，每个会话把 datagram 接到
+// 一个 netstack 上，在隧道内 10.9.0.1:80 提供 HTTP。
+func startTestMASQUEPeer(t *testing.T) Endpoint {
+	t.Helper()
+	cert, err := simCertificate()
+	if err != nil {
+		t.Fatalf("server certificate: %v", err)
+	}
+	tlsConf := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"h3"},
+		ClientAuth:   tls.RequireAnyClientCert,
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	listener, err := quic.Listen(conn, tlsConf, &quic.Config{EnableDatagrams: true, InitialPacketSize: masqueInitialPacketSize})
+	if err != nil {
+		t.Fatalf("quic listen: %v", err)
+	}
+
+	server := &http3.Server{EnableDatagrams: true, Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tunDevice, tnet, err := netstack.CreateNetTUN([]netip.Addr{netip.MustParseAddr("10.9.0.1")}, nil, benchmarkMTU)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		defer tunDevice.Close()
+		httpServer, err := serveTunnelHTTP(tnet)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		defer httpServer.Close()
+
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		stream := w.(http3.HTTPStreamer).HTTPStream()
+		go func() {
+			bufs := [][]byte{make([]byte, benchmarkMTU)}
+			sizes := []int{0}
+			for {
+				if _, err := tunDevice.Read(bufs, sizes, 0); err != nil {
+					return
+				}
+				_ = stream.SendDatagram(append([]byte{0}, bufs[0][:sizes[0]]...))
+			}
+		}()
+		for {
+			payload, err := stream.ReceiveDatagram(r.Context())
+			if err != nil {
+				return
+			}
+			if len(payload) > 1 && payload[0] == 0 {
+				_, _ = tunDevice.Write([][]byte{payload[1:]}, 0)
+			}
+		}
+	})}
+	go func() { _ = server.ServeListener(listener) }()
+	t.Cleanup(func() {
+		_ = server.Close()
+		_ = listener.Close()
+		_ = conn.Close()
+	})
+
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	return Endpoint{IP: "127.0.0.1", Port: port, Probe: ProbeQUIC}
+}
+
+func TestRunMASQUEBenchmark(t *testing.T) {
+	endpoint := startTestMASQUEPeer(t)
+	probeOpts := testMASQUEOptions(t, "10.9.0.2")
+
+	testCases := []struct {
+		name     string
+		url      string
+		upload   int64
+		duration time.Duration
+		partial  bool
+	}{
+		// datagram 丢包时隧道内 TCP 会退避重传，完整传输的窗口留宽一些
+		{name: "download", url: "http://10.9.0.1/down", duration: 15 * time.Second},
+		{name: "upload", url: "http://10.9.0.1/up", upload: 1 << 20, duration: 15 * time.Second},
+		{name: "download window", url: "http://10.9.0.1/stream", duration: 500 * time.Millisecond, partial: true},
+		{name: "upload window", url: "http://10.9.0.1/up", upload: 1 << 40, duration: 500 * time.Millisecond, partial: true},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			opts := BenchmarkOptions{
+				URL:         testCase.url,
+				UploadBytes: testCase.upload,
+				Duration:    testCase.duration,
+				PingTarget:  netip.MustParseAddr("10.9.0.1"),
+			}
+			result, err := RunMASQUEBenchmark(ctx, endpoint, probeOpts, opts)
+			if err != nil {
+				t.Fatalf("benchmark failed: %v", err)
+			}
+			if testCase.partial {
+				if result.Bytes <= 0 || (testCase.upload > 0 && result.Bytes >= testCase.upload) ||
+					result.Transfer > testCase.duration+benchmarkSetupTimeout {
+					t.Fatalf("transfer not cut at the window: %+v", result)
+				}
+			} else {
+				wantBytes := int64(2 << 20)
+				if testCase.upload > 0 {
+					wantBytes = testCase.upload
+				}
+				if result.Bytes != wantBytes {
+					t.Fatalf("unexpected bytes: got=%d want=%d", result.Bytes, wantBytes)
+				}
+			}
+			if result.Mbps() <= 0 || (testCase.upload == 0) != (result.TTFB > 0) || (testCase.upload > 0) != (result.FirstRead > 0) {
+				t.Fatalf("missing measurements: %+v", result)
+			}
+			if result.PingSent == 0 || result.PingReceived == 0 {
+				t.Fatalf("no in-tunnel echo replies: %+v", result)
+			}
+		})
+	}
+}
+
+// 吞吐测试在排序与 ICMP 校验之后运行，其会话报文同样写入 pcapng
+func TestRunMASQUEBenchmarkCapture(t *testing.T) {
+	endpoint := startTestMASQUEPeer(t)
+	probeOpts := testMASQUEOptions(t, "10.9.0.2")
+	path := filepath.Join(t.TempDir(), "bench.pcapng")
+	capture, err := CreatePcap(path)
+	if err != nil {
+		t.Fatalf("create pcap: %v", err)
+	}
+	probeOpts.Capture = capture
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	opts := BenchmarkOptions{URL: "http://10.9.0.1/up", UploadBytes: 64 << 10, Duration: 15 * time.Second}
+	if _, err := RunMASQUEBenchmark(ctx, endpoint, probeOpts, opts); err != nil {
+		t.Fatalf("benchmark failed: %v", err)
+	}
+	if err := capture.Close(); err != nil {
+		t.Fatalf("close pcap: %v", err)
+	}
+
+	packets := 0
+	for _, block := range readPcapngBlocks(t, path) {
+		if block[0].(uint32) == pcapngBlockEPB && strings.Contains(string(block[1].([]byte)), "endpoint="+endpoint.Address()) {
+			packets++
+		}
+	}
+	// 至少包含握手、CONNECT 与承载上传的 datagram
+	if packets < 10 {
+		t.Fatalf("benchmark session not captured: %d packets", packets)
+	}
+}
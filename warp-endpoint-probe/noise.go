@@ -18,8 +18,10 @@ package main
 
 import (
 	"context"
+	"crypto/hmac"
 	"crypto/rand"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
 	"time"
@@ -32,13 +34,27 @@ import (
 const (
 	// WireGuard protocol constants
 	wgMessageTypeHandshakeInitiation = 1
+	wgMessageTypeHandshakeResponse   = 2
+	wgMessageTypeCookieReply         = 3
+	wgMessageTypeTransportData       = 4
 	wgHandshakeInitiationSize        = 148
 	wgHandshakeResponseSize          = 92
+	wgCookieReplySize                = 64
 
 	// Noise protocol constants
 	noiseConstruction = "Noise_IKpsk2_25519_ChaChaPoly_BLAKE2s"
 	wgIdentifier      = "WireGuard v1 zx2c4 Jason@zx2c4.com"
 	wgLabelMAC1       = "mac1----"
+	wgLabelCookie     = "cookie--"
+)
+
+var (
+	errResponseMalformed = errors.New("malformed handshake response")
+	errResponseIndex     = errors.New("handshake response receiver index mismatch")
+	errResponseMAC1      = errors.New("handshake response mac1 mismatch")
+	errResponseAEAD      = errors.New("handshake response failed noise authentication")
+	errCookieMalformed   = errors.New("malformed cookie reply")
+	errCookieAEAD        = errors.New("cookie reply failed authentication")
 )
 
 // Cloudflare WARP WireGuard public key (base64: bmXOC+F1FxEMF9dyiK2H5/1SUtzH0JuVo51h2wPfgyo=)
@@ -49,56 +65,220 @@ var cloudflarePublicKey = [32]byte{
 	0xa3, 0x9d, 0x61, 0xdb, 0x03, 0xdf, 0x83, 0x2a,
 }
 
+// WireGuardOptions configures the WireGuard handshake probe.
+type WireGuardOptions struct {
+	// SourcePorts 为 nil 时每次探测使用随机临时端口。
+	SourcePorts *SourcePortPool
+	// Identity 的 PeerPublic 为零值时使用 cloudflarePublicKey。
+	Identity WireGuardIdentity
+}
+
+func (opts WireGuardOptions) identity() WireGuardIdentity {
+	identity := opts.Identity
+	if identity.PeerPublic == ([32]byte{}) {
+		identity.PeerPublic = cloudflarePublicKey
+	}
+	return identity
+}
+
 // ProbeWireGuardHandshake sends a 148-byte handshake initiation packet and
 // waits for a WireGuard response packet to measure RTT.
-func ProbeWireGuardHandshake(ctx context.Context, endpoint Endpoint, timeout time.Duration) (time.Duration, error) {
+// 若服务端处于负载状态回复 Cookie Reply，则带上 MAC2 重试一次并标记 UnderLoad。
+func ProbeWireGuardHandshake(ctx context.Context, endpoint Endpoint, timeout time.Duration, opts ProbeOptions) (ProbeSample, error) {
 	if timeout <= 0 {
 		timeout = 2 * time.Second
 	}
 
-	packet, err := buildHandshakeInitiation()
+	probeCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	transport, err := openWGTransport(probeCtx, endpoint, opts)
 	if err != nil {
-		return 0, fmt.Errorf("build wireguard initiation: %w", err)
+		return ProbeSample{}, err
 	}
+	defer transport.Close()
 
-	probeCtx, cancel := context.WithTimeout(ctx, timeout)
-	defer cancel()
+	_, sample, err := handshakeWireGuard(probeCtx, endpoint, transport, opts.WireGuard.identity(), opts.Capture)
+	return sample, err
+}
+
+// handshakeWireGuard 在 transport 上完成一次握手（含 Cookie Reply 重试），
+// 返回已通过 Noise IK 校验的握手状态。
+func handshakeWireGuard(ctx context.Context, endpoint Endpoint, transport wgTransport, identity WireGuardIdentity, capture *PcapWriter) (*wgHandshake, ProbeSample, error) {
+	handshake, err := buildHandshakeInitiation(identity)
+	if err != nil {
+		return nil, ProbeSample{}, fmt.Errorf("build wireguard initiation: %w", err)
+	}
 
-	dialer := net.Dialer{Timeout: timeout}
-	connRaw, err := dialer.DialContext(probeCtx, "udp", endpoint.Address())
+	exchange, err := transport.roundTrip(ctx, handshake.msg, nil)
+	exchange.record(capture, endpoint)
 	if err != nil {
-		return 0, fmt.Errorf("dial udp %s: %w", endpoint.Address(), err)
+		return nil, ProbeSample{}, err
+	}
+
+	var sample ProbeSample
+	if wgMessageType(exchange.reply) == wgMessageTypeCookieReply {
+		// cookie 绑定源地址与端口，必须经同一 transport 重试
+		cookie, err := handshake.consumeCookieReply(exchange.reply)
+		if err != nil {
+			return nil, ProbeSample{}, fmt.Errorf("invalid cookie reply %s: %w", endpoint.Address(), err)
+		}
+		handshake, err = buildHandshakeInitiation(identity)
+		if err != nil {
+			return nil, ProbeSample{}, fmt.Errorf("build wireguard initiation: %w", err)
+		}
+		handshake.applyCookie(cookie)
+
+		exchange, err = transport.roundTrip(ctx, handshake.msg, nil)
+		exchange.record(capture, endpoint)
+		if err != nil {
+			return nil, ProbeSample{}, fmt.Errorf("retry with cookie: %w", err)
+		}
+		sample.UnderLoad = true
 	}
-	defer connRaw.Close()
 
+	// 只认可完整通过 Noise IK 校验的响应，防止中间设备伪造 type=2 回包
+	if err := handshake.consumeResponse(exchange.reply); err != nil {
+		return nil, ProbeSample{}, fmt.Errorf("invalid handshake response %s: %w", endpoint.Address(), err)
+	}
+
+	sample.Latency = exchange.latency
+	return handshake, sample, nil
+}
+
+// wgExchange 记录一次握手收发的结果，出错时 reply 为空。
+type wgExchange struct {
+	local   net.Addr
+	remote  net.Addr
+	packet  []byte
+	sent    time.Time
+	reply   []byte
+	latency time.Duration
+}
+
+// record 将发送的报文与收到的回包写入抓包文件。
+func (exchange wgExchange) record(capture *PcapWriter, endpoint Endpoint) {
+	if capture == nil || exchange.sent.IsZero() {
+		return
+	}
+	local, remote := addrPortOf(exchange.local), addrPortOf(exchange.remote)
+	capture.WriteUDP(exchange.sent, local, remote, exchange.packet, captureComment(endpoint, "out"))
+	if exchange.reply != nil {
+		capture.WriteUDP(exchange.sent.Add(exchange.latency), remote, local, exchange.reply, captureComment(endpoint, "in"))
+	}
+}
+
+// wgTransport 是一次探测期间使用的 UDP 通道：随机端口的临时 socket，
+// 或固定源端口的共享 socket。同一探测内的重试必须复用它。
+// roundTrip 返回第一个 accept 的回包；accept 为 nil 时接受任意回包。
+type wgTransport interface {
+	roundTrip(ctx context.Context, packet []byte, accept func(reply []byte) bool) (wgExchange, error)
+	Close()
+}
+
+func openWGTransport(ctx context.Context, endpoint Endpoint, opts ProbeOptions) (wgTransport, error) {
+	if opts.WireGuard.SourcePorts != nil {
+		addr, err := net.ResolveUDPAddr("udp", endpoint.Address())
+		if err != nil {
+			return nil, fmt.Errorf("resolve udp %s: %w", endpoint.Address(), err)
+		}
+		return &sharedTransport{socket: opts.WireGuard.SourcePorts.pick(), addr: addr, endpoint: endpoint}, nil
+	}
+
+	var dialer net.Dialer
+	connRaw, err := dialer.DialContext(ctx, "udp", endpoint.Address())
+	if err != nil {
+		return nil, fmt.Errorf("dial udp %s: %w", endpoint.Address(), err)
+	}
 	conn, ok := connRaw.(*net.UDPConn)
 	if !ok {
-		return 0, fmt.Errorf("unexpected conn type for %s", endpoint.Address())
+		_ = connRaw.Close()
+		return nil, fmt.Errorf("unexpected conn type for %s", endpoint.Address())
 	}
+	return &ephemeralTransport{conn: conn, endpoint: endpoint}, nil
+}
 
-	_ = conn.SetDeadline(time.Now().Add(timeout))
+// ephemeralTransport 使用随机源端口的已连接 UDP socket。
+type ephemeralTransport struct {
+	conn     *net.UDPConn
+	endpoint Endpoint
+}
 
-	start := time.Now()
-	if _, err = conn.Write(packet); err != nil {
-		return 0, fmt.Errorf("send handshake initiation %s: %w", endpoint.Address(), err)
+func (t *ephemeralTransport) Close() {
+	_ = t.conn.Close()
+}
+
+func (t *ephemeralTransport) roundTrip(ctx context.Context, packet []byte, accept func(reply []byte) bool) (wgExchange, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = t.conn.SetDeadline(deadline)
 	}
 
-	buf := make([]byte, 256)
-	n, err := conn.Read(buf)
-	latency := time.Since(start)
-	if err != nil {
-		return 0, fmt.Errorf("read handshake response %s: %w", endpoint.Address(), err)
+	exchange := wgExchange{local: t.conn.LocalAddr(), remote: t.conn.RemoteAddr(), packet: packet, sent: time.Now()}
+	if _, err := t.conn.Write(packet); err != nil {
+		return wgExchange{}, fmt.Errorf("send wireguard packet %s: %w", t.endpoint.Address(), err)
 	}
-	if n < 4 || buf[0] != 2 {
-		return 0, fmt.Errorf("invalid handshake response %s: size=%d type=%d", endpoint.Address(), n, buf[0])
+
+	buf := make([]byte, 2048)
+	for {
+		n, err := t.conn.Read(buf)
+		latency := time.Since(exchange.sent)
+		if err != nil {
+			return exchange, fmt.Errorf("read wireguard reply %s: %w", t.endpoint.Address(), err)
+		}
+		if accept != nil && !accept(buf[:n]) {
+			continue
+		}
+		exchange.reply = buf[:n]
+		exchange.latency = latency
+		return exchange, nil
 	}
+}
 
-	return latency, nil
+// sharedTransport 通过固定源端口的共享 socket 收发，按 receiver index 分发回包。
+type sharedTransport struct {
+	socket   *wgSocket
+	addr     *net.UDPAddr
+	endpoint Endpoint
+	// senderIndex 为最近一次 initiation 的 sender index，数据报文沿用它接收回包
+	senderIndex uint32
+}
+
+func (t *sharedTransport) Close() {}
+
+func (t *sharedTransport) roundTrip(ctx context.Context, packet []byte, accept func(reply []byte) bool) (wgExchange, error) {
+	if wgMessageType(packet) == wgMessageTypeHandshakeInitiation {
+		t.senderIndex = binary.LittleEndian.Uint32(packet[4:8])
+	}
+	exchange := wgExchange{local: t.socket.conn.LocalAddr(), remote: t.addr, packet: packet, sent: time.Now()}
+	reply, latency, err := t.socket.exchange(ctx, t.addr, packet, t.senderIndex, accept)
+	if err != nil {
+		return exchange, fmt.Errorf("handshake via source port %d %s: %w", t.socket.LocalPort(), t.endpoint.Address(), err)
+	}
+	exchange.reply = reply
+	exchange.latency = latency
+	return exchange, nil
+}
+
+// wgHandshake 保存发起方在一次握手中的 Noise 状态，用于校验响应。
+type wgHandshake struct {
+	msg         []byte
+	senderIndex uint32
+	peerIndex   uint32
+	peerPublic  [32]byte
+	staticPriv  [32]byte
+	staticPub   [32]byte
+	psk         [32]byte
+	ephPriv     [32]byte
+	ck          [32]byte
+	h           [32]byte
 }
 
 // buildHandshakeInitiation constructs a 148-byte WireGuard Handshake
-// Initiation message targeting the Cloudflare WARP endpoint.
-func buildHandshakeInitiation() ([]byte, error) {
+// Initiation message targeting the responder identity.PeerPublic
+// (cloudflarePublicKey for WARP endpoints).
+func buildHandshakeInitiation(identity WireGuardIdentity) (*wgHandshake, error) {
+	peerPublic := identity.PeerPublic
+
 	// Generate ephemeral keypair
 	var ephPriv, ephPub [32]byte
 	if _, err := rand.Read(ephPriv[:]); err != nil {
@@ -106,9 +286,11 @@ func buildHandshakeInitiation() ([]byte, error) {
 	}
 	curve25519.ScalarBaseMult(&ephPub, &ephPriv)
 
-	// Generate initiator static keypair (throwaway, just for probing)
+	// Initiator static keypair: configured device key, or throwaway for probing
 	var staticPriv, staticPub [32]byte
-	if _, err := rand.Read(staticPriv[:]); err != nil {
+	if identity.PrivateKey != nil {
+		staticPriv = *identity.PrivateKey
+	} else if _, err := rand.Read(staticPriv[:]); err != nil {
 		return nil, err
 	}
 	curve25519.ScalarBaseMult(&staticPub, &staticPriv)
@@ -121,13 +303,14 @@ func buildHandshakeInitiation() ([]byte, error) {
 	constructionHash := blake2sHash([]byte(noiseConstruction))
 	ck := constructionHash
 	h := blake2sHash(constructionHash[:], []byte(wgIdentifier))
-	h = blake2sHash(h[:], cloudflarePublicKey[:])
+	h = blake2sHash(h[:], peerPublic[:])
 
 	// msg.type = 1
 	// msg.sender_index = random 4 bytes
 	msg := make([]byte, wgHandshakeInitiationSize)
 	msg[0] = wgMessageTypeHandshakeInitiation
-	// bytes 1-3 are reserved (zero)
+	// bytes 1-3 are reserved; WARP carries the client ID here, written after the MACs
+	// are computed (as reservedBind does below wireguard-go)
 	if _, err := rand.Read(msg[4:8]); err != nil {
 		return nil, err
 	}
@@ -143,7 +326,7 @@ func buildHandshakeInitiation() ([]byte, error) {
 	_ = k // k is used for KDF, not directly here
 
 	// DH: ephemeral_private × responder_public
-	ss, err := curve25519.X25519(ephPriv[:], cloudflarePublicKey[:])
+	ss, err := curve25519.X25519(ephPriv[:], peerPublic[:])
 	if err != nil {
 		return nil, err
 	}
@@ -162,38 +345,166 @@ func buildHandshakeInitiation() ([]byte, error) {
 	h = blake2sHash(h[:], msg[40:88])
 
 	// DH: static_private × responder_public
-	ss2, err := curve25519.X25519(staticPriv[:], cloudflarePublicKey[:])
+	ss2, err := curve25519.X25519(staticPriv[:], peerPublic[:])
 	if err != nil {
 		return nil, err
 	}
 	ck, k = hkdf2(ck[:], ss2)
 
 	// msg.encrypted_timestamp = AEAD(k, 0, TAI64N(now), h)
+	// 新 key 下计数器从 0 重新开始
 	timestamp := tai64nNow()
-	var nonce1 [12]byte
-	nonce1[11] = 1 // nonce = 1 (little-endian counter)
 
 	// Need new AEAD with new key
 	aead2, err := chacha20poly1305.New(k[:])
 	if err != nil {
 		return nil, err
 	}
-	encryptedTS := aead2.Seal(nil, nonce1[:], timestamp[:], h[:])
+	encryptedTS := aead2.Seal(nil, nonce[:], timestamp[:], h[:])
 	copy(msg[88:116], encryptedTS)
 
 	// h = HASH(h || msg.encrypted_timestamp)
 	h = blake2sHash(h[:], msg[88:116])
-	_ = ck // ck is carried forward for response processing (not needed for probe)
 
 	// MAC1 = keyed_hash(HASH(LABEL_MAC1 || responder_public), msg[0:116])
-	mac1Key := blake2sHash([]byte(wgLabelMAC1), cloudflarePublicKey[:])
+	mac1Key := blake2sHash([]byte(wgLabelMAC1), peerPublic[:])
 	mac1 := blake2s128(mac1Key[:], msg[:116])
 	copy(msg[116:132], mac1[:])
 
 	// MAC2 = zeros (no cookie)
 	// msg[132:148] already zero
+	copy(msg[1:4], identity.Reserved[:])
+
+	return &wgHandshake{
+		msg:         msg,
+		senderIndex: binary.LittleEndian.Uint32(msg[4:8]),
+		peerPublic:  peerPublic,
+		staticPriv:  staticPriv,
+		staticPub:   staticPub,
+		psk:         identity.PresharedKey,
+		ephPriv:     ephPriv,
+		ck:          ck,
+		h:           h,
+	}, nil
+}
+
+// consumeResponse 按 Noise IK 完整处理 92 字节的 Handshake Response：
+// receiver index、MAC1 (以我方 static 公钥为 key) 以及 encrypted_nothing 的 AEAD。
+// 只有持有 peerPublic 对应私钥的服务端才能构造出可通过校验的响应。
+//
+// Response format (92 bytes):
+//   - Type (4 bytes): 0x02000000
+//   - Sender Index (4 bytes)
+//   - Receiver Index (4 bytes): must equal our sender index
+//   - Unencrypted Ephemeral (32 bytes)
+//   - Encrypted Nothing (16 bytes): AEAD(empty)
+//   - MAC1 (16 bytes), MAC2 (16 bytes)
+func (hs *wgHandshake) consumeResponse(msg []byte) error {
+	if len(msg) != wgHandshakeResponseSize || msg[0] != wgMessageTypeHandshakeResponse {
+		return fmt.Errorf("%w: size=%d type=%d", errResponseMalformed, len(msg), wgMessageType(msg))
+	}
+	if receiver := binary.LittleEndian.Uint32(msg[8:12]); receiver != hs.senderIndex {
+		return fmt.Errorf("%w: got=%08x want=%08x", errResponseIndex, receiver, hs.senderIndex)
+	}
+
+	// MAC1 = keyed_hash(HASH(LABEL_MAC1 || initiator_static_public), msg[0:60])，
+	// 对端回包的 bytes 1-3 可能带 client ID，按 0 计算
+	mac1Key := blake2sHash([]byte(wgLabelMAC1), hs.staticPub[:])
+	mac1 := blake2s128(mac1Key[:], wgZeroReserved(msg[:60]))
+	if !hmac.Equal(mac1[:], msg[60:76]) {
+		return errResponseMAC1
+	}
+
+	// h = HASH(h || msg.unencrypted_ephemeral)
+	// ck = KDF1(ck, msg.unencrypted_ephemeral)
+	respEph := msg[12:44]
+	ck, h := hs.ck, blake2sHash(hs.h[:], respEph)
+	ck, _ = hkdf2(ck[:], respEph)
+
+	// ck = KDF1(ck, DH(initiator_ephemeral_private, responder_ephemeral))
+	ss, err := curve25519.X25519(hs.ephPriv[:], respEph)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errResponseMalformed, err)
+	}
+	ck, _ = hkdf2(ck[:], ss)
+
+	// ck = KDF1(ck, DH(initiator_static_private, responder_ephemeral))
+	ss2, err := curve25519.X25519(hs.staticPriv[:], respEph)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errResponseMalformed, err)
+	}
+	ck, _ = hkdf2(ck[:], ss2)
+
+	// ck, tau, k = KDF3(ck, preshared_key)，WARP 不使用 PSK (全零)
+	ck, tau, k := hkdf3(ck[:], hs.psk[:])
+	h = blake2sHash(h[:], tau[:])
+
+	// msg.encrypted_nothing = AEAD(k, 0, empty, h)
+	aead, err := chacha20poly1305.New(k[:])
+	if err != nil {
+		return err
+	}
+	var nonce [12]byte
+	if _, err := aead.Open(nil, nonce[:], msg[44:60], h[:]); err != nil {
+		return errResponseAEAD
+	}
+
+	hs.ck = ck
+	hs.h = blake2sHash(h[:], msg[44:60])
+	hs.peerIndex = binary.LittleEndian.Uint32(msg[4:8])
+	return nil
+}
 
-	return msg, nil
+func wgMessageType(packet []byte) byte {
+	if len(packet) == 0 {
+		return 0
+	}
+	return packet[0]
+}
+
+// consumeCookieReply 解密服务端在负载状态下返回的 Cookie Reply。
+//
+// Cookie Reply format (64 bytes):
+//   - Type (4 bytes): 0x03000000
+//   - Receiver Index (4 bytes): must equal our sender index
+//   - Nonce (24 bytes)
+//   - Encrypted Cookie (32 bytes): XAEAD(HASH(LABEL_COOKIE || responder_public), nonce, cookie, initiation MAC1)
+func (hs *wgHandshake) consumeCookieReply(msg []byte) ([16]byte, error) {
+	var cookie [16]byte
+	if len(msg) != wgCookieReplySize || msg[0] != wgMessageTypeCookieReply {
+		return cookie, fmt.Errorf("%w: size=%d type=%d", errCookieMalformed, len(msg), wgMessageType(msg))
+	}
+	if receiver := binary.LittleEndian.Uint32(msg[4:8]); receiver != hs.senderIndex {
+		return cookie, fmt.Errorf("%w: got=%08x want=%08x", errResponseIndex, receiver, hs.senderIndex)
+	}
+
+	key := blake2sHash([]byte(wgLabelCookie), hs.peerPublic[:])
+	aead, err := chacha20poly1305.NewX(key[:])
+	if err != nil {
+		return cookie, err
+	}
+	plain, err := aead.Open(nil, msg[8:32], msg[32:64], hs.msg[116:132])
+	if err != nil {
+		return cookie, errCookieAEAD
+	}
+	copy(cookie[:], plain)
+	return cookie, nil
+}
+
+// applyCookie 用 cookie 计算 MAC2：MAC2 = keyed_hash(cookie, msg[0:132])，bytes 1-3 按 0 计算。
+func (hs *wgHandshake) applyCookie(cookie [16]byte) {
+	mac2 := blake2s128(cookie[:], wgZeroReserved(hs.msg[:132]))
+	copy(hs.msg[132:148], mac2[:])
+}
+
+// wgZeroReserved 返回 bytes 1-3 (reserved) 清零后的副本。WARP 的 client ID 在 MAC 计算之后
+// 写入、在校验之前清零，与 reservedBind 包装 wireguard-go 的方式一致。
+func wgZeroReserved(msg []byte) []byte {
+	zeroed := append([]byte(nil), msg...)
+	if len(zeroed) >= 4 {
+		zeroed[1], zeroed[2], zeroed[3] = 0, 0, 0
+	}
+	return zeroed
 }
 
 // --- Cryptographic helpers ---
@@ -216,6 +527,15 @@ func blake2s128(key []byte, data []byte) [16]byte {
 	return out
 }
 
+// hkdf3 extracts three 32-byte keys, used when mixing the preshared key.
+func hkdf3(ck, input []byte) ([32]byte, [32]byte, [32]byte) {
+	prk := hmacBlake2s(ck, input)
+	t1 := hmacBlake2s(prk[:], []byte{0x01})
+	t2 := hmacBlake2s(prk[:], append(t1[:], 0x02))
+	t3 := hmacBlake2s(prk[:], append(t2[:], 0x03))
+	return t1, t2, t3
+}
+
 // hkdf2 extracts two 32-byte keys using BLAKE2s-based HKDF.
 // This follows the WireGuard specification's KDF function.
 func hkdf2(ck, input []byte) ([32]byte, [32]byte) {
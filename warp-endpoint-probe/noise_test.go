@@ -1,12 +1,19 @@
 package main
 
-import "testing"
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
 
 func TestBuildHandshakeInitiation(t *testing.T) {
-	packet, err := buildHandshakeInitiation()
+	handshake, err := buildHandshakeInitiation(WireGuardIdentity{PeerPublic: cloudflarePublicKey})
 	if err != nil {
 		t.Fatalf("buildHandshakeInitiation failed: %v", err)
 	}
+	packet := handshake.msg
 	if len(packet) != wgHandshakeInitiationSize {
 		t.Fatalf("unexpected packet size: got=%d want=%d", len(packet), wgHandshakeInitiationSize)
 	}
@@ -14,3 +21,132 @@ func TestBuildHandshakeInitiation(t *testing.T) {
 		t.Fatalf("unexpected message type: got=%d want=%d", packet[0], wgMessageTypeHandshakeInitiation)
 	}
 }
+
+// testResponder 供直接收发 UDP 的测试使用，包装模拟边缘的响应方 (simWireGuard)。
+type testResponder struct {
+	*simWireGuard
+	// last 为最近一次握手建立的会话
+	last *simSession
+}
+
+func newTestResponder(t *testing.T) *testResponder {
+	t.Helper()
+	priv, _ := randomKey(t)
+	wg, err := newSimWireGuard(SimEdge{Probe: ProbeWireGuard, Mode: simModeRespond}, nil, priv)
+	if err != nil {
+		t.Fatalf("create responder: %v", err)
+	}
+	return &testResponder{simWireGuard: wg}
+}
+
+// respond 校验 initiation 并构造 92 字节的 Handshake Response。
+func (r *testResponder) respond(t *testing.T, initiation []byte) []byte {
+	t.Helper()
+	msg := r.handle(initiation, nil)
+	if msg == nil {
+		t.Fatal("initiation rejected")
+	}
+	r.mu.Lock()
+	r.last = r.sessions[binary.LittleEndian.Uint32(msg[4:8])]
+	r.mu.Unlock()
+	return msg
+}
+
+func TestConsumeHandshakeResponse(t *testing.T) {
+	responder := newTestResponder(t)
+
+	handshake, err := buildHandshakeInitiation(WireGuardIdentity{PeerPublic: responder.pub})
+	if err != nil {
+		t.Fatalf("build initiation: %v", err)
+	}
+	if err := handshake.consumeResponse(responder.respond(t, handshake.msg)); err != nil {
+		t.Fatalf("valid response rejected: %v", err)
+	}
+
+	// 中间设备只能伪造明文字段：receiver index 与 MAC1 都可以算对，
+	// 但没有服务端私钥就无法通过 encrypted_nothing 的 AEAD 校验。
+	forged := func(t *testing.T, hs *wgHandshake) []byte {
+		msg := responder.respond(t, hs.msg)
+		var junk [32]byte
+		_, _ = rand.Read(junk[:])
+		copy(msg[12:44], junk[:])
+		mac1Key := blake2sHash([]byte(wgLabelMAC1), hs.staticPub[:])
+		mac1 := blake2s128(mac1Key[:], msg[:60])
+		copy(msg[60:76], mac1[:])
+		return msg
+	}
+
+	testCases := []struct {
+		name    string
+		mutate  func(t *testing.T, hs *wgHandshake) []byte
+		wantErr error
+	}{
+		{name: "type_only", mutate: func(t *testing.T, hs *wgHandshake) []byte {
+			msg := make([]byte, wgHandshakeResponseSize)
+			msg[0] = wgMessageTypeHandshakeResponse
+			return msg
+		}, wantErr: errResponseIndex},
+		{name: "short", mutate: func(t *testing.T, hs *wgHandshake) []byte {
+			return []byte{wgMessageTypeHandshakeResponse, 0, 0, 0}
+		}, wantErr: errResponseMalformed},
+		{name: "bad_mac1", mutate: func(t *testing.T, hs *wgHandshake) []byte {
+			msg := responder.respond(t, hs.msg)
+			msg[60] ^= 0xff
+			return msg
+		}, wantErr: errResponseMAC1},
+		{name: "forged_without_key", mutate: forged, wantErr: errResponseAEAD},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			hs, err := buildHandshakeInitiation(WireGuardIdentity{PeerPublic: responder.pub})
+			if err != nil {
+				t.Fatalf("build initiation: %v", err)
+			}
+			err = hs.consumeResponse(testCase.mutate(t, hs))
+			if !errors.Is(err, testCase.wantErr) {
+				t.Fatalf("unexpected error: got=%v want=%v", err, testCase.wantErr)
+			}
+		})
+	}
+}
+
+func TestCookieReplyRoundTrip(t *testing.T) {
+	responder := newTestResponder(t)
+	var cookie [16]byte
+	_, _ = rand.Read(cookie[:])
+
+	handshake, err := buildHandshakeInitiation(WireGuardIdentity{PeerPublic: responder.pub})
+	if err != nil {
+		t.Fatalf("build initiation: %v", err)
+	}
+	reply, err := responder.cookieReply(handshake.msg, cookie)
+	if err != nil {
+		t.Fatalf("cookie reply: %v", err)
+	}
+
+	got, err := handshake.consumeCookieReply(reply)
+	if err != nil {
+		t.Fatalf("consume cookie reply: %v", err)
+	}
+	if got != cookie {
+		t.Fatalf("unexpected cookie: got=%x want=%x", got, cookie)
+	}
+
+	retry, err := buildHandshakeInitiation(WireGuardIdentity{PeerPublic: responder.pub})
+	if err != nil {
+		t.Fatalf("build retry initiation: %v", err)
+	}
+	retry.applyCookie(got)
+	if mac2 := blake2s128(cookie[:], wgZeroReserved(retry.msg[:132])); !hmac.Equal(mac2[:], retry.msg[132:148]) {
+		t.Fatal("retry mac2 not keyed with cookie")
+	}
+	if err := retry.consumeResponse(responder.respond(t, retry.msg)); err != nil {
+		t.Fatalf("retry response rejected: %v", err)
+	}
+
+	reply[40] ^= 0xff
+	if _, err := handshake.consumeCookieReply(reply); !errors.Is(err, errCookieAEAD) {
+		t.Fatalf("tampered cookie accepted: %v", err)
+	}
+}
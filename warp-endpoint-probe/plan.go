@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// 每次探测预计发出的报文数：
+//   - wireguard: 1 个 handshake initiation
+//   - quic: Initial (ClientHello) + CONNECTION_CLOSE
+//   - https: SYN + ACK + ClientHello + FIN
+//   - h2: 同 https
+//
+// 握手之后的请求 (-api-check、-h2-connect) 与排序后的各项校验不计入，Print 中注明。
+var packetsPerProbe = map[ProbeType]int{
+	ProbeWireGuard: 1,
+	ProbeQUIC:      2,
+	ProbeHTTPS:     4,
+	ProbeH2:        4,
+}
+
+// ICMP 校验的候选数量与单次超时，main 与 ScanPlan 共用。
+const (
+	icmpVerifyTopN    = 5
+	icmpVerifyTimeout = 2 * time.Second
+)
+
+// ScanPlan summarizes what a scan would do, without sending any packets.
+type ScanPlan struct {
+	Pool              TargetPool
+	CIDRs             []string
+	Endpoints         int
+	Rounds            int
+	Concurrency       int
+	PerProbeTimeout   time.Duration
+	TotalTimeout      time.Duration
+	EstimatedPackets  int
+	EstimatedDuration time.Duration
+}
+
+// BuildScanPlan estimates packet count and worst-case duration for a scan.
+func BuildScanPlan(pool TargetPool, endpoints []Endpoint, concurrency, rounds int, perProbeTimeout, totalTimeout time.Duration) ScanPlan {
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	if rounds <= 0 {
+		rounds = 1
+	}
+
+	plan := ScanPlan{
+		Pool:            pool,
+		Endpoints:       len(endpoints),
+		Rounds:          rounds,
+		Concurrency:     concurrency,
+		PerProbeTimeout: perProbeTimeout,
+		TotalTimeout:    totalTimeout,
+	}
+
+	seen := make(map[string]struct{})
+	for _, endpoint := range endpoints {
+		if _, dup := seen[endpoint.PoolCIDR]; dup {
+			continue
+		}
+		seen[endpoint.PoolCIDR] = struct{}{}
+		plan.CIDRs = append(plan.CIDRs, endpoint.PoolCIDR)
+	}
+
+	perProbe := packetsPerProbe[pool.Probe]
+	if perProbe == 0 {
+		perProbe = 1
+	}
+	plan.EstimatedPackets = len(endpoints)*rounds*perProbe + icmpVerifyTopN
+
+	// 最坏情况：每个 endpoint 的所有轮次都超时，按并发数分批执行
+	perEndpoint := time.Duration(rounds)*perProbeTimeout + time.Duration(rounds-1)*50*time.Millisecond
+	waves := (len(endpoints) + concurrency - 1) / concurrency
+	duration := time.Duration(waves) * perEndpoint
+	if totalTimeout > 0 && duration > totalTimeout {
+		duration = totalTimeout
+	}
+	plan.EstimatedDuration = duration + icmpVerifyTopN*icmpVerifyTimeout
+	return plan
+}
+
+// Print writes the plan in a human-readable form.
+func (plan ScanPlan) Print(w io.Writer) {
+	sni := plan.Pool.SNI
+	switch {
+	case plan.Pool.Probe == ProbeWireGuard:
+		sni = "-"
+	case sni == "":
+		sni = DefaultSNI + " (default)"
+	}
+
+	ports := make([]string, 0, len(plan.Pool.Ports))
+	for _, port := range plan.Pool.Ports {
+		ports = append(ports, fmt.Sprintf("%d", port))
+	}
+
+	fmt.Fprintf(w, "Pool:        %s\n", plan.Pool.Name)
+	fmt.Fprintf(w, "Probe:       %s\n", plan.Pool.Probe)
+	fmt.Fprintf(w, "SNI:         %s\n", sni)
+	fmt.Fprintf(w, "CIDRs:       %s\n", strings.Join(plan.CIDRs, ", "))
+	fmt.Fprintf(w, "Ports:       %s\n", strings.Join(ports, ", "))
+	fmt.Fprintf(w, "Endpoints:   %d\n", plan.Endpoints)
+	fmt.Fprintf(w, "Rounds:      %d\n", plan.Rounds)
+	fmt.Fprintf(w, "Concurrency: %d\n", plan.Concurrency)
+	fmt.Fprintf(w, "Packets:     ~%d (handshakes + ICMP verify; post-handshake requests and the top-N checks below are not counted)\n", plan.EstimatedPackets)
+	fmt.Fprintf(w, "Duration:    <= %s (per-probe timeout %s, hard timeout %s, ICMP verify %dx%s)\n",
+		plan.EstimatedDuration, plan.PerProbeTimeout, plan.TotalTimeout, icmpVerifyTopN, icmpVerifyTimeout)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildScanPlan(t *testing.T) {
+	pool, err := SelectPool("tunnel", "consumer", "", false)
+	if err != nil {
+		t.Fatalf("select consumer pool: %v", err)
+	}
+	endpoints, err := ExpandTargets(pool, false, 10)
+	if err != nil {
+		t.Fatalf("expand consumer endpoints: %v", err)
+	}
+
+	// 10 IPs × 4 ports = 40 endpoints, 并发 20 → 2 批
+	plan := BuildScanPlan(pool, endpoints, 20, 3, time.Second, 30*time.Second)
+	if plan.Endpoints != 40 {
+		t.Fatalf("unexpected endpoint count: got=%d want=40", plan.Endpoints)
+	}
+	if len(plan.CIDRs) != 1 || plan.CIDRs[0] != "162.159.192.0/24" {
+		t.Fatalf("unexpected cidrs: %v", plan.CIDRs)
+	}
+	if want := 40*3*packetsPerProbe[ProbeWireGuard] + icmpVerifyTopN; plan.EstimatedPackets != want {
+		t.Fatalf("unexpected packets: got=%d want=%d", plan.EstimatedPackets, want)
+	}
+	perEndpoint := 3*time.Second + 100*time.Millisecond
+	if want := 2*perEndpoint + icmpVerifyTopN*icmpVerifyTimeout; plan.EstimatedDuration != want {
+		t.Fatalf("unexpected duration: got=%s want=%s", plan.EstimatedDuration, want)
+	}
+
+	// 总超时封顶
+	capped := BuildScanPlan(pool, endpoints, 1, 3, time.Second, 10*time.Second)
+	if want := 10*time.Second + icmpVerifyTopN*icmpVerifyTimeout; capped.EstimatedDuration != want {
+		t.Fatalf("duration not capped: got=%s want=%s", capped.EstimatedDuration, want)
+	}
+
+	var output strings.Builder
+	plan.Print(&output)
+	if !strings.Contains(output.String(), "top-N checks below are not counted") {
+		t.Fatalf("packet estimate scope not stated:\n%s", output.String())
+	}
+}
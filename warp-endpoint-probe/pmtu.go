@@ -0,0 +1,277 @@
+package main
+
+// 路径 MTU 探测：以 DF 发送逐渐增大的 UDP 探测包，二分查找仍能得到回应的最大载荷。
+//   - QUIC: 带保留版本号 (0x?a?a?a?a) 的长包头，服务端对不小于 1200 字节的未知版本包
+//     回复 Version Negotiation，无需完成 TLS 即可确认该大小的包已到达
+//   - WireGuard: 在 148 字节的 Handshake Initiation 后补零；wireguard-go / boringtun
+//     严格校验长度，对端不接受补零时报告 padding rejected
+// 上限按以太网 MTU 1500 计，结果用于决定 WARP_ENABLE_PMTUD 与隧道 MTU。
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	// pmtuTopN 为做路径 MTU 探测的候选数量。
+	pmtuTopN = 5
+	// pmtuAttempts 为每个大小的最多发送次数，任一次有回应即视为可达。
+	pmtuAttempts = 2
+	// pmtuMaxProbes 为单个 endpoint 最多的探测包数：下限、上限、至多 9 步二分，
+	// WireGuard 另有一次未补零的 initiation。
+	pmtuMaxProbes = pmtuAttempts * 12
+	// pmtuLinkMTU 为探测上限。
+	pmtuLinkMTU   = 1500
+	udpHeaderSize = 8
+
+	// pmtuQUICMinPayload 为服务端回复 Version Negotiation 的最小包长 (RFC 9000 §14.1)。
+	pmtuQUICMinPayload = 1200
+	// pmtuWGPaddedPayload 为确认对端接受补零 initiation 的大小：576 字节的 IPv4 包任何路径都能承载。
+	pmtuWGPaddedPayload = 576 - 20 - udpHeaderSize
+	// wgInitiationInterval 避开 WireGuard 对同一 peer 的 initiation 限速 (20ms)。
+	wgInitiationInterval = 50 * time.Millisecond
+
+	// wgDataOverhead 为 WireGuard 数据包的封装开销：16 字节头部 + 16 字节 Poly1305 tag。
+	wgDataOverhead = 32
+	// masqueDatagramOverhead 与 warp-svc 一致：1350 字节的 QUIC 包承载 1280 字节内层报文。
+	masqueDatagramOverhead = masqueInitialPacketSize - benchmarkMTU
+)
+
+// 路径 MTU 探测方式。
+const (
+	pmtuMethodQUIC      = "quic-vn"
+	pmtuMethodWireGuard = "wireguard"
+)
+
+var (
+	errPMTUUnreachable     = errors.New("no answer at the minimum probe size")
+	errPMTUPaddingRejected = errors.New("peer ignores padded handshake initiations")
+	errPMTUNoDF            = errors.New("cannot set the don't-fragment bit on this platform")
+)
+
+// quicGreaseVersion 为 RFC 9000 §15 保留的版本号，服务端必然不支持。
+const quicGreaseVersion = 0x1a2a3a4a
+
+// PMTUResult is the largest UDP payload that reached one endpoint.
+type PMTUResult struct {
+	Method string
+	// Payload 为得到回应的最大 UDP 载荷，MTU 为对应的 IP 包大小。
+	Payload int
+	MTU     int
+	// TunnelMTU 为扣除 WireGuard / MASQUE 封装后的内层 MTU 建议值。
+	TunnelMTU int
+	// Probes 为实际发送的探测包数量。
+	Probes int
+	Err    error
+}
+
+func (result PMTUResult) String() string {
+	if result.Err != nil {
+		return fmt.Sprintf("path-mtu=unknown method=%s probes=%d err=%v", result.Method, result.Probes, result.Err)
+	}
+	return fmt.Sprintf("path-mtu=%d udp-payload=%d tunnel-mtu=%d method=%s probes=%d",
+		result.MTU, result.Payload, result.TunnelMTU, result.Method, result.Probes)
+}
+
+// pmtuSender 发送一个 size 字节的探测包，在 timeout 内收到对端回应时返回 true。
+type pmtuSender func(ctx context.Context, size int, timeout time.Duration) bool
+
+// ProbePMTU 对 QUIC 或 WireGuard endpoint 二分查找可达的最大 UDP 载荷。
+func ProbePMTU(ctx context.Context, endpoint Endpoint, timeout time.Duration, opts ProbeOptions) PMTUResult {
+	if timeout <= 0 {
+		timeout = 2 * time.Second
+	}
+	var result PMTUResult
+	switch endpoint.Probe {
+	case ProbeQUIC:
+		result.Method = pmtuMethodQUIC
+	case ProbeWireGuard:
+		result.Method = pmtuMethodWireGuard
+	default:
+		result.Err = fmt.Errorf("%w: %s", ErrUnsupportedProbe, endpoint.Probe)
+		return result
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", endpoint.Address())
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	ipHeader := 20
+	if ip, ok := netip.AddrFromSlice(addr.IP); ok && !ip.Unmap().Is4() {
+		ipHeader = 40
+	}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	defer conn.Close()
+	if err := setDontFragment(conn); err != nil {
+		result.Err = fmt.Errorf("%w: %v", errPMTUNoDF, err)
+		return result
+	}
+
+	var send pmtuSender
+	floor := pmtuQUICMinPayload
+	if endpoint.Probe == ProbeQUIC {
+		send = quicVersionSender(conn)
+	} else {
+		send = wgInitiationSender(conn, opts.WireGuard.identity())
+		// 先确认未补零的 initiation 有回应，再确认对端接受补零
+		if !retrySend(ctx, send, wgHandshakeInitiationSize, timeout, &result.Probes) {
+			result.Err = errPMTUUnreachable
+			return result
+		}
+		floor = pmtuWGPaddedPayload
+	}
+
+	maxPayload := pmtuLinkMTU - ipHeader - udpHeaderSize
+	result.Payload, result.Err = searchPMTU(ctx, floor, maxPayload, func(size int) bool {
+		return retrySend(ctx, send, size, timeout, &result.Probes)
+	})
+	if errors.Is(result.Err, errPMTUUnreachable) && endpoint.Probe == ProbeWireGuard {
+		result.Err = errPMTUPaddingRejected
+	}
+	if result.Err != nil {
+		result.Payload = 0
+		return result
+	}
+	result.MTU = result.Payload + udpHeaderSize + ipHeader
+	if endpoint.Probe == ProbeQUIC {
+		result.TunnelMTU = result.Payload - masqueDatagramOverhead
+	} else {
+		result.TunnelMTU = result.Payload - wgDataOverhead
+	}
+	return result
+}
+
+// retrySend 最多发送 pmtuAttempts 次，probes 累计实际发送数。
+func retrySend(ctx context.Context, send pmtuSender, size int, timeout time.Duration, probes *int) bool {
+	for attempt := 0; attempt < pmtuAttempts && ctx.Err() == nil; attempt++ {
+		*probes++
+		if send(ctx, size, timeout) {
+			return true
+		}
+	}
+	return false
+}
+
+// searchPMTU 在 [floor, ceiling] 内二分查找 fits 为 true 的最大值。
+// floor 不可达时返回 errPMTUUnreachable；先试 ceiling，多数路径一次即可确定。
+func searchPMTU(ctx context.Context, floor, ceiling int, fits func(size int) bool) (int, error) {
+	if !fits(floor) {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		return 0, errPMTUUnreachable
+	}
+	if fits(ceiling) {
+		return ceiling, nil
+	}
+	good, bad := floor, ceiling
+	for bad-good > 1 {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		mid := good + (bad-good)/2
+		if fits(mid) {
+			good = mid
+		} else {
+			bad = mid
+		}
+	}
+	return good, nil
+}
+
+// quicVersionSender 发送补零到 size 的未知版本长包头，等待回显 SCID 的 Version Negotiation。
+func quicVersionSender(conn *net.UDPConn) pmtuSender {
+	return func(ctx context.Context, size int, timeout time.Duration) bool {
+		packet := make([]byte, size)
+		packet[0] = 0xc0 // long header + fixed bit
+		binary.BigEndian.PutUint32(packet[1:5], quicGreaseVersion)
+		packet[5] = 8
+		_, _ = rand.Read(packet[6:14])
+		packet[14] = 8
+		_, _ = rand.Read(packet[15:23])
+		scid := packet[15:23]
+
+		return exchangePMTU(ctx, conn, packet, timeout, func(reply []byte) bool {
+			// Version Negotiation: 长包头、版本 0，DCID 为我们的 SCID
+			return len(reply) >= 6+len(scid) && reply[0]&0x80 != 0 &&
+				binary.BigEndian.Uint32(reply[1:5]) == 0 &&
+				int(reply[5]) == len(scid) && bytes.Equal(reply[6:6+len(scid)], scid)
+		})
+	}
+}
+
+// wgInitiationSender 每次发送新的 Handshake Initiation (时间戳递增，避免被当作重放)，
+// 补零到 size，Handshake Response 与 Cookie Reply 都算回应。
+func wgInitiationSender(conn *net.UDPConn, identity WireGuardIdentity) pmtuSender {
+	var last time.Time
+	return func(ctx context.Context, size int, timeout time.Duration) bool {
+		if wait := wgInitiationInterval - time.Since(last); wait > 0 {
+			select {
+			case <-ctx.Done():
+				return false
+			case <-time.After(wait):
+			}
+		}
+		last = time.Now()
+		handshake, err := buildHandshakeInitiation(identity)
+		if err != nil {
+			return false
+		}
+		packet := append(handshake.msg, make([]byte, max(0, size-len(handshake.msg)))...)
+		return exchangePMTU(ctx, conn, packet, timeout, func(reply []byte) bool {
+			index, ok := wgReceiverIndex(reply)
+			return ok && index == handshake.senderIndex
+		})
+	}
+}
+
+// exchangePMTU 发送 packet 并在 timeout 内等待 accept 为 true 的回应。
+// 超过本机接口 MTU 时 write 返回 EMSGSIZE，同样视为不可达。
+func exchangePMTU(ctx context.Context, conn *net.UDPConn, packet []byte, timeout time.Duration, accept func([]byte) bool) bool {
+	deadline := time.Now().Add(timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	if _, err := conn.Write(packet); err != nil {
+		return false
+	}
+	_ = conn.SetReadDeadline(deadline)
+	buf := make([]byte, 2048)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return false
+		}
+		if accept(buf[:n]) {
+			return true
+		}
+	}
+}
+
+// CheckPMTU 并发探测前 topN 名的路径 MTU。
+func CheckPMTU(ctx context.Context, results []ProbeResult, endpoints []Endpoint, topN int, timeout time.Duration, opts ProbeOptions) []ProbeResult {
+	var wg sync.WaitGroup
+	eachTopResult(results, endpoints, topN, func(result *ProbeResult, endpoint Endpoint) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pmtu := ProbePMTU(ctx, endpoint, timeout, opts)
+			result.PMTU = &pmtu
+		}()
+	})
+	wg.Wait()
+	return results
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// setDontFragment 以 PMTUDISC_PROBE 设置 DF：不分片，也不受内核缓存的路径 MTU 限制。
+func setDontFragment(conn *net.UDPConn) error {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var errIPv4, errIPv6 error
+	if err := rawConn.Control(func(fd uintptr) {
+		errIPv4 = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_PROBE)
+		errIPv6 = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IPV6_PMTUDISC_PROBE)
+	}); err != nil {
+		return err
+	}
+	// IPv4 socket 上设置 IPv6 选项会失败，反之亦然，任一成功即可
+	if errIPv4 != nil && errIPv6 != nil {
+		return errIPv4
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// setDontFragment 目前只在 Linux 上实现 (镜像与 init 脚本均运行于 Linux)。
+func setDontFragment(*net.UDPConn) error {
+	return errors.New("unsupported platform")
+}
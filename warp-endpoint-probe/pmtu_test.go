@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSearchPMTU(t *testing.T) {
+	testCases := []struct {
+		name    string
+		limit   int
+		want    int
+		wantErr error
+	}{
+		{name: "full_link", limit: 9000, want: 1472},
+		{name: "pppoe", limit: 1464, want: 1464},
+		{name: "just_above_floor", limit: 1201, want: 1201},
+		{name: "floor", limit: 1200, want: 1200},
+		{name: "below_floor", limit: 1100, wantErr: errPMTUUnreachable},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			var calls int
+			actual, err := searchPMTU(context.Background(), 1200, 1472, func(size int) bool {
+				calls++
+				return size <= testCase.limit
+			})
+			if !errors.Is(err, testCase.wantErr) || actual != testCase.want {
+				t.Fatalf("unexpected result: got=%d err=%v want=%d", actual, err, testCase.want)
+			}
+			if calls > 11 {
+				t.Fatalf("too many probes: %d", calls)
+			}
+		})
+	}
+}
+
+func TestProbePMTU(t *testing.T) {
+	specs := []struct {
+		spec    string
+		wantMTU int
+		wantErr error
+	}{
+		{spec: "quic@127.0.0.1:0", wantMTU: pmtuLinkMTU},
+		{spec: "quic@127.0.0.1:0,mtu=1400", wantMTU: 1400},
+		{spec: "quic@127.0.0.1:0,mode=drop", wantErr: errPMTUUnreachable},
+		{spec: "wireguard@127.0.0.1:0", wantErr: errPMTUPaddingRejected},
+		{spec: "wireguard@127.0.0.1:0,mode=drop", wantErr: errPMTUUnreachable},
+		{spec: "https@127.0.0.1:0", wantErr: ErrUnsupportedProbe},
+	}
+	var edges []SimEdge
+	for _, spec := range specs {
+		edge, err := ParseSimEdge(spec.spec, SimEdge{})
+		if err != nil {
+			t.Fatalf("parse %s: %v", spec.spec, err)
+		}
+		edges = append(edges, edge)
+	}
+	privateKey, _ := randomKey(t)
+	sim, err := StartSimulator(edges, privateKey)
+	if err != nil {
+		t.Fatalf("start simulator: %v", err)
+	}
+	defer sim.Close()
+	opts := ProbeOptions{WireGuard: WireGuardOptions{Identity: WireGuardIdentity{PeerPublic: sim.PeerPublic}}}
+
+	for i, spec := range specs {
+		t.Run(spec.spec, func(t *testing.T) {
+			result := ProbePMTU(context.Background(), simEndpoint(t, sim.Edges[i]), 100*time.Millisecond, opts)
+			if spec.wantErr != nil {
+				if !errors.Is(result.Err, spec.wantErr) {
+					t.Fatalf("unexpected error: got=%v want=%v", result.Err, spec.wantErr)
+				}
+				return
+			}
+			if result.Err != nil || result.MTU != spec.wantMTU || result.Payload != spec.wantMTU-28 {
+				t.Fatalf("unexpected result: %s", result)
+			}
+			if result.TunnelMTU != result.Payload-masqueDatagramOverhead {
+				t.Fatalf("unexpected tunnel MTU: %s", result)
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+// 后量子 key share：warp-svc 的 pq-enabled / MDM 的 WARP_ENABLE_POST_QUANTUM 会让 ClientHello
+// 携带 X25519MLKEM768 (约 1.2KB)，QUIC 下 ClientHello 因此跨两个 Initial 包。
+// 部分中间设备会静默丢弃这种大 ClientHello，对同一 endpoint 分别用只含 X25519 与只含
+// X25519MLKEM768 的 ClientHello 握手，即可区分服务端不支持与路径丢弃。
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"time"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+// pqCheckTopN 为做 PQ 对照的候选数量。
+const pqCheckTopN = 5
+
+// ClientHello 中的 key share 组合。
+const (
+	keyShareDefault   = "default"   // crypto/tls 与 Chrome 的默认值：X25519MLKEM768 + X25519
+	keyShareClassical = "classical" // 仅 X25519 / P-256，ClientHello 小
+	keySharePQ        = "pq"        // 仅 X25519MLKEM768，只有支持 PQ 的服务端能完成 ServerHello
+)
+
+// PQ 对照结论。
+const (
+	pqVerdictOK          = "ok"          // 服务端以 X25519MLKEM768 回应 ServerHello
+	pqVerdictUnsupported = "unsupported" // 经典握手有 ServerHello，PQ 握手被服务端拒绝
+	pqVerdictDropped     = "dropped"     // 经典握手有回应，大 ClientHello 超时或被重置
+	pqVerdictAnswered    = "answered"    // 两者都在 ServerHello 之前被拒绝，无法判断是否支持 PQ
+	pqVerdictUnreachable = "unreachable" // 经典握手也无回应
+)
+
+// ParseKeyShare 解析 -key-share。
+func ParseKeyShare(value string) (string, error) {
+	switch value {
+	case "", keyShareDefault:
+		return keyShareDefault, nil
+	case keyShareClassical, keySharePQ:
+		return value, nil
+	default:
+		return "", fmt.Errorf("invalid key share %q: want default | classical | pq", value)
+	}
+}
+
+// quicCurvePreferences 返回 crypto/tls 的 CurvePreferences，default 时为 nil。
+func quicCurvePreferences(keyShare string) []tls.CurveID {
+	switch keyShare {
+	case keyShareClassical:
+		return []tls.CurveID{tls.X25519, tls.CurveP256}
+	case keySharePQ:
+		return []tls.CurveID{tls.X25519MLKEM768}
+	default:
+		return nil
+	}
+}
+
+// utlsKeyShareGroups 返回 uTLS ClientHello 中保留的组，default 时为 nil (保持 Chrome 原样)。
+func utlsKeyShareGroups(keyShare string) []utls.CurveID {
+	switch keyShare {
+	case keyShareClassical:
+		return []utls.CurveID{utls.X25519, utls.CurveP256}
+	case keySharePQ:
+		return []utls.CurveID{utls.X25519MLKEM768}
+	default:
+		return nil
+	}
+}
+
+// PQCheck compares a classical and a post-quantum-only handshake on one endpoint.
+type PQCheck struct {
+	Classical SNIResult
+	PQ        SNIResult
+}
+
+// Verdict 汇总两次握手的结果。
+func (check PQCheck) Verdict() string {
+	switch {
+	case !check.Classical.answered():
+		return pqVerdictUnreachable
+	case !check.PQ.answered():
+		return pqVerdictDropped
+	case check.PQ.Outcome == SNIServerHello:
+		return pqVerdictOK
+	case check.Classical.Outcome == SNIServerHello:
+		return pqVerdictUnsupported
+	default:
+		return pqVerdictAnswered
+	}
+}
+
+func (check PQCheck) String() string {
+	return fmt.Sprintf("pq=%s classical=%s post-quantum=%s", check.Verdict(), check.Classical.Outcome, check.PQ.Outcome)
+}
+
+// ProbePQ 对同一 endpoint 先做经典握手、再做只含 X25519MLKEM768 的握手。
+func ProbePQ(ctx context.Context, endpoint Endpoint, timeout time.Duration, opts ProbeOptions) PQCheck {
+	serverName := endpoint.SNI
+	if serverName == "" {
+		serverName = DefaultSNI
+	}
+	classical, pq := opts, opts
+	classical.KeyShare, pq.KeyShare = keyShareClassical, keySharePQ
+	return PQCheck{
+		Classical: ProbeSNI(ctx, endpoint, serverName, timeout, classical),
+		PQ:        ProbeSNI(ctx, endpoint, serverName, timeout, pq),
+	}
+}
+
+// CheckPQ 对前 topN 名做 PQ 对照。
+func CheckPQ(ctx context.Context, results []ProbeResult, endpoints []Endpoint, topN int, timeout time.Duration, opts ProbeOptions) []ProbeResult {
+	eachTopResult(results, endpoints, topN, func(result *ProbeResult, endpoint Endpoint) {
+		check := ProbePQ(ctx, endpoint, timeout, opts)
+		result.PQ = &check
+	})
+	return results
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestParseKeyShare(t *testing.T) {
+	testCases := []struct {
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{value: "", want: keyShareDefault},
+		{value: "default", want: keyShareDefault},
+		{value: "classical", want: keyShareClassical},
+		{value: "pq", want: keySharePQ},
+		{value: "kyber", wantErr: true},
+	}
+	for _, testCase := range testCases {
+		actual, err := ParseKeyShare(testCase.value)
+		if (err != nil) != testCase.wantErr || actual != testCase.want {
+			t.Fatalf("ParseKeyShare(%q) = %q, %v; want %q", testCase.value, actual, err, testCase.want)
+		}
+	}
+}
+
+func TestPQCheckVerdict(t *testing.T) {
+	testCases := []struct {
+		name      string
+		classical string
+		pq        string
+		want      string
+	}{
+		{name: "ok", classical: SNIServerHello, pq: SNIServerHello, want: pqVerdictOK},
+		{name: "unsupported", classical: SNIServerHello, pq: SNIAlert, want: pqVerdictUnsupported},
+		{name: "dropped", classical: SNIServerHello, pq: SNITimeout, want: pqVerdictDropped},
+		{name: "reset", classical: SNIAlert, pq: SNIReset, want: pqVerdictDropped},
+		{name: "answered", classical: SNIAlert, pq: SNIAlert, want: pqVerdictAnswered},
+		{name: "unreachable", classical: SNITimeout, pq: SNITimeout, want: pqVerdictUnreachable},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			check := PQCheck{Classical: SNIResult{Outcome: testCase.classical}, PQ: SNIResult{Outcome: testCase.pq}}
+			if actual := check.Verdict(); actual != testCase.want {
+				t.Fatalf("unexpected verdict: got=%s want=%s", actual, testCase.want)
+			}
+		})
+	}
+}
+
+func TestProbePQ(t *testing.T) {
+	specs := []struct {
+		spec string
+		want string
+	}{
+		{spec: "https@127.0.0.1:0", want: pqVerdictOK},
+		{spec: "https@127.0.0.1:0,pq=off", want: pqVerdictUnsupported},
+		{spec: "https@127.0.0.1:0,pq=drop", want: pqVerdictDropped},
+		{spec: "quic@127.0.0.1:0,mode=accept", want: pqVerdictOK},
+		{spec: "quic@127.0.0.1:0,mode=accept,pq=off", want: pqVerdictUnsupported},
+		{spec: "quic@127.0.0.1:0,pq=drop", want: pqVerdictDropped},
+		{spec: "quic@127.0.0.1:0", want: pqVerdictOK},
+		{spec: "quic@127.0.0.1:0,mode=drop", want: pqVerdictUnreachable},
+	}
+	var edges []SimEdge
+	for _, spec := range specs {
+		edge, err := ParseSimEdge(spec.spec, SimEdge{})
+		if err != nil {
+			t.Fatalf("parse %s: %v", spec.spec, err)
+		}
+		edges = append(edges, edge)
+	}
+	var wgKey [32]byte
+	sim, err := StartSimulator(edges, wgKey)
+	if err != nil {
+		t.Fatalf("start simulator: %v", err)
+	}
+	defer sim.Close()
+
+	for i, spec := range specs {
+		t.Run(spec.spec, func(t *testing.T) {
+			endpoint := simEndpoint(t, sim.Edges[i])
+			endpoint.SNI = MasqueSNI
+			check := ProbePQ(context.Background(), endpoint, 300*time.Millisecond, ProbeOptions{})
+			if actual := check.Verdict(); actual != spec.want {
+				t.Fatalf("unexpected verdict: got=%s want=%s (%s)", actual, spec.want, check)
+			}
+		})
+	}
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"sort"
+	"strings"
 	"sync"
 	"time"
 )
@@ -12,18 +14,255 @@ type ProbeResult struct {
 	Endpoint string
 	Latency  time.Duration
 	Err      error
+	// UnderLoad 表示至少一轮收到了 WireGuard Cookie Reply。
+	UnderLoad bool
+	// Tunnel 非 nil 表示做过隧道内校验。
+	Tunnel *DataPlaneResult
+	// Throughput 非 nil 表示做过隧道吞吐测试。
+	Throughput *BenchmarkResult
+	// QUIC 为 QUIC 探测各轮分阶段耗时的平均值。
+	QUIC *QUICTiming
+	// MASQUE 非 nil 表示做过 MASQUE 会话校验。
+	MASQUE *MASQUESessionResult
+	// H2 为 H2Tunnel 探测各轮分阶段耗时的平均值。
+	H2 *H2Timing
+	// HTTPS 为 HTTPS 探测各轮分阶段耗时的平均值。
+	HTTPS *HTTPSTiming
+	// Cert 为最后一轮采集到的服务端证书，Problem 按 ProbeOptions.Cert 校验。
+	Cert *ServerCert
+	// PQ 非 nil 表示做过经典 / 后量子 ClientHello 对照。
+	PQ *PQCheck
+	// PMTU 非 nil 表示做过路径 MTU 探测。
+	PMTU *PMTUResult
+	// API 非 nil 表示做过应用层 WARP API 校验，取各轮中最可信的结果。
+	API *APIResult
+	// ECH 非 nil 表示做过明文 SNI / ECH 对照。
+	ECH *ECHCheck
+}
+
+// ProbeSample is the measurement from one probe round.
+type ProbeSample struct {
+	Latency   time.Duration
+	UnderLoad bool
+	// QUIC 仅 QUIC 探测收到服务端 Initial 时非 nil。
+	QUIC *QUICTiming
+	// H2 仅 H2Tunnel 探测完成 TLS 握手时非 nil。
+	H2 *H2Timing
+	// HTTPS 仅 HTTPS 探测完成 TCP 建连时非 nil。
+	HTTPS *HTTPSTiming
+	// Cert 仅收到服务端证书时非 nil。
+	Cert *ServerCert
+	// API 仅 HTTPS 探测完成握手且开启 API 校验时非 nil。
+	API *APIResult
+}
+
+// Tags returns short annotations written alongside the latency in the CSV.
+func (r ProbeResult) Tags() []string {
+	var tags []string
+	if r.UnderLoad {
+		tags = append(tags, "under-load")
+	}
+	if r.Tunnel != nil {
+		if r.Tunnel.Received == 0 {
+			tags = append(tags, "tunnel-down")
+		} else {
+			tags = append(tags,
+				fmt.Sprintf("tunnel-rtt=%dms", r.Tunnel.RTT.Milliseconds()),
+				fmt.Sprintf("tunnel-loss=%.0f%%", r.Tunnel.Loss()*100))
+		}
+	}
+	if r.Throughput != nil {
+		tags = append(tags, fmt.Sprintf("mbps=%.1f", r.Throughput.Mbps()))
+	}
+	if r.QUIC != nil {
+		if r.QUIC.Handshake > 0 {
+			tags = append(tags, fmt.Sprintf("quic-handshake=%dms", r.QUIC.Handshake.Milliseconds()))
+		}
+		if r.QUIC.SmoothedRTT > 0 {
+			tags = append(tags, fmt.Sprintf("quic-srtt=%dms", r.QUIC.SmoothedRTT.Milliseconds()))
+		}
+		tags = append(tags, fmt.Sprintf("quic-total=%dms", r.QUIC.Total.Milliseconds()))
+	}
+	if r.H2 != nil {
+		tags = append(tags,
+			fmt.Sprintf("h2-connect=%dms", r.H2.Connect.Milliseconds()),
+			fmt.Sprintf("h2-tls=%dms", r.H2.TLS.Milliseconds()))
+		if r.H2.Status != 0 {
+			tags = append(tags, fmt.Sprintf("h2-status=%d", r.H2.Status), fmt.Sprintf("h2-response=%dms", r.H2.Response.Milliseconds()))
+		}
+	}
+	if r.HTTPS != nil {
+		tags = append(tags, fmt.Sprintf("tcp-connect=%dms", r.HTTPS.Connect.Milliseconds()))
+		if r.HTTPS.ServerHello > 0 {
+			tags = append(tags, fmt.Sprintf("tls-server-hello=%dms", r.HTTPS.ServerHello.Milliseconds()))
+		}
+		if r.HTTPS.Handshake > 0 {
+			tags = append(tags, fmt.Sprintf("tls-handshake=%dms", r.HTTPS.Handshake.Milliseconds()))
+		}
+		if r.HTTPS.TLS != httpsTLSOK {
+			tags = append(tags, "tls="+r.HTTPS.TLS)
+		}
+		if r.HTTPS.Split != "" {
+			tags = append(tags, "tls-split="+r.HTTPS.Split)
+		}
+		if r.HTTPS.DPISuspect() {
+			tags = append(tags, "dpi-suspect")
+		}
+	}
+	if r.Cert != nil {
+		tags = append(tags, "cert="+r.Cert.Fingerprint[:16])
+		if r.Cert.Problem != "" {
+			tags = append(tags, "cert-unexpected="+r.Cert.Problem)
+		}
+	}
+	if r.API != nil {
+		tags = append(tags, "api="+r.API.Outcome)
+		if r.API.Status != 0 {
+			tags = append(tags, fmt.Sprintf("api-status=%d", r.API.Status), fmt.Sprintf("api-response=%dms", r.API.Response.Milliseconds()))
+		}
+	}
+	if r.PQ != nil {
+		tags = append(tags, "pq="+r.PQ.Verdict())
+	}
+	if r.ECH != nil {
+		tags = append(tags, "ech="+r.ECH.Verdict())
+	}
+	if r.PMTU != nil && r.PMTU.Err == nil {
+		tags = append(tags, fmt.Sprintf("pmtu=%d", r.PMTU.MTU))
+	}
+	if r.MASQUE != nil {
+		switch {
+		case r.MASQUE.OK():
+			tags = append(tags, "masque=200", fmt.Sprintf("masque-time-to-200=%dms", r.MASQUE.TimeToOK().Milliseconds()))
+		case r.MASQUE.Status != 0:
+			tags = append(tags, fmt.Sprintf("masque=%d", r.MASQUE.Status))
+		default:
+			tags = append(tags, "masque-down")
+		}
+	}
+	return tags
 }
 
 // SortProbeResults sorts successful probe results by latency ascending.
+// 处于负载状态 (under-load) 的 endpoint 排在正常 endpoint 之后，其后为疑似 DPI
+// (TCP 正常而 TLS 慢或被重置) 的 endpoint，再后为未通过 WARP API 校验的 endpoint，
+// 证书不符合预期的 endpoint 排在最后。
 func SortProbeResults(results []ProbeResult) {
-	sort.Slice(results, func(i, j int) bool {
+	sort.SliceStable(results, func(i, j int) bool {
+		pi, pj := probePenalty(results[i]), probePenalty(results[j])
+		if pi != pj {
+			return pi < pj
+		}
 		return results[i].Latency < results[j].Latency
 	})
 }
 
+// probePenalty 为 SortProbeResults 延迟之前的排序键，数值越大越靠后：证书异常 > API 未通过 >
+// 疑似 DPI > under-load。RankByDataPlane / RankByMASQUE 只在同一 penalty 内按各自的层级重排，
+// 因此 mark 模式下被标记的 endpoint 不会因为隧道结果排到前面。
+func probePenalty(r ProbeResult) int {
+	penalty := 0
+	if r.Cert != nil && r.Cert.Problem != "" {
+		penalty |= 8
+	}
+	if r.API != nil && r.API.Outcome != apiOK {
+		penalty |= 4
+	}
+	if r.HTTPS != nil && r.HTTPS.DPISuspect() {
+		penalty |= 2
+	}
+	if r.UnderLoad {
+		penalty |= 1
+	}
+	return penalty
+}
+
+// topCandidates 返回排序后前 topN 个结果对应的目标。没有任何结果时，fallback 为 true 则改取
+// 前 topN 个目标 (用于区分“被拒绝”与“不可达”)，否则返回 nil。
+func topCandidates(results []ProbeResult, endpoints []Endpoint, topN int, fallback bool) []Endpoint {
+	byAddress := endpointsByAddress(endpoints)
+	var candidates []Endpoint
+	for _, result := range results {
+		if len(candidates) >= topN {
+			break
+		}
+		if endpoint, ok := byAddress[result.Endpoint]; ok {
+			candidates = append(candidates, endpoint)
+		}
+	}
+	if len(candidates) == 0 && fallback {
+		candidates = endpoints[:min(topN, len(endpoints))]
+	}
+	return candidates
+}
+
+// eachTopResult 对前 topN 个结果依次调用 probe，传入结果对应的目标；不在 endpoints 中的结果跳过。
+// probe 只填写该结果的标注字段，不改变排序，需要按标注重排的调用方自行排序。
+func eachTopResult(results []ProbeResult, endpoints []Endpoint, topN int, probe func(result *ProbeResult, endpoint Endpoint)) {
+	byAddress := endpointsByAddress(endpoints)
+	for i := 0; i < len(results) && i < topN; i++ {
+		if endpoint, ok := byAddress[results[i].Endpoint]; ok {
+			probe(&results[i], endpoint)
+		}
+	}
+}
+
+func endpointsByAddress(endpoints []Endpoint) map[string]Endpoint {
+	byAddress := make(map[string]Endpoint, len(endpoints))
+	for _, endpoint := range endpoints {
+		byAddress[endpoint.Address()] = endpoint
+	}
+	return byAddress
+}
+
+// checkAction 决定排序后的校验 (-cert-check、-api-check) 如何处理未通过的 endpoint。
+type checkAction string
+
+const (
+	checkOff     checkAction = "off"     // 只记录
+	checkMark    checkAction = "mark"    // 标注并排到后面
+	checkExclude checkAction = "exclude" // 从结果中剔除
+)
+
+// parseCheckAction 解析 off / mark / exclude，空值为 off；name 用于错误信息。
+func parseCheckAction(name, value string) (checkAction, error) {
+	switch action := checkAction(strings.ToLower(strings.TrimSpace(value))); action {
+	case "":
+		return checkOff, nil
+	case checkOff, checkMark, checkExclude:
+		return action, nil
+	default:
+		return "", fmt.Errorf("invalid %s %q: want off | mark | exclude", name, value)
+	}
+}
+
+// ProbeOptions carries per-protocol probe settings.
+type ProbeOptions struct {
+	WireGuard WireGuardOptions
+	// Capture 非 nil 时记录所有探测报文到 pcapng。
+	Capture *PcapWriter
+	// Progress 非 nil 时周期性输出扫描进度。
+	Progress *ProgressReporter
+	MASQUE   MASQUEOptions
+	H2       H2Options
+	QUIC     QUICOptions
+	Cert     CertPolicy
+	// KeyShare 为 QUIC / HTTPS ClientHello 的 key share 组合，见 keyShare* 常量。
+	KeyShare string
+	// Fingerprint 为 HTTPS / H2 探测的 uTLS ClientHello 指纹，零值为 Chrome。
+	Fingerprint Fingerprint
+	// API 控制 HTTPS 探测握手后的 WARP API 请求。
+	API APIOptions
+	// TLSSplit 为 HTTPS 探测依次尝试的 ClientHello 分片策略，空值为不分片。
+	TLSSplit []string
+	// ECH 非 nil 时 QUIC / HTTPS / H2 探测以该 ECHConfigList 加密 ClientHello，外层 SNI 为其 public_name。
+	ECH []byte
+}
+
 // RunProbes executes probes with bounded concurrency.
-// rounds 指定每个目标被测试的次数，取平均延时。
-func RunProbes(ctx context.Context, endpoints []Endpoint, concurrency int, perProbeTimeout time.Duration, rounds int) []ProbeResult {
+// rounds 指定每个目标被测试的次数，取平均延时。dpiSuspects 为 TCP 可达而 TLS 始终无回应的目标：
+// 没有 RTT，不进入 successful，由调用方决定如何报告。
+func RunProbes(ctx context.Context, endpoints []Endpoint, concurrency int, perProbeTimeout time.Duration, rounds int, opts ProbeOptions) (successful, dpiSuspects []ProbeResult) {
 	if concurrency <= 0 {
 		concurrency = 1
 	}
@@ -40,7 +279,7 @@ func RunProbes(ctx context.Context, endpoints []Endpoint, concurrency int, perPr
 		go func() {
 			defer workerGroup.Done()
 			for endpoint := range jobs {
-				r := probeWithRounds(ctx, endpoint, perProbeTimeout, rounds)
+				r := probeWithRounds(ctx, endpoint, perProbeTimeout, rounds, opts)
 				results <- r
 			}
 		}()
@@ -62,23 +301,35 @@ func RunProbes(ctx context.Context, endpoints []Endpoint, concurrency int, perPr
 		close(results)
 	}()
 
+	opts.Progress.Start(len(endpoints))
+	defer opts.Progress.Stop()
+
 	// 关键修复：按 Latency > 0 过滤（而非 Err == nil），
 	// 因为 MASQUE 节点会先回应 ServerHello 再拒绝证书，
 	// 此时 err != nil 但 RTT 仍然有效。
-	successful := make([]ProbeResult, 0, len(endpoints))
+	successful = make([]ProbeResult, 0, len(endpoints))
 	for result := range results {
+		opts.Progress.Observe(result)
 		if result.Latency > 0 {
 			successful = append(successful, result)
+		} else if result.HTTPS != nil && result.HTTPS.DPISuspect() {
+			dpiSuspects = append(dpiSuspects, result)
 		}
 	}
-	return successful
+	return successful, dpiSuspects
 }
 
 // probeWithRounds 对同一个 endpoint 进行 rounds 轮探测，返回平均延时。
-func probeWithRounds(ctx context.Context, endpoint Endpoint, timeout time.Duration, rounds int) ProbeResult {
+func probeWithRounds(ctx context.Context, endpoint Endpoint, timeout time.Duration, rounds int, opts ProbeOptions) ProbeResult {
 	var totalLatency time.Duration
 	var responded int
 	var lastErr error
+	var underLoad bool
+	var quicTimings []QUICTiming
+	var h2Timings []H2Timing
+	var httpsTimings []HTTPSTiming
+	var apiResults []APIResult
+	var cert *ServerCert
 
 	for i := 0; i < rounds; i++ {
 		select {
@@ -87,13 +338,31 @@ func probeWithRounds(ctx context.Context, endpoint Endpoint, timeout time.Durati
 		default:
 		}
 
-		latency, err := probeSingleEndpoint(ctx, endpoint, timeout)
+		sample, err := probeSingleEndpoint(ctx, endpoint, timeout, opts)
 		if err != nil {
 			lastErr = err
 		}
-		if latency > 0 {
+		if sample.UnderLoad {
+			underLoad = true
+		}
+		if sample.QUIC != nil {
+			quicTimings = append(quicTimings, *sample.QUIC)
+		}
+		if sample.H2 != nil {
+			h2Timings = append(h2Timings, *sample.H2)
+		}
+		if sample.HTTPS != nil {
+			httpsTimings = append(httpsTimings, *sample.HTTPS)
+		}
+		if sample.Cert != nil {
+			cert = sample.Cert
+		}
+		if sample.API != nil {
+			apiResults = append(apiResults, *sample.API)
+		}
+		if sample.Latency > 0 {
 			responded++
-			totalLatency += latency
+			totalLatency += sample.Latency
 		}
 		// 轮间间隔，避免触发 rate-limit
 		if i < rounds-1 {
@@ -102,8 +371,23 @@ func probeWithRounds(ctx context.Context, endpoint Endpoint, timeout time.Durati
 	}
 
 	r := ProbeResult{
-		Endpoint: endpoint.Address(),
-		Err:      lastErr,
+		Endpoint:  endpoint.Address(),
+		Err:       lastErr,
+		UnderLoad: underLoad,
+		QUIC:      averageQUICTiming(quicTimings),
+		H2:        averageH2Timing(h2Timings),
+		HTTPS:     averageHTTPSTiming(httpsTimings),
+		Cert:      cert,
+	}
+	if opts.API.enabled() && endpoint.Probe == ProbeHTTPS {
+		r.API = bestAPIResult(apiResults)
+	}
+	if cert != nil {
+		serverName := endpoint.SNI
+		if serverName == "" {
+			serverName = DefaultSNI
+		}
+		cert.Problem = opts.Cert.Check(cert, serverName, time.Now())
 	}
 	if responded > 0 {
 		r.Latency = totalLatency / time.Duration(responded)
@@ -111,15 +395,17 @@ func probeWithRounds(ctx context.Context, endpoint Endpoint, timeout time.Durati
 	return r
 }
 
-func probeSingleEndpoint(ctx context.Context, endpoint Endpoint, timeout time.Duration) (time.Duration, error) {
+func probeSingleEndpoint(ctx context.Context, endpoint Endpoint, timeout time.Duration, opts ProbeOptions) (ProbeSample, error) {
 	switch endpoint.Probe {
 	case ProbeWireGuard:
-		return ProbeWireGuardHandshake(ctx, endpoint, timeout)
+		return ProbeWireGuardHandshake(ctx, endpoint, timeout, opts)
 	case ProbeQUIC:
-		return ProbeQUICHandshake(ctx, endpoint, timeout)
+		return ProbeQUICHandshake(ctx, endpoint, timeout, opts)
 	case ProbeHTTPS:
-		return ProbeHTTPSHandshake(ctx, endpoint, timeout)
+		return ProbeHTTPSHandshake(ctx, endpoint, timeout, opts)
+	case ProbeH2:
+		return ProbeH2Tunnel(ctx, endpoint, timeout, opts)
 	default:
-		return 0, ErrUnsupportedProbe
+		return ProbeSample{}, ErrUnsupportedProbe
 	}
 }
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProgressFormat selects how progress reports are rendered.
+type ProgressFormat string
+
+const (
+	ProgressText ProgressFormat = "text"
+	ProgressJSON ProgressFormat = "json"
+)
+
+// ParseProgressFormat validates a -progress-format value.
+func ParseProgressFormat(value string) (ProgressFormat, error) {
+	switch format := ProgressFormat(strings.ToLower(strings.TrimSpace(value))); format {
+	case ProgressText, ProgressJSON:
+		return format, nil
+	default:
+		return "", fmt.Errorf("unsupported progress format: %s", value)
+	}
+}
+
+// ProgressEvent is one progress report.
+type ProgressEvent struct {
+	Event      string  `json:"event"`
+	Done       int     `json:"done"`
+	Total      int     `json:"total"`
+	Responders int     `json:"responders"`
+	Best       string  `json:"best,omitempty"`
+	BestMs     float64 `json:"best_ms,omitempty"`
+	ElapsedMs  int64   `json:"elapsed_ms"`
+	EtaMs      int64   `json:"eta_ms"`
+}
+
+// ProgressReporter 周期性地输出扫描进度（已完成/总数、响应数、当前最佳、ETA）。
+// nil *ProgressReporter 不输出任何内容。
+type ProgressReporter struct {
+	w        io.Writer
+	interval time.Duration
+	format   ProgressFormat
+
+	mu         sync.Mutex
+	started    time.Time
+	total      int
+	done       int
+	responders int
+	best       ProbeResult
+	stopCh     chan struct{}
+	stopped    chan struct{}
+}
+
+// NewProgressReporter returns nil when interval <= 0.
+func NewProgressReporter(w io.Writer, interval time.Duration, format ProgressFormat) *ProgressReporter {
+	if interval <= 0 {
+		return nil
+	}
+	return &ProgressReporter{w: w, interval: interval, format: format}
+}
+
+// Start begins periodic reporting for a scan of total endpoints.
+func (p *ProgressReporter) Start(total int) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	p.started = time.Now()
+	p.total = total
+	p.done = 0
+	p.responders = 0
+	p.best = ProbeResult{}
+	p.stopCh = make(chan struct{})
+	p.stopped = make(chan struct{})
+	p.mu.Unlock()
+
+	go func() {
+		defer close(p.stopped)
+		ticker := time.NewTicker(p.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.stopCh:
+				return
+			case <-ticker.C:
+				p.emit("progress")
+			}
+		}
+	}()
+}
+
+// Observe records one finished endpoint.
+func (p *ProgressReporter) Observe(result ProbeResult) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done++
+	if result.Latency > 0 {
+		p.responders++
+		if p.best.Latency == 0 || result.Latency < p.best.Latency {
+			p.best = result
+		}
+	}
+}
+
+// Stop halts periodic reporting and emits a final "done" event.
+func (p *ProgressReporter) Stop() {
+	if p == nil || p.stopCh == nil {
+		return
+	}
+	close(p.stopCh)
+	<-p.stopped
+	p.emit("done")
+}
+
+func (p *ProgressReporter) snapshot(event string) ProgressEvent {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	elapsed := time.Since(p.started)
+	snapshot := ProgressEvent{
+		Event:      event,
+		Done:       p.done,
+		Total:      p.total,
+		Responders: p.responders,
+		ElapsedMs:  elapsed.Milliseconds(),
+	}
+	if p.best.Latency > 0 {
+		snapshot.Best = p.best.Endpoint
+		snapshot.BestMs = float64(p.best.Latency) / float64(time.Millisecond)
+	}
+	if p.done > 0 && p.done < p.total {
+		eta := elapsed / time.Duration(p.done) * time.Duration(p.total-p.done)
+		snapshot.EtaMs = eta.Milliseconds()
+	}
+	return snapshot
+}
+
+func (p *ProgressReporter) emit(event string) {
+	snapshot := p.snapshot(event)
+	if p.format == ProgressJSON {
+		line, _ := json.Marshal(snapshot)
+		fmt.Fprintf(p.w, "%s\n", line)
+		return
+	}
+
+	percent := 0.0
+	if snapshot.Total > 0 {
+		percent = float64(snapshot.Done) * 100 / float64(snapshot.Total)
+	}
+	best := "-"
+	if snapshot.Best != "" {
+		best = fmt.Sprintf("%s (%.1fms)", snapshot.Best, snapshot.BestMs)
+	}
+	eta := "-"
+	if snapshot.Done > 0 {
+		eta = (time.Duration(snapshot.EtaMs) * time.Millisecond).Round(time.Second).String()
+	}
+	label := "Progress"
+	if event == "done" {
+		label = "Finished"
+	}
+	fmt.Fprintf(p.w, "%s: %d/%d (%.1f%%) responders=%d best=%s eta=%s\n",
+		label, snapshot.Done, snapshot.Total, percent, snapshot.Responders, best, eta)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProgressReporterJSON(t *testing.T) {
+	var buf bytes.Buffer
+	reporter := NewProgressReporter(&buf, time.Hour, ProgressJSON)
+	reporter.Start(3)
+	reporter.Observe(ProbeResult{Endpoint: "1.1.1.1:443", Latency: 30 * time.Millisecond})
+	reporter.Observe(ProbeResult{Endpoint: "1.0.0.1:443", Latency: 20 * time.Millisecond})
+	reporter.Observe(ProbeResult{Endpoint: "1.2.3.4:443"})
+	reporter.Stop()
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	var event ProgressEvent
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &event); err != nil {
+		t.Fatalf("decode progress event: %v", err)
+	}
+	if event.Event != "done" || event.Done != 3 || event.Total != 3 || event.Responders != 2 {
+		t.Fatalf("unexpected final event: %+v", event)
+	}
+	if event.Best != "1.0.0.1:443" || event.BestMs != 20 {
+		t.Fatalf("unexpected best: %s %.1f", event.Best, event.BestMs)
+	}
+}
+
+func TestProgressReporterDisabled(t *testing.T) {
+	reporter := NewProgressReporter(&bytes.Buffer{}, 0, ProgressText)
+	if reporter != nil {
+		t.Fatal("expected nil reporter when interval is 0")
+	}
+	// nil reporter 的所有方法都应为空操作
+	reporter.Start(1)
+	reporter.Observe(ProbeResult{})
+	reporter.Stop()
+}
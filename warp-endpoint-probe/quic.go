@@ -3,15 +3,16 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
-	"strings"
+	"net"
 	"time"
 
 	"github.com/quic-go/quic-go"
 )
 
 // ProbeQUICHandshake performs a QUIC handshake to measure RTT.
-func ProbeQUICHandshake(ctx context.Context, endpoint Endpoint, timeout time.Duration) (time.Duration, error) {
+func ProbeQUICHandshake(ctx context.Context, endpoint Endpoint, timeout time.Duration, opts ProbeOptions) (ProbeSample, error) {
 	if timeout <= 0 {
 		timeout = 2 * time.Second
 	}
@@ -27,34 +28,70 @@ func ProbeQUICHandshake(ctx context.Context, endpoint Endpoint, timeout time.Dur
 	tlsConf := &tls.Config{
 		ServerName:         serverName,
 		InsecureSkipVerify: true,
-		NextProtos:         []string{"h3"},
+		NextProtos:         opts.QUIC.nextProtos(),
 	}
+	certs := &certCapture{}
+	tlsConf.VerifyPeerCertificate = certs.verify
+	tlsConf.CurvePreferences = quicCurvePreferences(opts.KeyShare)
+	ech := &echRejection{}
+	ech.applyTLS(tlsConf, opts.ECH)
 
+	trace := &quicTimingTrace{}
 	quicConf := &quic.Config{
 		HandshakeIdleTimeout: timeout,
+		Tracer:               trace.tracer(),
+		Versions:             opts.QUIC.versions(),
 	}
 
 	start := time.Now()
-	conn, err := quic.DialAddr(probeCtx, endpoint.Address(), tlsConf, quicConf)
-	latency := time.Since(start)
+	conn, release, err := dialQUIC(probeCtx, endpoint, tlsConf, quicConf, opts.Capture)
+	total := time.Since(start)
 
 	if conn != nil {
 		_ = conn.CloseWithError(0, "probe")
 	}
+	release()
 
-	// 即使握手因缺客户端证书被拒绝 (CRYPTO_ERROR 0x128)，
-	// 只要服务端回应了 ServerHello，latency < timeout 即为有效 RTT。
-	if err != nil {
-		errStr := err.Error()
-		// 如果是 Connection Refused 等网络错误，立马失败，防止把死节点当优选
-		if !strings.Contains(errStr, "CRYPTO_ERROR") && !strings.Contains(errStr, "APPLICATION_ERROR") {
-			return 0, fmt.Errorf("quic handshake %s: %w", endpoint.Address(), err)
+	// RTT 以首个服务端 Initial (ServerHello 或拒绝) 到达为准。即使握手因缺客户端证书
+	// 被拒绝 (CRYPTO_ERROR)，只要收到了服务端 Initial 就是有效 RTT；
+	// 完全没有回应 (超时、Connection Refused 等) 则视为失败，防止把死节点当优选。
+	timing, answered := trace.timing(start, total)
+	if ech.rejected.Load() {
+		err = fmt.Errorf("%w: %v", errECHRejected, err)
+	}
+	if !answered {
+		if err == nil {
+			err = errors.New("no server initial received")
 		}
+		return ProbeSample{}, fmt.Errorf("quic handshake %s: %w", endpoint.Address(), err)
+	}
+	return ProbeSample{Latency: timing.Initial, QUIC: &timing, Cert: certs.cert()}, err
+}
 
-		// 真正超时（完全没回应）时返回 0
-		if latency >= timeout-50*time.Millisecond {
-			return 0, fmt.Errorf("quic handshake timeout %s: %w", endpoint.Address(), err)
-		}
+// dialQUIC 建立 QUIC 连接。开启抓包时改用自建 Transport，
+// 以便经由 capturePacketConn 记录每个数据报。
+// 返回的 release 用于在连接关闭后释放底层 socket。
+func dialQUIC(ctx context.Context, endpoint Endpoint, tlsConf *tls.Config, quicConf *quic.Config, capture *PcapWriter) (*quic.Conn, func(), error) {
+	if capture == nil {
+		conn, err := quic.DialAddr(ctx, endpoint.Address(), tlsConf, quicConf)
+		return conn, func() {}, err
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", endpoint.Address())
+	if err != nil {
+		return nil, func() {}, err
+	}
+	udpConn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, func() {}, err
+	}
+	transport := &quic.Transport{
+		Conn: &capturePacketConn{PacketConn: udpConn, udp: udpConn, capture: capture, endpoint: endpoint},
+	}
+	release := func() {
+		_ = transport.Close()
+		_ = udpConn.Close()
 	}
-	return latency, err
+	conn, err := transport.Dial(ctx, addr, tlsConf, quicConf)
+	return conn, release, err
 }
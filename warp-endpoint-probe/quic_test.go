@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestProbeQUICHandshakeTiming(t *testing.T) {
+	edges := []SimEdge{
+		{Probe: ProbeQUIC, Address: "127.0.0.1:0", Latency: 20 * time.Millisecond, Mode: simModeCertRequired},
+		{Probe: ProbeQUIC, Address: "127.0.0.1:0", Latency: 20 * time.Millisecond, Mode: simModeAccept},
+		{Probe: ProbeQUIC, Address: "127.0.0.1:0", Mode: simModeDrop},
+	}
+	var key [32]byte
+	sim, err := StartSimulator(edges, key)
+	if err != nil {
+		t.Fatalf("start simulator: %v", err)
+	}
+	defer sim.Close()
+	ctx := context.Background()
+
+	// 服务端先回 ServerHello 再要求客户端证书：以 ServerHello 到达计 RTT，拒绝发生在客户端握手完成之后
+	sample, _ := ProbeQUICHandshake(ctx, simEndpoint(t, sim.Edges[0]), time.Second, ProbeOptions{})
+	if sample.QUIC == nil || sample.Cert == nil {
+		t.Fatalf("cert-required: sample=%+v", sample)
+	}
+	if sample.Latency != sample.QUIC.Initial || sample.QUIC.Initial < 20*time.Millisecond {
+		t.Fatalf("cert-required: unexpected initial rtt %+v", sample.QUIC)
+	}
+	if sample.QUIC.Handshake < sample.QUIC.Initial {
+		t.Fatalf("cert-required: missing handshake packet %+v", sample.QUIC)
+	}
+
+	sample, err = ProbeQUICHandshake(ctx, simEndpoint(t, sim.Edges[1]), time.Second, ProbeOptions{})
+	if err != nil || sample.QUIC == nil {
+		t.Fatalf("accept: sample=%+v err=%v", sample, err)
+	}
+	timing := *sample.QUIC
+	if timing.Initial < 20*time.Millisecond || timing.Handshake < timing.Initial || timing.Total < timing.Initial {
+		t.Fatalf("accept: inconsistent timing %s", timing)
+	}
+	if timing.SmoothedRTT < 20*time.Millisecond {
+		t.Fatalf("accept: smoothed rtt not reported %s", timing)
+	}
+
+	if sample, err := ProbeQUICHandshake(ctx, simEndpoint(t, sim.Edges[2]), 300*time.Millisecond, ProbeOptions{}); err == nil || sample.Latency != 0 {
+		t.Fatalf("drop: sample=%+v err=%v", sample, err)
+	}
+}
+
+func TestAverageQUICTiming(t *testing.T) {
+	if averageQUICTiming(nil) != nil {
+		t.Fatal("expected nil for no samples")
+	}
+	got := averageQUICTiming([]QUICTiming{
+		{Initial: 10 * time.Millisecond, Total: 30 * time.Millisecond},
+		{Initial: 20 * time.Millisecond, Handshake: 25 * time.Millisecond, SmoothedRTT: 18 * time.Millisecond, Total: 50 * time.Millisecond},
+	})
+	want := QUICTiming{Initial: 15 * time.Millisecond, Handshake: 25 * time.Millisecond, SmoothedRTT: 18 * time.Millisecond, Total: 40 * time.Millisecond}
+	if *got != want {
+		t.Fatalf("unexpected average: got=%s want=%s", got, want)
+	}
+}
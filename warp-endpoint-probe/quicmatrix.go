@@ -0,0 +1,147 @@
+package main
+
+// QUIC 版本 / ALPN 矩阵：对同一 endpoint 以 QUIC v1、v2 与多个 ALPN 的组合依次握手，
+// 区分 ServerHello、Version Negotiation、alert 与无回应，用于判断中间设备是否按版本放行，
+// 以及 Cloudflare 是否改变了所接受的 ALPN (探测默认只发 h3)。
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// quicMatrixTopN 为做版本 / ALPN 矩阵的候选数量。
+const quicMatrixTopN = 5
+
+// QUICVersionNegotiation 表示服务端以 Version Negotiation 拒绝所提供的版本。
+const QUICVersionNegotiation = "version-negotiation"
+
+// quicMatrixVersions 为矩阵中依次尝试的 QUIC 版本。
+var quicMatrixVersions = []quic.Version{quic.Version1, quic.Version2}
+
+// QUICOptions controls the version and ALPN offered by the QUIC handshake probe.
+type QUICOptions struct {
+	// Version 为 0 时使用 quic-go 默认版本列表。
+	Version quic.Version
+	// ALPN 为空时为 h3。
+	ALPN []string
+}
+
+func (opts QUICOptions) nextProtos() []string {
+	if len(opts.ALPN) == 0 {
+		return []string{"h3"}
+	}
+	return opts.ALPN
+}
+
+func (opts QUICOptions) versions() []quic.Version {
+	if opts.Version == 0 {
+		return nil
+	}
+	return []quic.Version{opts.Version}
+}
+
+// ParseALPNList 解析 -quic-matrix 的逗号分隔 ALPN 列表，h3 总是排在第一个。
+func ParseALPNList(value string) ([]string, error) {
+	alpns := []string{"h3"}
+	for _, alpn := range strings.Split(value, ",") {
+		alpn = strings.TrimSpace(alpn)
+		if alpn == "" || alpn == "h3" {
+			continue
+		}
+		if len(alpn) > 255 {
+			return nil, fmt.Errorf("invalid alpn %q: longer than 255 bytes", alpn)
+		}
+		alpns = append(alpns, alpn)
+	}
+	return alpns, nil
+}
+
+// QUICCapability is the outcome of one version / ALPN combination.
+type QUICCapability struct {
+	Version quic.Version
+	ALPN    string
+	Outcome string
+	Latency time.Duration
+	Err     error
+}
+
+// Name 为 "<version>/<alpn>"，如 v1/h3。
+func (result QUICCapability) Name() string {
+	return result.Version.String() + "/" + result.ALPN
+}
+
+func (result QUICCapability) String() string {
+	if result.Outcome == SNIServerHello || result.Outcome == SNIAlert {
+		return fmt.Sprintf("%s=%s(%dms)", result.Name(), result.Outcome, result.Latency.Milliseconds())
+	}
+	return result.Name() + "=" + result.Outcome
+}
+
+// QUICMatrix holds the per-combination outcomes of one endpoint.
+type QUICMatrix struct {
+	Endpoint string
+	Results  []QUICCapability
+}
+
+// ProbeQUICCapability 只提供 version 与 alpn 握手一次并归类结果。
+func ProbeQUICCapability(ctx context.Context, endpoint Endpoint, version quic.Version, alpn string, timeout time.Duration, opts ProbeOptions) QUICCapability {
+	opts.QUIC = QUICOptions{Version: version, ALPN: []string{alpn}}
+	sample, err := ProbeQUICHandshake(ctx, endpoint, timeout, opts)
+	result := QUICCapability{Version: version, ALPN: alpn, Err: err}
+	var versionErr *quic.VersionNegotiationError
+	switch {
+	case sample.QUIC != nil && (err == nil || sample.QUIC.Handshake > 0):
+		result.Outcome, result.Latency = SNIServerHello, sample.Latency
+	case sample.QUIC != nil:
+		result.Outcome, result.Latency = SNIAlert, sample.Latency
+	case errors.As(err, &versionErr):
+		result.Outcome = QUICVersionNegotiation
+	default:
+		result.Outcome = classifyNoAnswer(err)
+	}
+	return result
+}
+
+// CheckQUICMatrix 对每个候选依次尝试 quicMatrixVersions × alpns 的每个组合。
+func CheckQUICMatrix(ctx context.Context, candidates []Endpoint, alpns []string, timeout time.Duration, opts ProbeOptions) []QUICMatrix {
+	matrices := make([]QUICMatrix, 0, len(candidates))
+	for _, endpoint := range candidates {
+		matrix := QUICMatrix{Endpoint: endpoint.Address()}
+		for _, version := range quicMatrixVersions {
+			for _, alpn := range alpns {
+				matrix.Results = append(matrix.Results, ProbeQUICCapability(ctx, endpoint, version, alpn, timeout, opts))
+			}
+		}
+		matrices = append(matrices, matrix)
+	}
+	return matrices
+}
+
+// PrintQUICMatrix 每个 endpoint 输出一行，最后按组合汇总收到 ServerHello 的比例。
+func PrintQUICMatrix(w io.Writer, matrices []QUICMatrix) {
+	var names []string
+	serverHellos := make(map[string]int)
+	for _, matrix := range matrices {
+		cells := make([]string, 0, len(matrix.Results))
+		for _, result := range matrix.Results {
+			cells = append(cells, result.String())
+			if _, seen := serverHellos[result.Name()]; !seen {
+				names = append(names, result.Name())
+				serverHellos[result.Name()] = 0
+			}
+			if result.Outcome == SNIServerHello {
+				serverHellos[result.Name()]++
+			}
+		}
+		fmt.Fprintf(w, "QUIC: %s %s\n", matrix.Endpoint, strings.Join(cells, " "))
+	}
+	for _, name := range names {
+		fmt.Fprintf(w, "QUIC summary: %s server-hello=%d/%d\n", name, serverHellos[name], len(matrices))
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+func TestParseALPNList(t *testing.T) {
+	testCases := []struct {
+		value string
+		want  []string
+	}{
+		{value: "h3", want: []string{"h3"}},
+		{value: "h3-29, cf-masque", want: []string{"h3", "h3-29", "cf-masque"}},
+		{value: "h2,h3,", want: []string{"h3", "h2"}},
+	}
+	for _, testCase := range testCases {
+		actual, err := ParseALPNList(testCase.value)
+		if err != nil || !reflect.DeepEqual(actual, testCase.want) {
+			t.Fatalf("ParseALPNList(%q) = %v, %v; want %v", testCase.value, actual, err, testCase.want)
+		}
+	}
+	if _, err := ParseALPNList(strings.Repeat("x", 256)); err == nil {
+		t.Fatal("expected error for oversized alpn")
+	}
+}
+
+func TestProbeQUICCapability(t *testing.T) {
+	var edges []SimEdge
+	for _, spec := range []string{
+		"quic@127.0.0.1:0,mode=accept",
+		"quic@127.0.0.1:0,mode=accept,versions=v1",
+		"quic@127.0.0.1:0,mode=drop",
+	} {
+		edge, err := ParseSimEdge(spec, SimEdge{})
+		if err != nil {
+			t.Fatalf("parse %s: %v", spec, err)
+		}
+		edges = append(edges, edge)
+	}
+	var wgKey [32]byte
+	sim, err := StartSimulator(edges, wgKey)
+	if err != nil {
+		t.Fatalf("start simulator: %v", err)
+	}
+	defer sim.Close()
+
+	testCases := []struct {
+		name    string
+		edge    int
+		version quic.Version
+		alpn    string
+		want    string
+	}{
+		{name: "v1_h3", edge: 0, version: quic.Version1, alpn: "h3", want: SNIServerHello},
+		{name: "v2_h3", edge: 0, version: quic.Version2, alpn: "h3", want: SNIServerHello},
+		{name: "unknown_alpn", edge: 0, version: quic.Version1, alpn: "h3-29", want: SNIAlert},
+		{name: "v2_not_supported", edge: 1, version: quic.Version2, alpn: "h3", want: QUICVersionNegotiation},
+		{name: "v1_only_edge", edge: 1, version: quic.Version1, alpn: "h3", want: SNIServerHello},
+		{name: "silent", edge: 2, version: quic.Version1, alpn: "h3", want: SNITimeout},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			endpoint := simEndpoint(t, sim.Edges[testCase.edge])
+			result := ProbeQUICCapability(context.Background(), endpoint, testCase.version, testCase.alpn, 300*time.Millisecond, ProbeOptions{})
+			if result.Outcome != testCase.want {
+				t.Fatalf("unexpected outcome: got=%s want=%s err=%v", result.Outcome, testCase.want, result.Err)
+			}
+		})
+	}
+}
+
+func TestPrintQUICMatrix(t *testing.T) {
+	matrices := []QUICMatrix{
+		{Endpoint: "a", Results: []QUICCapability{
+			{Version: quic.Version1, ALPN: "h3", Outcome: SNIServerHello, Latency: 30 * time.Millisecond},
+			{Version: quic.Version2, ALPN: "h3", Outcome: QUICVersionNegotiation},
+		}},
+		{Endpoint: "b", Results: []QUICCapability{
+			{Version: quic.Version1, ALPN: "h3", Outcome: SNITimeout},
+			{Version: quic.Version2, ALPN: "h3", Outcome: SNITimeout},
+		}},
+	}
+	var out bytes.Buffer
+	PrintQUICMatrix(&out, matrices)
+	for _, want := range []string{
+		"QUIC: a v1/h3=server-hello(30ms) v2/h3=version-negotiation\n",
+		"QUIC summary: v1/h3 server-hello=1/2\n",
+		"QUIC summary: v2/h3 server-hello=0/2\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Fatalf("missing %q in:\n%s", want, out.String())
+		}
+	}
+}
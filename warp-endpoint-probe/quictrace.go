@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/qlog"
+	"github.com/quic-go/quic-go/qlogwriter"
+)
+
+// QUICTiming 为一次 QUIC 握手的分阶段耗时，均以首个客户端 Initial 发出为起点。
+// 按 docs/masque_api_analysis_report.md 的定义，RTT 取 ServerHello (首个服务端 Initial) 到达时刻。
+type QUICTiming struct {
+	// Initial 为首个服务端 Initial 包 (携带 ServerHello 或拒绝) 到达的耗时。
+	Initial time.Duration
+	// Handshake 为首个服务端 Handshake 包到达的耗时，握手在 Initial 阶段即被拒绝时为 0。
+	Handshake time.Duration
+	// SmoothedRTT 为 quic-go 拥塞控制估计的 smoothed RTT，未收到 ACK 时为 0。
+	SmoothedRTT time.Duration
+	// Total 为 Dial 从开始到返回 (完成或被拒绝) 的耗时。
+	Total time.Duration
+}
+
+func (timing QUICTiming) String() string {
+	return fmt.Sprintf("initial=%s handshake=%s srtt=%s total=%s",
+		timing.Initial.Round(time.Microsecond), timing.Handshake.Round(time.Microsecond),
+		timing.SmoothedRTT.Round(time.Microsecond), timing.Total.Round(time.Microsecond))
+}
+
+// quicTimingTrace 实现 qlogwriter.Trace / Recorder，仅在内存中记录握手关键事件的时刻，
+// 不做任何 JSON 编码。quic-go v0.5x 以 qlog 事件取代了旧的 logging.ConnectionTracer。
+type quicTimingTrace struct {
+	mu             sync.Mutex
+	firstSent      time.Time
+	firstInitial   time.Time
+	firstHandshake time.Time
+	smoothedRTT    time.Duration
+}
+
+var (
+	_ qlogwriter.Trace    = (*quicTimingTrace)(nil)
+	_ qlogwriter.Recorder = (*quicTimingTrace)(nil)
+)
+
+// tracer 返回用于 quic.Config.Tracer 的回调。
+func (trace *quicTimingTrace) tracer() func(context.Context, bool, quic.ConnectionID) qlogwriter.Trace {
+	return func(context.Context, bool, quic.ConnectionID) qlogwriter.Trace { return trace }
+}
+
+func (trace *quicTimingTrace) AddProducer() qlogwriter.Recorder { return trace }
+
+func (trace *quicTimingTrace) SupportsSchemas(string) bool { return false }
+
+func (trace *quicTimingTrace) Close() error { return nil }
+
+func (trace *quicTimingTrace) RecordEvent(event qlogwriter.Event) {
+	now := time.Now()
+	trace.mu.Lock()
+	defer trace.mu.Unlock()
+	switch e := event.(type) {
+	case qlog.PacketSent:
+		if trace.firstSent.IsZero() {
+			trace.firstSent = now
+		}
+	case qlog.PacketReceived:
+		switch e.Header.PacketType {
+		case qlog.PacketTypeInitial:
+			if trace.firstInitial.IsZero() {
+				trace.firstInitial = now
+			}
+		case qlog.PacketTypeHandshake:
+			if trace.firstHandshake.IsZero() {
+				trace.firstHandshake = now
+			}
+		}
+	case qlog.MetricsUpdated:
+		if e.SmoothedRTT > 0 {
+			trace.smoothedRTT = e.SmoothedRTT
+		}
+	}
+}
+
+// timing 汇总记录的事件；未收到任何服务端 Initial 时返回 false。
+func (trace *quicTimingTrace) timing(dialStart time.Time, total time.Duration) (QUICTiming, bool) {
+	trace.mu.Lock()
+	defer trace.mu.Unlock()
+	if trace.firstInitial.IsZero() {
+		return QUICTiming{}, false
+	}
+	start := trace.firstSent
+	if start.IsZero() {
+		start = dialStart
+	}
+	timing := QUICTiming{
+		Initial:     trace.firstInitial.Sub(start),
+		SmoothedRTT: trace.smoothedRTT,
+		Total:       total,
+	}
+	if !trace.firstHandshake.IsZero() {
+		timing.Handshake = trace.firstHandshake.Sub(start)
+	}
+	return timing, true
+}
+
+// averageQUICTiming 对多轮的分阶段耗时逐项取平均，只统计非零值。
+func averageQUICTiming(timings []QUICTiming) *QUICTiming {
+	if len(timings) == 0 {
+		return nil
+	}
+	avg := func(field func(QUICTiming) time.Duration) time.Duration {
+		var total time.Duration
+		var n int
+		for _, timing := range timings {
+			if value := field(timing); value > 0 {
+				total += value
+				n++
+			}
+		}
+		if n == 0 {
+			return 0
+		}
+		return total / time.Duration(n)
+	}
+	return &QUICTiming{
+		Initial:     avg(func(t QUICTiming) time.Duration { return t.Initial }),
+		Handshake:   avg(func(t QUICTiming) time.Duration { return t.Handshake }),
+		SmoothedRTT: avg(func(t QUICTiming) time.Duration { return t.SmoothedRTT }),
+		Total:       avg(func(t QUICTiming) time.Duration { return t.Total }),
+	}
+}
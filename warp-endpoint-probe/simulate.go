@@ -0,0 +1,818 @@
+package main
+
+// simulate 子命令：在本地运行 WARP edge 的替身，使整个优选链路可以离线测试。
+//   - wireguard: Noise IK 响应方 (自行生成类似 Cloudflare 的密钥)
+//   - quic: 回 ServerHello 后要求客户端证书，没有证书即拒绝，模拟未注册客户端
+//   - https: api.cloudflareclient.com 的替身 (TLS + WARP API JSON 响应)
+//   - h2: H2Tunnel 回退 (ALPN h2 + extended CONNECT)
+// 每个监听都可单独配置延迟、抖动、丢包与端口行为，TLS 边缘还可配置对后量子 key share 与 ECH 的处理。
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	mathrand "math/rand/v2"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/crypto/cryptobyte"
+	"golang.org/x/crypto/curve25519"
+)
+
+// QUIC / HTTPS 边缘的行为模式。
+const (
+	simModeCertRequired = "cert-required" // QUIC: 回 ServerHello 后要求客户端证书，没有证书即拒绝
+	simModeAccept       = "accept"        // QUIC: 完成握手
+	simModeMASQUE       = "masque"        // QUIC: 要求客户端证书，HTTP/3 CF-CONNECT-IP 返回 200 并应答隧道内 ICMP echo；H2: 带证书时 CONNECT 返回 200
+	simModeRefuse       = "refuse"        // QUIC / H2: 完成握手但 CONNECT 返回 403
+	simModeStall        = "stall"         // HTTPS / H2: 接受 TCP 但不回应 TLS
+	simModeReset        = "reset"         // HTTPS / H2: 接受后立即 RST
+	simModeWrongBackend = "wrong-backend" // HTTPS: 完成握手，HTTP 返回非 WARP API 的页面
+	simModeHangup       = "hangup"        // HTTPS: 完成握手，收到 HTTP 请求后断开
+)
+
+// TLS 边缘对 X25519MLKEM768 key share 的处理。
+const (
+	simPQOn   = "on"   // 与 Cloudflare 一致，优先协商 X25519MLKEM768
+	simPQOff  = "off"  // 服务端只支持经典曲线，仅含 PQ key share 的 ClientHello 收到 alert
+	simPQDrop = "drop" // 模拟中间设备：静默丢弃携带 PQ key share 的大 ClientHello
+)
+
+// HTTPS 边缘前按 SNI 阻断的中间设备，取到完整 SNI 即以 RST 断开。
+const (
+	simDPISegment = "segment" // 只检查首个 TCP 段，但会合并段内的多个 TLS 记录
+	simDPIStream  = "stream"  // 重组 TCP 流，但只检查首个 TLS 记录
+)
+
+var errSimDPIBlocked = errors.New("client hello blocked by simulated dpi")
+
+// TLS 边缘对 Encrypted Client Hello 的处理。配置了 ech 的模拟器会生成一个 ECHConfigList，
+// 启动时输出供 -ech 使用。
+const (
+	simECHOn   = "on"   // 持有私钥，接受 ECH
+	simECHOff  = "off"  // 不支持 ECH，以 public_name 完成外层握手
+	simECHDrop = "drop" // 模拟中间设备：静默丢弃 SNI 为 public_name 的 ClientHello
+)
+
+// simECHPublicName 与 Cloudflare 一致。
+const simECHPublicName = "cloudflare-ech.com"
+
+// simModes 为每种探测可选的模式，第一个为默认模式。
+var simModes = map[ProbeType][]string{
+	ProbeWireGuard: {simModeRespond, simModeCookie, simModeForge, simModeDrop},
+	ProbeQUIC:      {simModeCertRequired, simModeAccept, simModeMASQUE, simModeRefuse, simModeDrop},
+	ProbeHTTPS:     {simModeRespond, simModeStall, simModeReset, simModeWrongBackend, simModeHangup},
+	ProbeH2:        {simModeMASQUE, simModeRefuse, simModeStall, simModeReset},
+}
+
+// parseSimVersions 解析 "v1+v2" 形式的 QUIC 版本列表。
+func parseSimVersions(value string) ([]quic.Version, error) {
+	if value == "" {
+		return nil, nil
+	}
+	var versions []quic.Version
+	for _, name := range strings.Split(value, "+") {
+		switch name {
+		case "v1":
+			versions = append(versions, quic.Version1)
+		case "v2":
+			versions = append(versions, quic.Version2)
+		default:
+			return nil, fmt.Errorf("unknown quic version %q: want v1 | v2", name)
+		}
+	}
+	return versions, nil
+}
+
+// SimEdge describes one simulated listener.
+type SimEdge struct {
+	Probe   ProbeType
+	Address string
+	Latency time.Duration
+	Jitter  time.Duration
+	Loss    float64
+	Mode    string
+	// PQ 为 TLS 边缘对后量子 key share 的处理，空值等同 on。
+	PQ string
+	// MTU 非 0 时 UDP 边缘丢弃超过该大小的入向 IP 包，模拟路径 MTU。
+	MTU int
+	// Versions 为 QUIC 边缘支持的版本，如 "v1" 或 "v1+v2"，空值为 quic-go 默认 (v1、v2)。
+	Versions string
+	// DPI 非空时 HTTPS 边缘前有按 SNI 阻断的中间设备，见 simDPI* 常量。
+	DPI string
+	// ECH 为 TLS 边缘对 ECH 的处理，空值等同 off。
+	ECH string
+}
+
+func (edge SimEdge) String() string {
+	text := fmt.Sprintf("%s %s mode=%s latency=%s jitter=%s loss=%.0f%%",
+		edge.Probe, edge.Address, edge.Mode, edge.Latency, edge.Jitter, edge.Loss*100)
+	if edge.PQ != "" && edge.PQ != simPQOn {
+		text += " pq=" + edge.PQ
+	}
+	if edge.MTU > 0 {
+		text += fmt.Sprintf(" mtu=%d", edge.MTU)
+	}
+	if edge.Versions != "" {
+		text += " versions=" + edge.Versions
+	}
+	if edge.DPI != "" {
+		text += " dpi=" + edge.DPI
+	}
+	if edge.ECH != "" {
+		text += " ech=" + edge.ECH
+	}
+	return text
+}
+
+// delay 返回一次应答的模拟延迟。
+func (edge SimEdge) delay() time.Duration {
+	if edge.Jitter <= 0 {
+		return edge.Latency
+	}
+	return edge.Latency + time.Duration(mathrand.Int64N(int64(2*edge.Jitter))) - edge.Jitter
+}
+
+func (edge SimEdge) drop() bool {
+	return edge.Loss > 0 && mathrand.Float64() < edge.Loss
+}
+
+// ParseSimEdge parses "<probe>@<host>:<port>[,latency=..][,jitter=..][,loss=..][,mode=..][,pq=..][,mtu=..][,versions=..][,dpi=..][,ech=..]".
+// Unset fields inherit from defaults.
+func ParseSimEdge(value string, defaults SimEdge) (SimEdge, error) {
+	fields := strings.Split(strings.TrimSpace(value), ",")
+	probe, address, ok := strings.Cut(fields[0], "@")
+	if !ok {
+		return SimEdge{}, fmt.Errorf("invalid edge %q: want <probe>@<host>:<port>", value)
+	}
+
+	edge := defaults
+	edge.Probe = ProbeType(strings.ToLower(probe))
+	edge.Address = address
+	edge.Mode = ""
+	modes, ok := simModes[edge.Probe]
+	if !ok {
+		return SimEdge{}, fmt.Errorf("invalid edge %q: %w: %s", value, ErrUnsupportedProbe, probe)
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return SimEdge{}, fmt.Errorf("invalid edge %q: %w", value, err)
+	}
+
+	for _, field := range fields[1:] {
+		key, raw, ok := strings.Cut(field, "=")
+		if !ok {
+			return SimEdge{}, fmt.Errorf("invalid edge option %q", field)
+		}
+		var err error
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "latency":
+			edge.Latency, err = time.ParseDuration(raw)
+		case "jitter":
+			edge.Jitter, err = time.ParseDuration(raw)
+		case "loss":
+			edge.Loss, err = strconv.ParseFloat(raw, 64)
+			if err == nil && (edge.Loss < 0 || edge.Loss > 1) {
+				err = errors.New("must be within [0, 1]")
+			}
+		case "mode":
+			edge.Mode = strings.ToLower(raw)
+		case "pq":
+			edge.PQ = strings.ToLower(raw)
+			switch {
+			case edge.Probe == ProbeWireGuard:
+				err = errors.New("only applies to TLS edges")
+			case edge.PQ != simPQOn && edge.PQ != simPQOff && edge.PQ != simPQDrop:
+				err = fmt.Errorf("want %s | %s | %s", simPQOn, simPQOff, simPQDrop)
+			}
+		case "mtu":
+			edge.MTU, err = strconv.Atoi(raw)
+			switch {
+			case err != nil:
+			case edge.Probe != ProbeWireGuard && edge.Probe != ProbeQUIC:
+				err = errors.New("only applies to UDP edges")
+			case edge.MTU < 576:
+				err = errors.New("must be at least 576")
+			}
+		case "versions":
+			edge.Versions = strings.ToLower(raw)
+			if edge.Probe != ProbeQUIC {
+				err = errors.New("only applies to QUIC edges")
+			} else {
+				_, err = parseSimVersions(edge.Versions)
+			}
+		case "dpi":
+			edge.DPI = strings.ToLower(raw)
+			switch {
+			case edge.Probe != ProbeHTTPS:
+				err = errors.New("only applies to HTTPS edges")
+			case edge.DPI != simDPISegment && edge.DPI != simDPIStream:
+				err = fmt.Errorf("want %s | %s", simDPISegment, simDPIStream)
+			}
+		case "ech":
+			edge.ECH = strings.ToLower(raw)
+			switch {
+			case edge.Probe == ProbeWireGuard:
+				err = errors.New("only applies to TLS edges")
+			case edge.ECH != simECHOn && edge.ECH != simECHOff && edge.ECH != simECHDrop:
+				err = fmt.Errorf("want %s | %s | %s", simECHOn, simECHOff, simECHDrop)
+			}
+		default:
+			err = errors.New("unknown option")
+		}
+		if err != nil {
+			return SimEdge{}, fmt.Errorf("invalid edge option %q: %w", field, err)
+		}
+	}
+
+	if edge.Mode == "" {
+		edge.Mode = modes[0]
+	}
+	for _, mode := range modes {
+		if edge.Mode == mode {
+			return edge, nil
+		}
+	}
+	return SimEdge{}, fmt.Errorf("invalid edge %q: mode %s not in %v", value, edge.Mode, modes)
+}
+
+// DefaultSimEdges 在每个 host 上按真实地址池的端口布置监听。
+func DefaultSimEdges(hosts []string, defaults SimEdge) []SimEdge {
+	var edges []SimEdge
+	for _, host := range hosts {
+		for _, port := range tunnelTargets["consumer"].Ports {
+			edge := defaults
+			edge.Probe, edge.Mode = ProbeWireGuard, simModeRespond
+			edge.Address = net.JoinHostPort(host, strconv.Itoa(port))
+			edges = append(edges, edge)
+		}
+		quicEdge, httpsEdge := defaults, defaults
+		quicEdge.Probe, quicEdge.Mode = ProbeQUIC, simModeCertRequired
+		quicEdge.Address = net.JoinHostPort(host, "443")
+		httpsEdge.Probe, httpsEdge.Mode = ProbeHTTPS, simModeRespond
+		httpsEdge.Address = net.JoinHostPort(host, "443")
+		edges = append(edges, quicEdge, httpsEdge)
+	}
+	return edges
+}
+
+// Simulator runs a set of simulated edges.
+type Simulator struct {
+	PeerPublic [32]byte
+	// ECHConfigList 为 ECH 边缘的公钥配置，没有边缘配置 ech 时为 nil。
+	ECHConfigList []byte
+	// Edges 与启动参数一一对应，Address 为实际监听地址 (端口 0 时已解析)。
+	Edges []SimEdge
+
+	echKey  tls.EncryptedClientHelloKey
+	closers []io.Closer
+	wg      sync.WaitGroup
+	// done 在 Close 时关闭，释放被 pq=drop 挂起的握手。
+	done chan struct{}
+}
+
+// StartSimulator starts all edges; the WireGuard edges share privateKey.
+func StartSimulator(edges []SimEdge, privateKey [32]byte) (*Simulator, error) {
+	sim := &Simulator{done: make(chan struct{})}
+	var tlsConf *tls.Config
+	for _, edge := range edges {
+		if edge.Probe != ProbeWireGuard && tlsConf == nil {
+			cert, err := simCertificate()
+			if err != nil {
+				return nil, err
+			}
+			tlsConf = &tls.Config{Certificates: []tls.Certificate{cert}}
+		}
+		if edge.ECH != "" && sim.ECHConfigList == nil {
+			var err error
+			if sim.echKey, sim.ECHConfigList, err = simECHKey(simECHPublicName); err != nil {
+				return nil, err
+			}
+		}
+
+		var err error
+		switch edge.Probe {
+		case ProbeWireGuard:
+			edge, err = sim.startWireGuard(edge, privateKey)
+		case ProbeQUIC:
+			edge, err = sim.startQUIC(edge, sim.edgeTLSConfig(edge, tlsConf))
+		case ProbeHTTPS:
+			edge, err = sim.startHTTPS(edge, sim.edgeTLSConfig(edge, tlsConf))
+		case ProbeH2:
+			edge, err = sim.startH2(edge, sim.edgeTLSConfig(edge, tlsConf))
+		}
+		if err != nil {
+			sim.Close()
+			return nil, fmt.Errorf("start %s edge %s: %w", edge.Probe, edge.Address, err)
+		}
+		sim.Edges = append(sim.Edges, edge)
+	}
+	curve25519.ScalarBaseMult(&sim.PeerPublic, &privateKey)
+	return sim, nil
+}
+
+// edgeTLSConfig 按 PQ 与 ECH 行为派生边缘的 TLS 配置。
+func (sim *Simulator) edgeTLSConfig(edge SimEdge, base *tls.Config) *tls.Config {
+	tlsConf := base.Clone()
+	switch edge.PQ {
+	case simPQOff:
+		tlsConf.CurvePreferences = []tls.CurveID{tls.X25519, tls.CurveP256}
+	case simPQDrop:
+		tlsConf.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			if !slices.Contains(hello.SupportedCurves, tls.X25519MLKEM768) {
+				return nil, nil
+			}
+			return nil, sim.stall(hello, "post-quantum client hello dropped")
+		}
+	}
+	switch edge.ECH {
+	case simECHOn:
+		tlsConf.EncryptedClientHelloKeys = []tls.EncryptedClientHelloKey{sim.echKey}
+	case simECHDrop:
+		// 没有私钥时 GetConfigForClient 看到的是外层 ClientHello
+		next := tlsConf.GetConfigForClient
+		tlsConf.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			if hello.ServerName == simECHPublicName {
+				return nil, sim.stall(hello, "encrypted client hello dropped")
+			}
+			if next != nil {
+				return next(hello)
+			}
+			return nil, nil
+		}
+	}
+	return tlsConf
+}
+
+// stall 不回应也不关闭，直到连接上下文结束或模拟器关闭，返回 reason 作为错误。
+func (sim *Simulator) stall(hello *tls.ClientHelloInfo, reason string) error {
+	select {
+	case <-hello.Context().Done():
+	case <-sim.done:
+	}
+	return errors.New(reason)
+}
+
+// Close stops all listeners.
+func (sim *Simulator) Close() {
+	close(sim.done)
+	for _, closer := range sim.closers {
+		_ = closer.Close()
+	}
+	sim.wg.Wait()
+}
+
+func (sim *Simulator) startWireGuard(edge SimEdge, privateKey [32]byte) (SimEdge, error) {
+	conn, err := net.ListenPacket("udp", edge.Address)
+	if err != nil {
+		return edge, err
+	}
+	edge.Address = conn.LocalAddr().String()
+	responder, err := newSimWireGuard(edge, &simPacketConn{PacketConn: conn, edge: edge}, privateKey)
+	if err != nil {
+		_ = conn.Close()
+		return edge, err
+	}
+	sim.closers = append(sim.closers, conn)
+	sim.wg.Add(1)
+	go func() {
+		defer sim.wg.Done()
+		responder.serve()
+	}()
+	return edge, nil
+}
+
+func (sim *Simulator) startQUIC(edge SimEdge, base *tls.Config) (SimEdge, error) {
+	versions, err := parseSimVersions(edge.Versions)
+	if err != nil {
+		return edge, err
+	}
+	conn, err := net.ListenPacket("udp", edge.Address)
+	if err != nil {
+		return edge, err
+	}
+	edge.Address = conn.LocalAddr().String()
+
+	if edge.Mode == simModeDrop {
+		// 只占用端口，不回应任何报文
+		sim.closers = append(sim.closers, conn)
+		return edge, nil
+	}
+
+	tlsConf := base.Clone()
+	tlsConf.NextProtos = []string{"h3"}
+	switch edge.Mode {
+	case simModeCertRequired, simModeMASQUE, simModeRefuse:
+		// 与 Cloudflare 一致：先回 ServerHello 并要求客户端证书，没有证书时服务端在握手末尾拒绝
+		tlsConf.ClientAuth = tls.RequireAnyClientCert
+	}
+
+	transport := &quic.Transport{Conn: &simPacketConn{PacketConn: conn, edge: edge}}
+	listener, err := transport.Listen(tlsConf, &quic.Config{EnableDatagrams: true, InitialPacketSize: masqueInitialPacketSize, Versions: versions})
+	if err != nil {
+		_ = conn.Close()
+		return edge, err
+	}
+
+	if edge.Mode == simModeMASQUE || edge.Mode == simModeRefuse {
+		server := &http3.Server{Handler: simMASQUEHandler(edge.Mode), EnableDatagrams: true}
+		sim.closers = append(sim.closers, server, listener, transport, conn)
+		sim.wg.Add(1)
+		go func() {
+			defer sim.wg.Done()
+			_ = server.ServeListener(listener)
+		}()
+		return edge, nil
+	}
+
+	sim.closers = append(sim.closers, listener, transport, conn)
+	sim.wg.Add(1)
+	go func() {
+		defer sim.wg.Done()
+		for {
+			session, err := listener.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			_ = session.CloseWithError(0, "simulated edge")
+		}
+	}()
+	return edge, nil
+}
+
+// simMASQUEHandler 只接受带客户端证书的 CF-CONNECT-IP extended CONNECT。
+func simMASQUEHandler(mode string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method != http.MethodConnect || r.Proto != masqueConnectProtocol:
+			w.WriteHeader(http.StatusBadRequest)
+		case mode == simModeRefuse || r.TLS == nil || len(r.TLS.PeerCertificates) == 0:
+			w.WriteHeader(http.StatusForbidden)
+		default:
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			serveSimMASQUEEcho(r.Context(), w.(http3.HTTPStreamer).HTTPStream())
+		}
+	})
+}
+
+// serveSimMASQUEEcho 对会话内 Context ID 为 0 的 datagram 应答 ICMP echo，直到会话结束。
+func serveSimMASQUEEcho(ctx context.Context, stream *http3.Stream) {
+	for {
+		payload, err := stream.ReceiveDatagram(ctx)
+		if err != nil {
+			return
+		}
+		if len(payload) < 2 || payload[0] != 0 {
+			continue
+		}
+		if reply := echoReplyFor(payload[1:]); reply != nil {
+			_ = stream.SendDatagram(append([]byte{0}, reply...))
+		}
+	}
+}
+
+func (sim *Simulator) startHTTPS(edge SimEdge, tlsConf *tls.Config) (SimEdge, error) {
+	listener, err := net.Listen("tcp", edge.Address)
+	if err != nil {
+		return edge, err
+	}
+	edge.Address = listener.Addr().String()
+
+	// 与 Cloudflare 一致，按 ALPN 提供 h2 与 HTTP/1.1
+	tlsConf = tlsConf.Clone()
+	tlsConf.NextProtos = []string{"h2", "http/1.1"}
+	server := &http.Server{
+		Handler: simAPIHandler(edge.Mode),
+		// 探测方在握手后直接断开，不输出 TLS handshake error
+		ErrorLog: log.New(io.Discard, "", 0),
+	}
+	sim.closers = append(sim.closers, server)
+	sim.wg.Add(1)
+	go func() {
+		defer sim.wg.Done()
+		_ = server.Serve(tls.NewListener(&simListener{Listener: listener, edge: edge}, tlsConf))
+	}()
+	return edge, nil
+}
+
+// simAPIHandler 模拟 api.cloudflareclient.com：client_config 返回配置，其余路径返回 404，
+// 两者都使用 Cloudflare API 的 JSON 信封。
+func simAPIHandler(mode string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case mode == simModeHangup:
+			panic(http.ErrAbortHandler)
+		case mode == simModeWrongBackend:
+			w.Header().Set("Content-Type", "text/html")
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintln(w, "<html><body>403 Forbidden</body></html>")
+		case strings.HasSuffix(r.URL.Path, "/client_config"):
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintln(w, `{"result":{"denylist":{}},"success":true,"errors":[],"messages":[]}`)
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintln(w, `{"result":null,"success":false,"errors":[{"code":1000,"message":"Not Found"}],"messages":[]}`)
+		}
+	})
+}
+
+// simPacketConn 在 UDP 上模拟丢包、路径 MTU (入方向) 与延迟 (出方向)。
+// 不暴露 *net.UDPConn，quic-go 因此走 ReadFrom / WriteTo。
+type simPacketConn struct {
+	net.PacketConn
+	edge SimEdge
+}
+
+func (c *simPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	if c.edge.MTU > 0 {
+		return c.readWithinMTU(b)
+	}
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(b)
+		if err != nil || !c.edge.drop() {
+			return n, addr, err
+		}
+	}
+}
+
+// readWithinMTU 先读入足够大的缓冲区，以免 b 较小时按截断后的长度判断 MTU。
+func (c *simPacketConn) readWithinMTU(b []byte) (int, net.Addr, error) {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(buf)
+		if err != nil {
+			return 0, addr, err
+		}
+		ipHeader := 20
+		if udpAddr, ok := addr.(*net.UDPAddr); ok && udpAddr.IP.To4() == nil {
+			ipHeader = 40
+		}
+		if n+udpHeaderSize+ipHeader > c.edge.MTU || c.edge.drop() {
+			continue
+		}
+		return copy(b, buf[:n]), addr, nil
+	}
+}
+
+func (c *simPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	delay := c.edge.delay()
+	if delay <= 0 {
+		return c.PacketConn.WriteTo(b, addr)
+	}
+	packet := append([]byte(nil), b...)
+	time.AfterFunc(delay, func() {
+		_, _ = c.PacketConn.WriteTo(packet, addr)
+	})
+	return len(b), nil
+}
+
+// simListener 按端口行为处理 TCP 连接，丢包体现为直接关闭连接。
+type simListener struct {
+	net.Listener
+	edge SimEdge
+}
+
+func (l *simListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case l.edge.Mode == simModeReset || l.edge.drop():
+			if tcpConn, ok := conn.(*net.TCPConn); ok {
+				_ = tcpConn.SetLinger(0)
+			}
+			_ = conn.Close()
+		case l.edge.Mode == simModeStall:
+			// 保持连接直到客户端超时关闭
+			go func() {
+				_, _ = io.Copy(io.Discard, conn)
+				_ = conn.Close()
+			}()
+		case l.edge.DPI != "":
+			return &simConn{Conn: &simDPIConn{Conn: conn, mode: l.edge.DPI}, edge: l.edge}, nil
+		default:
+			return &simConn{Conn: conn, edge: l.edge}, nil
+		}
+	}
+}
+
+// simDPIConn 在第一次读时按模式检查 ClientHello，未阻断时把已读的字节交还给 TLS 服务端。
+type simDPIConn struct {
+	net.Conn
+	mode      string
+	inspected bool
+	pending   []byte
+}
+
+func (c *simDPIConn) Read(b []byte) (int, error) {
+	if !c.inspected {
+		c.inspected = true
+		seen, err := c.inspect()
+		if err != nil {
+			return 0, err
+		}
+		c.pending = seen
+	}
+	if len(c.pending) > 0 {
+		n := copy(b, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *simDPIConn) inspect() ([]byte, error) {
+	buf := make([]byte, 64<<10)
+	n, err := c.Conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	seen := buf[:n]
+	recordEnd := func(data []byte) int {
+		return 5 + (int(data[3])<<8 | int(data[4]))
+	}
+
+	var handshake []byte
+	if c.mode == simDPIStream {
+		for len(seen) < 5 || len(seen) < recordEnd(seen) {
+			if n, err = c.Conn.Read(buf[len(seen):]); err != nil {
+				return nil, err
+			}
+			seen = buf[:len(seen)+n]
+		}
+		handshake = seen[5:recordEnd(seen)]
+	} else {
+		for rest := seen; len(rest) >= 5; {
+			end := min(recordEnd(rest), len(rest))
+			handshake = append(handshake, rest[5:end]...)
+			rest = rest[end:]
+		}
+	}
+	if _, _, ok := clientHelloSNI(handshake); ok {
+		if tcpConn, ok := c.Conn.(*net.TCPConn); ok {
+			_ = tcpConn.SetLinger(0)
+		}
+		_ = c.Conn.Close()
+		return nil, errSimDPIBlocked
+	}
+	return seen, nil
+}
+
+// simConn 在每次写出前等待模拟延迟。
+type simConn struct {
+	net.Conn
+	edge SimEdge
+}
+
+func (c *simConn) Write(b []byte) (int, error) {
+	time.Sleep(c.edge.delay())
+	return c.Conn.Write(b)
+}
+
+// simECHKey 生成 DHKEM(X25519) 私钥及对应的 ECHConfig (HKDF-SHA256, AES-128-GCM)，
+// 返回服务端密钥与只含该配置的 ECHConfigList。
+func simECHKey(publicName string) (tls.EncryptedClientHelloKey, []byte, error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return tls.EncryptedClientHelloKey{}, nil, fmt.Errorf("generate ech key: %w", err)
+	}
+	var config cryptobyte.Builder
+	config.AddUint16(echConfigVersion)
+	config.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint8(1)       // config_id
+		b.AddUint16(0x0020) // DHKEM(X25519, HKDF-SHA256)
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(key.PublicKey().Bytes()) })
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddUint16(0x0001) // HKDF-SHA256
+			b.AddUint16(0x0001) // AES-128-GCM
+		})
+		b.AddUint8(0) // maximum_name_length
+		b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes([]byte(publicName)) })
+		b.AddUint16(0) // extensions
+	})
+	raw, err := config.Bytes()
+	if err != nil {
+		return tls.EncryptedClientHelloKey{}, nil, fmt.Errorf("marshal ech config: %w", err)
+	}
+	var list cryptobyte.Builder
+	list.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(raw) })
+	return tls.EncryptedClientHelloKey{Config: raw, PrivateKey: key.Bytes(), SendAsRetry: true}, list.BytesOrPanic(), nil
+}
+
+// simCertificate 生成自签名证书，SAN 覆盖 WARP 使用的 SNI。
+func simCertificate() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: DefaultSNI},
+		DNSNames:     append([]string{DefaultSNI, MasqueSNI, "localhost"}, MasqueSNIs...),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// stringList 是可重复的 flag。
+type stringList []string
+
+func (l *stringList) String() string     { return strings.Join(*l, " ") }
+func (l *stringList) Set(v string) error { *l = append(*l, v); return nil }
+
+// runSimulate 实现 `warp-endpoint-probe simulate`。
+func runSimulate(args []string) {
+	flags := flag.NewFlagSet("simulate", flag.ExitOnError)
+	listen := flags.String("listen", "127.0.0.1", "Comma-separated hosts for the default edges")
+	latency := flags.Duration("latency", 0, "Default one-way reply delay")
+	jitter := flags.Duration("jitter", 0, "Default +/- delay jitter")
+	loss := flags.Float64("loss", 0, "Default inbound loss ratio 0..1")
+	privateKeyOpt := flags.String("wg-private-key", "", "Responder private key (base64, random if empty)")
+	duration := flags.Duration("duration", 0, "Stop after this long (0=until SIGINT/SIGTERM)")
+	var edgeSpecs stringList
+	flags.Var(&edgeSpecs, "edge", "Edge <probe>@<host>:<port>[,latency=..,jitter=..,loss=..,mode=..,pq=..,mtu=..,versions=..,dpi=..,ech=..] (repeatable)")
+	_ = flags.Parse(args)
+
+	defaults := SimEdge{Latency: *latency, Jitter: *jitter, Loss: *loss}
+	var edges []SimEdge
+	for _, spec := range edgeSpecs {
+		edge, err := ParseSimEdge(spec, defaults)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+			os.Exit(2)
+		}
+		edges = append(edges, edge)
+	}
+	if len(edges) == 0 {
+		edges = DefaultSimEdges(strings.Split(*listen, ","), defaults)
+	}
+
+	var privateKey [32]byte
+	if *privateKeyOpt != "" {
+		key, err := ParseWireGuardKey(*privateKeyOpt)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+			os.Exit(2)
+		}
+		privateKey = key
+	} else if _, err := rand.Read(privateKey[:]); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: generating key: %v\n", err)
+		os.Exit(2)
+	}
+
+	sim, err := StartSimulator(edges, privateKey)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		os.Exit(2)
+	}
+	defer sim.Close()
+
+	fmt.Printf("PeerKey=%s\n", base64.StdEncoding.EncodeToString(sim.PeerPublic[:]))
+	if sim.ECHConfigList != nil {
+		fmt.Printf("ECHConfigList=%s\n", base64.StdEncoding.EncodeToString(sim.ECHConfigList))
+	}
+	for _, edge := range sim.Edges {
+		fmt.Printf("Edge: %s\n", edge)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *duration)
+		defer cancel()
+	}
+	<-ctx.Done()
+}
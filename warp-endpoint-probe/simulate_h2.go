@@ -0,0 +1,86 @@
+package main
+
+// 模拟 H2Tunnel 边缘：TLS 上 ALPN h2，SETTINGS 声明 ENABLE_CONNECT_PROTOCOL，
+// 对 CF-CONNECT-IP extended CONNECT 按模式返回 200 / 403。只处理响应头，不转发隧道数据。
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"strconv"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+func (sim *Simulator) startH2(edge SimEdge, base *tls.Config) (SimEdge, error) {
+	listener, err := net.Listen("tcp", edge.Address)
+	if err != nil {
+		return edge, err
+	}
+	edge.Address = listener.Addr().String()
+
+	tlsConf := base.Clone()
+	tlsConf.NextProtos = []string{http2.NextProtoTLS}
+	tlsConf.ClientAuth = tls.RequestClientCert
+	tlsListener := tls.NewListener(&simListener{Listener: listener, edge: edge}, tlsConf)
+
+	sim.closers = append(sim.closers, tlsListener)
+	sim.wg.Add(1)
+	go func() {
+		defer sim.wg.Done()
+		for {
+			conn, err := tlsListener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSimH2(conn.(*tls.Conn), edge.Mode)
+		}
+	}()
+	return edge, nil
+}
+
+// serveSimH2 处理一个连接，直到客户端断开。
+func serveSimH2(conn *tls.Conn, mode string) {
+	defer conn.Close()
+	if err := conn.Handshake(); err != nil {
+		return
+	}
+	preface := make([]byte, len(http2.ClientPreface))
+	if _, err := io.ReadFull(conn, preface); err != nil || string(preface) != http2.ClientPreface {
+		return
+	}
+	framer := http2.NewFramer(conn, conn)
+	framer.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+	if err := framer.WriteSettings(http2.Setting{ID: http2.SettingEnableConnectProtocol, Val: 1}); err != nil {
+		return
+	}
+
+	hasCert := len(conn.ConnectionState().PeerCertificates) > 0
+	for {
+		frame, err := framer.ReadFrame()
+		if err != nil {
+			return
+		}
+		switch frame := frame.(type) {
+		case *http2.SettingsFrame:
+			if !frame.IsAck() {
+				_ = framer.WriteSettingsAck()
+			}
+		case *http2.MetaHeadersFrame:
+			status := 200
+			switch {
+			case frame.PseudoValue("method") != "CONNECT" || frame.PseudoValue("protocol") != masqueConnectProtocol:
+				status = 400
+			case mode == simModeRefuse || !hasCert:
+				status = 403
+			}
+			var block bytes.Buffer
+			_ = hpack.NewEncoder(&block).WriteField(hpack.HeaderField{Name: ":status", Value: strconv.Itoa(status)})
+			_ = framer.WriteHeaders(http2.HeadersFrameParam{
+				StreamID: frame.StreamID, BlockFragment: block.Bytes(), EndHeaders: true, EndStream: status != 200,
+			})
+		}
+	}
+}
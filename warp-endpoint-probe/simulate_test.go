@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseSimEdge(t *testing.T) {
+	defaults := SimEdge{Latency: 10 * time.Millisecond}
+	testCases := []struct {
+		name     string
+		value    string
+		expected SimEdge
+		wantErr  bool
+	}{
+		{name: "defaults", value: "wireguard@127.0.0.1:2408",
+			expected: SimEdge{Probe: ProbeWireGuard, Address: "127.0.0.1:2408", Latency: 10 * time.Millisecond, Mode: simModeRespond}},
+		{name: "options", value: "quic@127.0.0.2:443,latency=30ms,jitter=5ms,loss=0.25,mode=accept",
+			expected: SimEdge{Probe: ProbeQUIC, Address: "127.0.0.2:443", Latency: 30 * time.Millisecond, Jitter: 5 * time.Millisecond, Loss: 0.25, Mode: simModeAccept}},
+		{name: "https_reset", value: "https@[::1]:443,mode=reset",
+			expected: SimEdge{Probe: ProbeHTTPS, Address: "[::1]:443", Latency: 10 * time.Millisecond, Mode: simModeReset}},
+		{name: "https_pq_drop", value: "https@127.0.0.1:443,pq=DROP",
+			expected: SimEdge{Probe: ProbeHTTPS, Address: "127.0.0.1:443", Latency: 10 * time.Millisecond, Mode: simModeRespond, PQ: simPQDrop}},
+		{name: "https_wrong_backend", value: "https@127.0.0.1:443,mode=wrong-backend",
+			expected: SimEdge{Probe: ProbeHTTPS, Address: "127.0.0.1:443", Latency: 10 * time.Millisecond, Mode: simModeWrongBackend}},
+		{name: "https_dpi", value: "https@127.0.0.1:443,dpi=Stream",
+			expected: SimEdge{Probe: ProbeHTTPS, Address: "127.0.0.1:443", Latency: 10 * time.Millisecond, Mode: simModeRespond, DPI: simDPIStream}},
+		{name: "quic_ech", value: "quic@127.0.0.1:443,ech=On",
+			expected: SimEdge{Probe: ProbeQUIC, Address: "127.0.0.1:443", Latency: 10 * time.Millisecond, Mode: simModeCertRequired, ECH: simECHOn}},
+		{name: "ech_for_wireguard", value: "wireguard@127.0.0.1:2408,ech=on", wantErr: true},
+		{name: "bad_ech", value: "https@127.0.0.1:443,ech=grease", wantErr: true},
+		{name: "dpi_for_quic", value: "quic@127.0.0.1:443,dpi=segment", wantErr: true},
+		{name: "hangup_for_h2", value: "h2@127.0.0.1:443,mode=hangup", wantErr: true},
+		{name: "pq_for_wireguard", value: "wireguard@127.0.0.1:2408,pq=off", wantErr: true},
+		{name: "bad_pq", value: "quic@127.0.0.1:443,pq=maybe", wantErr: true},
+		{name: "quic_mtu", value: "quic@127.0.0.1:443,mtu=1400",
+			expected: SimEdge{Probe: ProbeQUIC, Address: "127.0.0.1:443", Latency: 10 * time.Millisecond, Mode: simModeCertRequired, MTU: 1400}},
+		{name: "quic_versions", value: "quic@127.0.0.1:443,versions=V1",
+			expected: SimEdge{Probe: ProbeQUIC, Address: "127.0.0.1:443", Latency: 10 * time.Millisecond, Mode: simModeCertRequired, Versions: "v1"}},
+		{name: "bad_versions", value: "quic@127.0.0.1:443,versions=v1+draft-29", wantErr: true},
+		{name: "mtu_for_tcp", value: "https@127.0.0.1:443,mtu=1400", wantErr: true},
+		{name: "mtu_too_small", value: "wireguard@127.0.0.1:2408,mtu=500", wantErr: true},
+		{name: "mode_for_other_probe", value: "https@127.0.0.1:443,mode=cookie", wantErr: true},
+		{name: "bad_loss", value: "wireguard@127.0.0.1:500,loss=2", wantErr: true},
+		{name: "unknown_probe", value: "tcp@127.0.0.1:80", wantErr: true},
+		{name: "missing_port", value: "wireguard@127.0.0.1", wantErr: true},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			actual, err := ParseSimEdge(testCase.value, defaults)
+			if testCase.wantErr {
+				if err == nil {
+					t.Fatalf("expected error for %q", testCase.value)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if actual != testCase.expected {
+				t.Fatalf("unexpected edge: got=%+v want=%+v", actual, testCase.expected)
+			}
+		})
+	}
+}
+
+func simEndpoint(t *testing.T, edge SimEdge) Endpoint {
+	t.Helper()
+	host, port, err := net.SplitHostPort(edge.Address)
+	if err != nil {
+		t.Fatalf("split %s: %v", edge.Address, err)
+	}
+	portNum, _ := strconv.Atoi(port)
+	return Endpoint{IP: host, Port: portNum, Probe: edge.Probe}
+}
+
+func TestSimulatorEdges(t *testing.T) {
+	privateKey, _ := randomKey(t)
+	var edges []SimEdge
+	for _, spec := range []string{
+		"wireguard@127.0.0.1:0,latency=20ms",
+		"wireguard@127.0.0.1:0,mode=cookie",
+		"wireguard@127.0.0.1:0,mode=forge",
+		"wireguard@127.0.0.1:0,loss=1",
+		"quic@127.0.0.1:0",
+		"https@127.0.0.1:0",
+		"https@127.0.0.1:0,mode=reset",
+	} {
+		edge, err := ParseSimEdge(spec, SimEdge{})
+		if err != nil {
+			t.Fatalf("parse %s: %v", spec, err)
+		}
+		edges = append(edges, edge)
+	}
+	sim, err := StartSimulator(edges, privateKey)
+	if err != nil {
+		t.Fatalf("start simulator: %v", err)
+	}
+	defer sim.Close()
+
+	ctx := context.Background()
+	wgOpts := ProbeOptions{WireGuard: WireGuardOptions{Identity: WireGuardIdentity{PeerPublic: sim.PeerPublic}}}
+
+	sample, err := ProbeWireGuardHandshake(ctx, simEndpoint(t, sim.Edges[0]), time.Second, wgOpts)
+	if err != nil {
+		t.Fatalf("wireguard respond: %v", err)
+	}
+	if sample.Latency < 20*time.Millisecond {
+		t.Fatalf("simulated latency not applied: %v", sample.Latency)
+	}
+
+	sample, err = ProbeWireGuardHandshake(ctx, simEndpoint(t, sim.Edges[1]), time.Second, wgOpts)
+	if err != nil || !sample.UnderLoad {
+		t.Fatalf("wireguard cookie: sample=%+v err=%v", sample, err)
+	}
+
+	if _, err := ProbeWireGuardHandshake(ctx, simEndpoint(t, sim.Edges[2]), time.Second, wgOpts); err == nil {
+		t.Fatal("forged response accepted")
+	}
+	if _, err := ProbeWireGuardHandshake(ctx, simEndpoint(t, sim.Edges[3]), 200*time.Millisecond, wgOpts); err == nil {
+		t.Fatal("lossy edge answered")
+	}
+
+	// 模拟 MASQUE 节点：ServerHello 后要求客户端证书，RTT 与证书仍然有效
+	sample, err = ProbeQUICHandshake(ctx, simEndpoint(t, sim.Edges[4]), time.Second, ProbeOptions{})
+	if sample.Latency <= 0 || sample.Cert == nil {
+		t.Fatalf("quic cert-required: sample=%+v err=%v", sample, err)
+	}
+
+	if sample, err := ProbeHTTPSHandshake(ctx, simEndpoint(t, sim.Edges[5]), time.Second, ProbeOptions{}); err != nil || sample.Latency <= 0 {
+		t.Fatalf("https respond: sample=%+v err=%v", sample, err)
+	}
+	if _, err := ProbeHTTPSHandshake(ctx, simEndpoint(t, sim.Edges[6]), time.Second, ProbeOptions{}); err == nil {
+		t.Fatal("reset edge completed tls handshake")
+	}
+
+	// 模拟边缘同样应答隧道内 ICMP echo
+	clientKey, _ := randomKey(t)
+	dataOpts := wgOpts
+	dataOpts.WireGuard.Identity.PrivateKey = &clientKey
+	dataOpts.WireGuard.Identity.Addresses = []netip.Addr{netip.MustParseAddr("172.16.0.2")}
+	tunnel, err := ProbeWireGuardDataPlane(ctx, simEndpoint(t, sim.Edges[0]), netip.MustParseAddr("1.1.1.1"), 2, time.Second, dataOpts)
+	if err != nil || tunnel.Received != 2 {
+		t.Fatalf("in-tunnel echo: result=%+v err=%v", tunnel, err)
+	}
+}
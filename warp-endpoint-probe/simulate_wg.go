@@ -0,0 +1,290 @@
+package main
+
+// 模拟 WARP edge 的 WireGuard 响应方：按 Noise IK 处理 initiation，
+// 支持负载状态下的 Cookie Reply，并在隧道内应答 ICMP echo，供离线测试完整链路。
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+)
+
+// WireGuard 边缘的行为模式。
+const (
+	simModeRespond = "respond" // 正常握手
+	simModeCookie  = "cookie"  // 先回 Cookie Reply，带 MAC2 重试后再握手
+	simModeForge   = "forge"   // 回一个无法通过 Noise 校验的 type=2 报文
+	simModeDrop    = "drop"    // 静默丢弃
+)
+
+type simSession struct {
+	initiatorIndex uint32
+	// initiator 为 initiation 中解出的发起方 static 公钥
+	initiator  [32]byte
+	send, recv [32]byte
+	counter    uint64
+}
+
+type simWireGuard struct {
+	edge   SimEdge
+	conn   net.PacketConn
+	priv   [32]byte
+	pub    [32]byte
+	secret [32]byte
+	// psk 为 preshared key，模拟边缘与 Cloudflare 一样不使用 (全 0)
+	psk [32]byte
+
+	mu       sync.Mutex
+	sessions map[uint32]*simSession
+}
+
+func newSimWireGuard(edge SimEdge, conn net.PacketConn, priv [32]byte) (*simWireGuard, error) {
+	wg := &simWireGuard{edge: edge, conn: conn, priv: priv, sessions: make(map[uint32]*simSession)}
+	curve25519.ScalarBaseMult(&wg.pub, &wg.priv)
+	if _, err := rand.Read(wg.secret[:]); err != nil {
+		return nil, err
+	}
+	return wg, nil
+}
+
+func (wg *simWireGuard) serve() {
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := wg.conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		if reply := wg.handle(buf[:n], from); reply != nil {
+			_, _ = wg.conn.WriteTo(reply, from)
+		}
+	}
+}
+
+// handle 返回应答报文，nil 表示不应答。
+func (wg *simWireGuard) handle(packet []byte, from net.Addr) []byte {
+	switch wgMessageType(packet) {
+	case wgMessageTypeHandshakeInitiation:
+		if len(packet) != wgHandshakeInitiationSize {
+			return nil
+		}
+		// bytes 1-3 可能带 client ID，MAC 按 0 计算
+		zeroed := wgZeroReserved(packet)
+		mac1Key := blake2sHash([]byte(wgLabelMAC1), wg.pub[:])
+		if mac1 := blake2s128(mac1Key[:], zeroed[:116]); !hmac.Equal(mac1[:], packet[116:132]) {
+			return nil
+		}
+		switch wg.edge.Mode {
+		case simModeDrop:
+			return nil
+		case simModeForge:
+			return wg.forgedResponse(packet)
+		case simModeCookie:
+			cookie := wg.cookie(from)
+			if mac2 := blake2s128(cookie[:], zeroed[:132]); !hmac.Equal(mac2[:], packet[132:148]) {
+				reply, _ := wg.cookieReply(packet, cookie)
+				return reply
+			}
+		}
+		reply, _ := wg.respond(packet)
+		return reply
+	case wgMessageTypeTransportData:
+		return wg.echo(packet)
+	default:
+		return nil
+	}
+}
+
+// respond 按 Noise IK 校验 initiation 并生成 92 字节的 Handshake Response。
+func (wg *simWireGuard) respond(initiation []byte) ([]byte, error) {
+	constructionHash := blake2sHash([]byte(noiseConstruction))
+	ck := constructionHash
+	h := blake2sHash(constructionHash[:], []byte(wgIdentifier))
+	h = blake2sHash(h[:], wg.pub[:])
+
+	initEph := initiation[8:40]
+	h = blake2sHash(h[:], initEph)
+	ck, _ = hkdf2(ck[:], initEph)
+
+	ss, err := curve25519.X25519(wg.priv[:], initEph)
+	if err != nil {
+		return nil, err
+	}
+	ck, k := hkdf2(ck[:], ss)
+	aead, _ := chacha20poly1305.New(k[:])
+	var nonce [12]byte
+	initStatic, err := aead.Open(nil, nonce[:], initiation[40:88], h[:])
+	if err != nil {
+		return nil, fmt.Errorf("decrypt initiator static: %w", err)
+	}
+	h = blake2sHash(h[:], initiation[40:88])
+
+	ss, err = curve25519.X25519(wg.priv[:], initStatic)
+	if err != nil {
+		return nil, err
+	}
+	ck, k = hkdf2(ck[:], ss)
+	aead, _ = chacha20poly1305.New(k[:])
+	if _, err := aead.Open(nil, nonce[:], initiation[88:116], h[:]); err != nil {
+		return nil, fmt.Errorf("decrypt initiator timestamp: %w", err)
+	}
+	h = blake2sHash(h[:], initiation[88:116])
+
+	var ephPriv, ephPub [32]byte
+	if _, err := rand.Read(ephPriv[:]); err != nil {
+		return nil, err
+	}
+	curve25519.ScalarBaseMult(&ephPub, &ephPriv)
+
+	msg := make([]byte, wgHandshakeResponseSize)
+	msg[0] = wgMessageTypeHandshakeResponse
+	if _, err := rand.Read(msg[4:8]); err != nil {
+		return nil, err
+	}
+	copy(msg[8:12], initiation[4:8])
+	copy(msg[12:44], ephPub[:])
+	h = blake2sHash(h[:], ephPub[:])
+	ck, _ = hkdf2(ck[:], ephPub[:])
+	ss, _ = curve25519.X25519(ephPriv[:], initEph)
+	ck, _ = hkdf2(ck[:], ss)
+	ss, _ = curve25519.X25519(ephPriv[:], initStatic)
+	ck, _ = hkdf2(ck[:], ss)
+	ck, tau, k := hkdf3(ck[:], wg.psk[:])
+	h = blake2sHash(h[:], tau[:])
+	aead, _ = chacha20poly1305.New(k[:])
+	copy(msg[44:60], aead.Seal(nil, nonce[:], nil, h[:]))
+
+	respMAC1Key := blake2sHash([]byte(wgLabelMAC1), initStatic)
+	mac1 := blake2s128(respMAC1Key[:], msg[:60])
+	copy(msg[60:76], mac1[:])
+
+	// 响应方: T_recv, T_send = KDF2(ck, empty)
+	session := &simSession{initiatorIndex: binary.LittleEndian.Uint32(initiation[4:8])}
+	copy(session.initiator[:], initStatic)
+	session.recv, session.send = hkdf2(ck[:], nil)
+	wg.mu.Lock()
+	wg.sessions[binary.LittleEndian.Uint32(msg[4:8])] = session
+	wg.mu.Unlock()
+	return msg, nil
+}
+
+// forgedResponse 构造 receiver index 正确但内容随机的响应，模拟中间设备伪造。
+func (wg *simWireGuard) forgedResponse(initiation []byte) []byte {
+	msg := make([]byte, wgHandshakeResponseSize)
+	_, _ = rand.Read(msg)
+	msg[0], msg[1], msg[2], msg[3] = wgMessageTypeHandshakeResponse, 0, 0, 0
+	copy(msg[8:12], initiation[4:8])
+	return msg
+}
+
+// cookie 以源地址计算 cookie，与 WireGuard 的 cookie 绑定源 IP:port 一致。
+func (wg *simWireGuard) cookie(from net.Addr) [16]byte {
+	return blake2s128(wg.secret[:], []byte(from.String()))
+}
+
+func (wg *simWireGuard) cookieReply(initiation []byte, cookie [16]byte) ([]byte, error) {
+	msg := make([]byte, wgCookieReplySize)
+	msg[0] = wgMessageTypeCookieReply
+	copy(msg[4:8], initiation[4:8])
+	if _, err := rand.Read(msg[8:32]); err != nil {
+		return nil, err
+	}
+	key := blake2sHash([]byte(wgLabelCookie), wg.pub[:])
+	aead, err := chacha20poly1305.NewX(key[:])
+	if err != nil {
+		return nil, err
+	}
+	copy(msg[32:64], aead.Seal(nil, msg[8:32], cookie[:], initiation[116:132]))
+	return msg, nil
+}
+
+// echo 解密 Transport Data，对其中的 ICMP / ICMPv6 echo request 加密回复 echo reply。
+func (wg *simWireGuard) echo(msg []byte) []byte {
+	if len(msg) < wgTransportHeaderSize+chacha20poly1305.Overhead {
+		return nil
+	}
+	wg.mu.Lock()
+	session, ok := wg.sessions[binary.LittleEndian.Uint32(msg[4:8])]
+	wg.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	recv, _ := chacha20poly1305.New(session.recv[:])
+	var nonce [12]byte
+	copy(nonce[4:], msg[8:16])
+	inner, err := recv.Open(nil, nonce[:], msg[wgTransportHeaderSize:], nil)
+	if err != nil {
+		return nil
+	}
+	reply := echoReplyFor(inner)
+	if reply == nil {
+		return nil
+	}
+	reply = append(reply, make([]byte, (16-len(reply)%16)%16)...)
+
+	wg.mu.Lock()
+	counter := session.counter
+	session.counter++
+	wg.mu.Unlock()
+
+	out := make([]byte, wgTransportHeaderSize, wgTransportHeaderSize+len(reply)+chacha20poly1305.Overhead)
+	out[0] = wgMessageTypeTransportData
+	binary.LittleEndian.PutUint32(out[4:8], session.initiatorIndex)
+	binary.LittleEndian.PutUint64(out[8:16], counter)
+	binary.LittleEndian.PutUint64(nonce[4:], counter)
+	send, _ := chacha20poly1305.New(session.send[:])
+	return send.Seal(out, nonce[:], reply, nil)
+}
+
+// echoReplyFor 为 echo request 构造 echo reply，非 echo request 或校验和错误时返回 nil。
+func echoReplyFor(packet []byte) []byte {
+	var src, dst netip.Addr
+	var icmp []byte
+	var proto uint8
+	switch {
+	case len(packet) >= 28 && packet[0]>>4 == 4:
+		headerLen := int(packet[0]&0x0f) * 4
+		total := int(binary.BigEndian.Uint16(packet[2:4]))
+		if headerLen < 20 || total > len(packet) || total < headerLen+8 || packet[9] != ipProtoICMP || packet[headerLen] != 8 ||
+			internetChecksum(0, packet[:headerLen]) != 0 || internetChecksum(0, packet[headerLen:total]) != 0 {
+			return nil
+		}
+		src, _ = netip.AddrFromSlice(packet[12:16])
+		dst, _ = netip.AddrFromSlice(packet[16:20])
+		icmp, proto = append([]byte(nil), packet[headerLen:total]...), ipProtoICMP
+		icmp[0] = 0
+	case len(packet) >= 48 && packet[0]>>4 == 6:
+		total := 40 + int(binary.BigEndian.Uint16(packet[4:6]))
+		if total > len(packet) || packet[6] != ipProtoICMPv6 || packet[40] != 128 {
+			return nil
+		}
+		src, _ = netip.AddrFromSlice(packet[8:24])
+		dst, _ = netip.AddrFromSlice(packet[24:40])
+		if transportChecksum(src, dst, ipProtoICMPv6, packet[40:total]) != 0 {
+			return nil
+		}
+		icmp, proto = append([]byte(nil), packet[40:total]...), ipProtoICMPv6
+		icmp[0] = 129
+	default:
+		return nil
+	}
+
+	icmp[2], icmp[3] = 0, 0
+	if proto == ipProtoICMPv6 {
+		binary.BigEndian.PutUint16(icmp[2:4], transportChecksum(dst, src, proto, icmp))
+	} else {
+		binary.BigEndian.PutUint16(icmp[2:4], internetChecksum(0, icmp))
+	}
+	return buildIPPacket(dst, src, proto, 0, icmp)
+}
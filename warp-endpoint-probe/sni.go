@@ -0,0 +1,213 @@
+package main
+
+// SNI 矩阵：对同一 endpoint 依次用多个 SNI 握手，按结果区分 ServerHello、超时与重置，
+// 用于判断网络是否按 SNI 阻断以及应固定使用哪个 SNI。
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	utls "github.com/refraction-networking/utls"
+)
+
+// sniMatrixTopN 为做 SNI 矩阵探测的候选数量。
+const sniMatrixTopN = 5
+
+// MasqueSNIs 为 warp-svc 二进制中硬编码的 4 个 MASQUE 域名，
+// 见 docs/masque_api_analysis_report.md。
+var MasqueSNIs = []string{
+	"zt-masque.cloudflareclient.com",
+	"zt-masque-proxy.cloudflareclient.com",
+	"consumer-masque.cloudflareclient.com",
+	"consumer-masque-proxy.cloudflareclient.com",
+}
+
+// 单个 SNI 的握手结果。
+const (
+	SNIServerHello = "server-hello" // 收到 ServerHello (之后被拒绝也算)
+	SNIAlert       = "alert"        // 服务端在 ServerHello 之前以 TLS alert / CONNECTION_CLOSE 拒绝
+	SNITimeout     = "timeout"      // 无任何回应
+	SNIReset       = "reset"        // TCP RST、ICMP 不可达或 QUIC stateless reset
+	SNIECHRejected = "ech-rejected" // 配置了 ECH，服务端以 public_name 完成外层握手，拒绝 ECH
+)
+
+// ParseSNIList 解析 -sni-matrix：`masque` 为 MasqueSNIs，否则为逗号分隔的域名列表；
+// 不含 "." 的短名补全为 <name>.cloudflareclient.com。
+func ParseSNIList(value string) ([]string, error) {
+	if strings.TrimSpace(value) == "masque" {
+		return MasqueSNIs, nil
+	}
+	var snis []string
+	for _, sni := range strings.Split(value, ",") {
+		sni = strings.TrimSpace(sni)
+		if sni == "" {
+			continue
+		}
+		if !strings.Contains(sni, ".") {
+			sni += ".cloudflareclient.com"
+		}
+		snis = append(snis, sni)
+	}
+	if len(snis) == 0 {
+		return nil, fmt.Errorf("invalid sni list %q: no names", value)
+	}
+	return snis, nil
+}
+
+// SNIResult is the outcome of one handshake with a given SNI.
+type SNIResult struct {
+	SNI     string
+	Outcome string
+	Latency time.Duration
+	Err     error
+}
+
+func (result SNIResult) String() string {
+	name := strings.TrimSuffix(result.SNI, ".cloudflareclient.com")
+	if result.answered() {
+		return fmt.Sprintf("%s=%s(%dms)", name, result.Outcome, result.Latency.Milliseconds())
+	}
+	return name + "=" + result.Outcome
+}
+
+// answered 报告服务端是否有回应 (ServerHello、alert 或拒绝 ECH 的外层握手)。
+func (result SNIResult) answered() bool {
+	return result.Outcome == SNIServerHello || result.Outcome == SNIAlert || result.Outcome == SNIECHRejected
+}
+
+// SNIMatrix holds the per-SNI outcomes of one endpoint.
+type SNIMatrix struct {
+	Endpoint string
+	Results  []SNIResult
+}
+
+// CheckSNIMatrix 对每个候选依次以 snis 中的每个 SNI 握手一次。
+func CheckSNIMatrix(ctx context.Context, candidates []Endpoint, snis []string, timeout time.Duration, opts ProbeOptions) []SNIMatrix {
+	matrices := make([]SNIMatrix, 0, len(candidates))
+	for _, endpoint := range candidates {
+		matrix := SNIMatrix{Endpoint: endpoint.Address()}
+		for _, sni := range snis {
+			matrix.Results = append(matrix.Results, ProbeSNI(ctx, endpoint, sni, timeout, opts))
+		}
+		matrices = append(matrices, matrix)
+	}
+	return matrices
+}
+
+// ProbeSNI 以指定 SNI 对 endpoint 握手并归类结果，支持 QUIC、HTTPS 与 H2Tunnel 探测。
+func ProbeSNI(ctx context.Context, endpoint Endpoint, sni string, timeout time.Duration, opts ProbeOptions) SNIResult {
+	endpoint.SNI = sni
+	result := SNIResult{SNI: sni}
+	switch endpoint.Probe {
+	case ProbeQUIC:
+		sample, err := ProbeQUICHandshake(ctx, endpoint, timeout, opts)
+		result.Err = err
+		switch {
+		case errors.Is(err, errECHRejected):
+			result.Outcome, result.Latency = SNIECHRejected, sample.Latency
+		case sample.QUIC != nil && (err == nil || sample.QUIC.Handshake > 0):
+			// 服务端 Handshake 包在 ServerHello 之后才会出现
+			result.Outcome, result.Latency = SNIServerHello, sample.Latency
+		case sample.QUIC != nil:
+			result.Outcome, result.Latency = SNIAlert, sample.Latency
+		default:
+			result.Outcome = classifyNoAnswer(err)
+		}
+	case ProbeHTTPS, ProbeH2:
+		result.Outcome, result.Latency, result.Err = probeHTTPSServerHello(ctx, endpoint, timeout, opts)
+	default:
+		result.Outcome, result.Err = SNITimeout, fmt.Errorf("%w: %s", ErrUnsupportedProbe, endpoint.Probe)
+	}
+	return result
+}
+
+// probeHTTPSServerHello 与 ProbeHTTPSHandshake 使用相同的 uTLS 指纹，
+// 但按首个服务端记录区分 ServerHello 之后被拒绝、ServerHello 之前的 alert、连接重置与超时，
+// 而不是把握手失败一概计为有效 RTT。
+func probeHTTPSServerHello(ctx context.Context, endpoint Endpoint, timeout time.Duration, opts ProbeOptions) (string, time.Duration, error) {
+	if timeout <= 0 {
+		timeout = 2 * time.Second
+	}
+	probeCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	dialer := &net.Dialer{Timeout: timeout}
+	tcpConn, err := dialTCPCaptured(func() (net.Conn, error) {
+		return dialer.DialContext(probeCtx, "tcp", endpoint.Address())
+	}, opts.Capture, endpoint)
+	if err != nil {
+		return classifyNoAnswer(err), 0, err
+	}
+	phases := &tlsPhaseConn{Conn: tcpConn}
+	defer phases.Close()
+
+	ech := &echRejection{}
+	config := &utls.Config{ServerName: endpoint.SNI, InsecureSkipVerify: true}
+	ech.applyUTLS(config, opts.ECH)
+	uConn, err := newUClient(phases, config, opts.Fingerprint, opts.KeyShare)
+	if err != nil {
+		return SNITimeout, 0, err
+	}
+	start := time.Now()
+	err = uConn.HandshakeContext(probeCtx)
+	latency := time.Since(start)
+	switch {
+	case err == nil:
+		return SNIServerHello, latency, nil
+	case ech.rejected.Load():
+		return SNIECHRejected, latency, err
+	case phases.firstRecord() == tlsRecordHandshake:
+		// ServerHello 之后才失败 (缺客户端证书、证书校验等)，SNI 已被接受
+		return SNIServerHello, latency, err
+	case phases.firstRecord() != 0:
+		// 首个记录即 alert (或不是 TLS)：服务端在 ServerHello 之前拒绝
+		return SNIAlert, latency, err
+	case isResetError(err) || errors.Is(err, io.EOF):
+		return SNIReset, 0, err
+	default:
+		return SNITimeout, 0, err
+	}
+}
+
+// classifyNoAnswer 区分未收到任何服务端报文时的重置与超时。
+func classifyNoAnswer(err error) string {
+	if isResetError(err) {
+		return SNIReset
+	}
+	return SNITimeout
+}
+
+func isResetError(err error) bool {
+	var statelessReset *quic.StatelessResetError
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.As(err, &statelessReset)
+}
+
+func isTimeoutError(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
+}
+
+// PrintSNIMatrix 每个 endpoint 输出一行，最后按 SNI 汇总收到 ServerHello 的比例。
+func PrintSNIMatrix(w io.Writer, snis []string, matrices []SNIMatrix) {
+	serverHellos := make(map[string]int, len(snis))
+	for _, matrix := range matrices {
+		cells := make([]string, 0, len(matrix.Results))
+		for _, result := range matrix.Results {
+			cells = append(cells, result.String())
+			if result.Outcome == SNIServerHello {
+				serverHellos[result.SNI]++
+			}
+		}
+		fmt.Fprintf(w, "SNI: %s %s\n", matrix.Endpoint, strings.Join(cells, " "))
+	}
+	for _, sni := range snis {
+		fmt.Fprintf(w, "SNI summary: %s server-hello=%d/%d\n", sni, serverHellos[sni], len(matrices))
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSNIList(t *testing.T) {
+	testCases := []struct {
+		name    string
+		value   string
+		want    []string
+		wantErr bool
+	}{
+		{name: "masque", value: "masque", want: MasqueSNIs},
+		{name: "short_names", value: "zt-masque, consumer-masque-proxy", want: []string{
+			"zt-masque.cloudflareclient.com", "consumer-masque-proxy.cloudflareclient.com"}},
+		{name: "full_names", value: "example.com,,api.cloudflareclient.com", want: []string{
+			"example.com", "api.cloudflareclient.com"}},
+		{name: "empty", value: " , ", wantErr: true},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			actual, err := ParseSNIList(testCase.value)
+			if testCase.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got %v", actual)
+				}
+				return
+			}
+			if err != nil || !reflect.DeepEqual(actual, testCase.want) {
+				t.Fatalf("unexpected result: got=%v err=%v want=%v", actual, err, testCase.want)
+			}
+		})
+	}
+}
+
+func TestProbeSNI(t *testing.T) {
+	var edges []SimEdge
+	for _, spec := range []string{
+		"quic@127.0.0.1:0,mode=accept",
+		"quic@127.0.0.1:0",
+		"quic@127.0.0.1:0,mode=drop",
+		"https@127.0.0.1:0",
+		"https@127.0.0.1:0,mode=reset",
+		"https@127.0.0.1:0,mode=stall",
+	} {
+		edge, err := ParseSimEdge(spec, SimEdge{})
+		if err != nil {
+			t.Fatalf("parse %s: %v", spec, err)
+		}
+		edges = append(edges, edge)
+	}
+	var wgKey [32]byte
+	sim, err := StartSimulator(edges, wgKey)
+	if err != nil {
+		t.Fatalf("start simulator: %v", err)
+	}
+	defer sim.Close()
+
+	// TLS 1.2 下服务端在 ServerHello 之后、客户端 Finished 之前以 alert 拒绝缺证书的客户端
+	cert, err := simCertificate()
+	if err != nil {
+		t.Fatalf("certificate: %v", err)
+	}
+	clientCert, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MaxVersion:   tls.VersionTLS12,
+		ClientAuth:   tls.RequireAnyClientCert,
+	})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer clientCert.Close()
+	// 只回一个 handshake_failure alert 记录，不发 ServerHello
+	alertOnly, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer alertOnly.Close()
+	for _, listener := range []net.Listener{clientCert, alertOnly} {
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer conn.Close()
+					if listener == alertOnly {
+						_, _ = conn.Read(make([]byte, 4096))
+						_, _ = conn.Write([]byte{0x15, 0x03, 0x03, 0x00, 0x02, 0x02, 0x28})
+						return
+					}
+					_ = conn.(*tls.Conn).Handshake()
+				}()
+			}
+		}()
+	}
+
+	closed, _ := net.Listen("tcp", "127.0.0.1:0")
+	closedEndpoint := simEndpoint(t, SimEdge{Probe: ProbeHTTPS, Address: closed.Addr().String()})
+	_ = closed.Close()
+
+	testCases := []struct {
+		name     string
+		endpoint Endpoint
+		want     string
+	}{
+		{name: "quic_accept", endpoint: simEndpoint(t, sim.Edges[0]), want: SNIServerHello},
+		{name: "quic_cert_required", endpoint: simEndpoint(t, sim.Edges[1]), want: SNIServerHello},
+		{name: "quic_drop", endpoint: simEndpoint(t, sim.Edges[2]), want: SNITimeout},
+		{name: "https_respond", endpoint: simEndpoint(t, sim.Edges[3]), want: SNIServerHello},
+		{name: "https_reset", endpoint: simEndpoint(t, sim.Edges[4]), want: SNIReset},
+		{name: "https_stall", endpoint: simEndpoint(t, sim.Edges[5]), want: SNITimeout},
+		{name: "https_closed_port", endpoint: closedEndpoint, want: SNIReset},
+		{name: "https_alert_after_server_hello", endpoint: simEndpoint(t, SimEdge{Probe: ProbeHTTPS, Address: clientCert.Addr().String()}), want: SNIServerHello},
+		{name: "https_alert_only", endpoint: simEndpoint(t, SimEdge{Probe: ProbeHTTPS, Address: alertOnly.Addr().String()}), want: SNIAlert},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			result := ProbeSNI(context.Background(), testCase.endpoint, MasqueSNIs[0], 300*time.Millisecond, ProbeOptions{})
+			if result.Outcome != testCase.want {
+				t.Fatalf("unexpected outcome: got=%s want=%s err=%v", result.Outcome, testCase.want, result.Err)
+			}
+			if (result.Outcome == SNIServerHello || result.Outcome == SNIAlert) && result.Latency <= 0 {
+				t.Fatalf("missing latency: %+v", result)
+			}
+		})
+	}
+}
+
+func TestPrintSNIMatrix(t *testing.T) {
+	snis := MasqueSNIs[:2]
+	matrices := []SNIMatrix{
+		{Endpoint: "a", Results: []SNIResult{
+			{SNI: snis[0], Outcome: SNIServerHello, Latency: 30 * time.Millisecond},
+			{SNI: snis[1], Outcome: SNIReset},
+		}},
+		{Endpoint: "b", Results: []SNIResult{
+			{SNI: snis[0], Outcome: SNIServerHello, Latency: 40 * time.Millisecond},
+			{SNI: snis[1], Outcome: SNITimeout},
+		}},
+	}
+	var out bytes.Buffer
+	PrintSNIMatrix(&out, snis, matrices)
+	for _, want := range []string{
+		"SNI: a zt-masque=server-hello(30ms) zt-masque-proxy=reset\n",
+		"SNI summary: zt-masque.cloudflareclient.com server-hello=2/2\n",
+		"SNI summary: zt-masque-proxy.cloudflareclient.com server-hello=0/2\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Fatalf("missing %q in:\n%s", want, out.String())
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SourcePortMode 决定 WireGuard 探测使用哪个本地 UDP 源端口。
+type SourcePortMode string
+
+const (
+	SourcePortRandom SourcePortMode = "random"
+	SourcePortFixed  SourcePortMode = "fixed"
+	SourcePortRange  SourcePortMode = "range"
+)
+
+// maxSourcePortRange 限制 range 模式下同时打开的 socket 数量。
+const maxSourcePortRange = 1024
+
+var errSourcePortClosed = errors.New("source port socket closed")
+
+// SourcePortPolicy describes how WireGuard probes pick their local UDP port.
+type SourcePortPolicy struct {
+	Mode SourcePortMode
+	Low  int
+	High int
+}
+
+func (policy SourcePortPolicy) String() string {
+	switch policy.Mode {
+	case SourcePortFixed:
+		return strconv.Itoa(policy.Low)
+	case SourcePortRange:
+		return fmt.Sprintf("%d-%d", policy.Low, policy.High)
+	default:
+		return string(SourcePortRandom)
+	}
+}
+
+// ParseSourcePortPolicy parses "random", "<port>" or "<low>-<high>".
+func ParseSourcePortPolicy(value string) (SourcePortPolicy, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if value == "" || value == string(SourcePortRandom) {
+		return SourcePortPolicy{Mode: SourcePortRandom}, nil
+	}
+
+	if lowStr, highStr, isRange := strings.Cut(value, "-"); isRange {
+		low, err := parsePort(lowStr)
+		if err != nil {
+			return SourcePortPolicy{}, err
+		}
+		high, err := parsePort(highStr)
+		if err != nil {
+			return SourcePortPolicy{}, err
+		}
+		if low > high {
+			return SourcePortPolicy{}, fmt.Errorf("invalid source port range %q: low > high", value)
+		}
+		if high-low+1 > maxSourcePortRange {
+			return SourcePortPolicy{}, fmt.Errorf("source port range %q exceeds %d ports", value, maxSourcePortRange)
+		}
+		if low == high {
+			return SourcePortPolicy{Mode: SourcePortFixed, Low: low, High: high}, nil
+		}
+		return SourcePortPolicy{Mode: SourcePortRange, Low: low, High: high}, nil
+	}
+
+	port, err := parsePort(value)
+	if err != nil {
+		return SourcePortPolicy{}, err
+	}
+	return SourcePortPolicy{Mode: SourcePortFixed, Low: port, High: port}, nil
+}
+
+func parsePort(value string) (int, error) {
+	port, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil || port <= 0 || port > 65535 {
+		return 0, fmt.Errorf("invalid source port %q", value)
+	}
+	return port, nil
+}
+
+// SourcePortPool 持有固定端口 / 端口段对应的长连接 UDP socket，
+// 所有探测共用这些 socket，与 warp-svc 的单 socket 行为一致。
+// random 模式下为 nil，每次探测各自拨号。
+type SourcePortPool struct {
+	sockets []*wgSocket
+	next    atomic.Uint32
+}
+
+// OpenSourcePortPool binds the sockets required by policy.
+// It returns nil for the random policy.
+func OpenSourcePortPool(policy SourcePortPolicy) (*SourcePortPool, error) {
+	if policy.Mode == SourcePortRandom || policy.Mode == "" {
+		return nil, nil
+	}
+
+	pool := &SourcePortPool{}
+	for port := policy.Low; port <= policy.High; port++ {
+		socket, err := listenWGSocket(port)
+		if err != nil {
+			pool.Close()
+			return nil, err
+		}
+		pool.sockets = append(pool.sockets, socket)
+	}
+	return pool, nil
+}
+
+// Close releases all sockets in the pool.
+func (pool *SourcePortPool) Close() {
+	if pool == nil {
+		return
+	}
+	for _, socket := range pool.sockets {
+		socket.Close()
+	}
+}
+
+// pick 轮询返回下一个 socket。
+func (pool *SourcePortPool) pick() *wgSocket {
+	i := pool.next.Add(1) - 1
+	return pool.sockets[int(i)%len(pool.sockets)]
+}
+
+type wgPacket struct {
+	data []byte
+	from *net.UDPAddr
+}
+
+// wgSocket 是一个共享 UDP socket，按 WireGuard receiver index
+// 将回包分发给对应的探测。
+type wgSocket struct {
+	conn    *net.UDPConn
+	mu      sync.Mutex
+	waiters map[uint32]chan wgPacket
+	done    chan struct{}
+}
+
+func listenWGSocket(port int) (*wgSocket, error) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: port})
+	if err != nil {
+		return nil, fmt.Errorf("listen udp source port %d: %w", port, err)
+	}
+	socket := &wgSocket{
+		conn:    conn,
+		waiters: make(map[uint32]chan wgPacket),
+		done:    make(chan struct{}),
+	}
+	go socket.readLoop()
+	return socket, nil
+}
+
+func (socket *wgSocket) LocalPort() int {
+	return socket.conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+func (socket *wgSocket) Close() {
+	_ = socket.conn.Close()
+	<-socket.done
+}
+
+func (socket *wgSocket) readLoop() {
+	defer close(socket.done)
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := socket.conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		index, ok := wgReceiverIndex(buf[:n])
+		if !ok {
+			continue
+		}
+
+		socket.mu.Lock()
+		waiter, exists := socket.waiters[index]
+		socket.mu.Unlock()
+		if !exists {
+			continue
+		}
+
+		data := make([]byte, n)
+		copy(data, buf[:n])
+		select {
+		case waiter <- wgPacket{data: data, from: from}:
+		default:
+		}
+	}
+}
+
+// exchange 发送 packet 并等待 receiver index 等于 senderIndex 且被 accept 接受的回包
+// (accept 为 nil 时接受任意回包)。返回回包内容及发送到收到之间的耗时。
+func (socket *wgSocket) exchange(ctx context.Context, addr *net.UDPAddr, packet []byte, senderIndex uint32, accept func([]byte) bool) ([]byte, time.Duration, error) {
+	waiter := make(chan wgPacket, 4)
+	socket.mu.Lock()
+	socket.waiters[senderIndex] = waiter
+	socket.mu.Unlock()
+	defer func() {
+		socket.mu.Lock()
+		delete(socket.waiters, senderIndex)
+		socket.mu.Unlock()
+	}()
+
+	start := time.Now()
+	if _, err := socket.conn.WriteToUDP(packet, addr); err != nil {
+		return nil, 0, err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, 0, ctx.Err()
+		case <-socket.done:
+			return nil, 0, errSourcePortClosed
+		case reply := <-waiter:
+			if !reply.from.IP.Equal(addr.IP) || reply.from.Port != addr.Port {
+				continue
+			}
+			if accept != nil && !accept(reply.data) {
+				continue
+			}
+			return reply.data, time.Since(start), nil
+		}
+	}
+}
+
+// wgReceiverIndex 取出 WireGuard 回包中的 receiver index。
+func wgReceiverIndex(packet []byte) (uint32, bool) {
+	if len(packet) < 12 {
+		return 0, false
+	}
+	switch packet[0] {
+	case wgMessageTypeHandshakeResponse:
+		return binary.LittleEndian.Uint32(packet[8:12]), true
+	case wgMessageTypeCookieReply, wgMessageTypeTransportData:
+		return binary.LittleEndian.Uint32(packet[4:8]), true
+	default:
+		return 0, false
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseSourcePortPolicy(t *testing.T) {
+	testCases := []struct {
+		name     string
+		value    string
+		expected SourcePortPolicy
+		wantErr  bool
+	}{
+		{name: "empty_is_random", value: "", expected: SourcePortPolicy{Mode: SourcePortRandom}},
+		{name: "random", value: "random", expected: SourcePortPolicy{Mode: SourcePortRandom}},
+		{name: "fixed", value: "51820", expected: SourcePortPolicy{Mode: SourcePortFixed, Low: 51820, High: 51820}},
+		{name: "range", value: "40000-40010", expected: SourcePortPolicy{Mode: SourcePortRange, Low: 40000, High: 40010}},
+		{name: "single_port_range", value: "40000-40000", expected: SourcePortPolicy{Mode: SourcePortFixed, Low: 40000, High: 40000}},
+		{name: "reversed_range", value: "40010-40000", wantErr: true},
+		{name: "out_of_range", value: "70000", wantErr: true},
+		{name: "too_wide", value: "1-2000", wantErr: true},
+		{name: "garbage", value: "abc", wantErr: true},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			actual, err := ParseSourcePortPolicy(testCase.value)
+			if testCase.wantErr {
+				if err == nil {
+					t.Fatalf("expected error for %q", testCase.value)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if actual != testCase.expected {
+				t.Fatalf("unexpected policy: got=%+v want=%+v", actual, testCase.expected)
+			}
+		})
+	}
+}
+
+func TestSharedSocketDemux(t *testing.T) {
+	// 本地回显服务：把 initiation 的 sender index 填入 response 的 receiver index
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer server.Close()
+	go func() {
+		buf := make([]byte, 256)
+		for {
+			n, from, err := server.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if n < 8 {
+				continue
+			}
+			reply := make([]byte, wgHandshakeResponseSize)
+			reply[0] = wgMessageTypeHandshakeResponse
+			copy(reply[8:12], buf[4:8])
+			_, _ = server.WriteToUDP(reply, from)
+		}
+	}()
+
+	socket, err := listenWGSocket(0)
+	if err != nil {
+		t.Fatalf("listen source socket: %v", err)
+	}
+	defer socket.Close()
+
+	serverAddr := server.LocalAddr().(*net.UDPAddr)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	for _, index := range []uint32{1, 42, 0xdeadbeef} {
+		packet := make([]byte, wgHandshakeInitiationSize)
+		packet[0] = wgMessageTypeHandshakeInitiation
+		binary.LittleEndian.PutUint32(packet[4:8], index)
+
+		reply, latency, err := socket.exchange(ctx, serverAddr, packet, index, nil)
+		if err != nil {
+			t.Fatalf("exchange index=%d: %v", index, err)
+		}
+		if latency <= 0 {
+			t.Fatalf("non-positive latency for index=%d", index)
+		}
+		if got, _ := wgReceiverIndex(reply); got != index {
+			t.Fatalf("unexpected receiver index: got=%d want=%d", got, index)
+		}
+	}
+}
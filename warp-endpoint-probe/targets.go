@@ -21,6 +21,8 @@ const (
 	ProbeWireGuard ProbeType = "wireguard"
 	ProbeQUIC      ProbeType = "quic"
 	ProbeHTTPS     ProbeType = "https"
+	// ProbeH2 为 warp-svc 的 H2Tunnel 回退路径：TCP/443 上 ALPN h2 + *-masque-proxy SNI。
+	ProbeH2 ProbeType = "h2"
 )
 
 var ErrUnsupportedProbe = errors.New("unsupported probe type")
@@ -70,6 +72,14 @@ var tunnelTargets = map[string]TargetPool{
 		Probe: ProbeQUIC,
 		SNI:   MasqueSNI,
 	},
+	// UDP/443 被封锁时的 H2Tunnel 回退，与 masque 共用地址段
+	"masque-h2": {
+		Name:  "masque-h2",
+		CIDRs: []string{"162.159.197.0/24", "2606:4700:102::/48"},
+		Ports: []int{443},
+		Probe: ProbeH2,
+		SNI:   "zt-masque-proxy.cloudflareclient.com",
+	},
 }
 
 var apiTargets = TargetPool{
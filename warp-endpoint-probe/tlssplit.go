@@ -0,0 +1,173 @@
+package main
+
+// ClientHello 分片：只靠浏览器指纹往往躲不过按 SNI 阻断的 DPI。常见的 DPI 只检查首个 TCP 段或
+// 首个 TLS 记录，把 ClientHello 从 SNI 中间切开即可让其取不到完整的域名：
+//   - tcp: 同一个 TLS 记录分两个 TCP 段发送
+//   - record: 拆成两个 TLS 记录，在同一个 TCP 段中发送
+//   - window: 模拟很小的 TCP 窗口，SNI 之前的部分按 tlsWindowSegment 字节一段发送
+// 服务端按 RFC 8446 §5.1 必须接受分片的握手消息。
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// ClientHello 分片策略。
+const (
+	tlsSplitNone   = "none"
+	tlsSplitTCP    = "tcp"
+	tlsSplitRecord = "record"
+	tlsSplitWindow = "window"
+)
+
+// allTLSSplits 为 -tls-split all 的尝试顺序。
+var allTLSSplits = []string{tlsSplitNone, tlsSplitTCP, tlsSplitRecord, tlsSplitWindow}
+
+const (
+	// tlsSplitDelay 为两次写之间的间隔，避免内核把相邻的写合并成一个段。
+	tlsSplitDelay = 10 * time.Millisecond
+	// tlsWindowSegment / tlsWindowDelay 为 window 策略的段大小与间隔。
+	tlsWindowSegment = 16
+	tlsWindowDelay   = 2 * time.Millisecond
+)
+
+// ParseTLSSplit 解析 -tls-split：逗号分隔的策略按顺序尝试，all 为全部策略。
+func ParseTLSSplit(value string) ([]string, error) {
+	var strategies []string
+	for _, strategy := range strings.Split(value, ",") {
+		strategy = strings.ToLower(strings.TrimSpace(strategy))
+		switch strategy {
+		case "":
+		case "all":
+			strategies = append(strategies, allTLSSplits...)
+		case tlsSplitNone, tlsSplitTCP, tlsSplitRecord, tlsSplitWindow:
+			strategies = append(strategies, strategy)
+		default:
+			return nil, fmt.Errorf("invalid tls split %q: want %s | all", strategy, strings.Join(allTLSSplits, " | "))
+		}
+	}
+	if len(strategies) == 0 {
+		strategies = []string{tlsSplitNone}
+	}
+	return strategies, nil
+}
+
+// splitConn 按策略改写第一次写出的 ClientHello 记录，之后的写原样透传。
+type splitConn struct {
+	net.Conn
+	strategy string
+	done     bool
+}
+
+func (c *splitConn) Write(b []byte) (int, error) {
+	if c.done || c.strategy == tlsSplitNone {
+		return c.Conn.Write(b)
+	}
+	c.done = true
+	chunks := splitClientHello(b, c.strategy)
+	if chunks == nil {
+		return c.Conn.Write(b)
+	}
+	delay := tlsSplitDelay
+	if c.strategy == tlsSplitWindow {
+		delay = tlsWindowDelay
+	}
+	for i, chunk := range chunks {
+		if i > 0 {
+			time.Sleep(delay)
+		}
+		if _, err := c.Conn.Write(chunk); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// splitClientHello 返回依次写出的分片；b 不是单个完整的 ClientHello 记录时返回 nil。
+func splitClientHello(b []byte, strategy string) [][]byte {
+	if len(b) < 5 || b[0] != tlsRecordHandshake || int(binary.BigEndian.Uint16(b[3:5])) != len(b)-5 {
+		return nil
+	}
+	msg := b[5:]
+	offset, length, ok := clientHelloSNI(msg)
+	if !ok {
+		// 没有 SNI 时从握手消息中间切开
+		offset, length = 0, len(msg)
+	}
+	cut := offset + length/2
+
+	switch strategy {
+	case tlsSplitTCP:
+		return [][]byte{b[:5+cut], b[5+cut:]}
+	case tlsSplitRecord:
+		records := make([]byte, 0, len(b)+5)
+		records = appendTLSRecord(records, b[1:3], msg[:cut])
+		records = appendTLSRecord(records, b[1:3], msg[cut:])
+		return [][]byte{records}
+	case tlsSplitWindow:
+		var chunks [][]byte
+		end := 5 + offset + length
+		for start := 0; start < end; start += tlsWindowSegment {
+			chunks = append(chunks, b[start:min(start+tlsWindowSegment, end)])
+		}
+		return append(chunks, b[end:])
+	default:
+		return nil
+	}
+}
+
+func appendTLSRecord(dst, version, payload []byte) []byte {
+	dst = append(dst, tlsRecordHandshake)
+	dst = append(dst, version...)
+	dst = binary.BigEndian.AppendUint16(dst, uint16(len(payload)))
+	return append(dst, payload...)
+}
+
+// clientHelloSNI 在 ClientHello 握手消息 (含 4 字节消息头) 中查找 server_name 扩展，
+// 返回主机名的偏移与长度。msg 可以被截断，只要主机名完整即可。
+func clientHelloSNI(msg []byte) (offset, length int, ok bool) {
+	if len(msg) < 4 || msg[0] != tlsHandshakeClientHello {
+		return 0, 0, false
+	}
+	// 消息头 4 + legacy_version 2 + random 32
+	pos := 4 + 2 + 32
+	skip := func(lengthBytes int) bool {
+		if pos+lengthBytes > len(msg) {
+			return false
+		}
+		n := 0
+		for _, c := range msg[pos : pos+lengthBytes] {
+			n = n<<8 | int(c)
+		}
+		pos += lengthBytes + n
+		return pos <= len(msg)
+	}
+	// session_id、cipher_suites、compression_methods
+	if !skip(1) || !skip(2) || !skip(1) || pos+2 > len(msg) {
+		return 0, 0, false
+	}
+	pos += 2 // extensions 总长度
+	for pos+4 <= len(msg) {
+		extType := binary.BigEndian.Uint16(msg[pos:])
+		extLen := int(binary.BigEndian.Uint16(msg[pos+2:]))
+		pos += 4
+		if extType != 0 { // server_name
+			pos += extLen
+			continue
+		}
+		// server_name_list 长度 2 + name_type 1 + host_name 长度 2
+		if pos+5 > len(msg) || msg[pos+2] != 0 {
+			return 0, 0, false
+		}
+		length = int(binary.BigEndian.Uint16(msg[pos+3:]))
+		offset = pos + 5
+		if offset+length > len(msg) {
+			return 0, 0, false
+		}
+		return offset, length, true
+	}
+	return 0, 0, false
+}
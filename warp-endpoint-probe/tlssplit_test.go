@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+// chromeClientHelloRecord 返回带 TLS 记录头的 Chrome ClientHello。
+func chromeClientHelloRecord(t *testing.T, serverName string) []byte {
+	t.Helper()
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	uConn := utls.UClient(client, &utls.Config{ServerName: serverName}, utls.HelloChrome_Auto)
+	if err := uConn.BuildHandshakeState(); err != nil {
+		t.Fatalf("build client hello: %v", err)
+	}
+	return decodeClientHello(uConn.HandshakeState.Hello.Raw)
+}
+
+func TestParseTLSSplit(t *testing.T) {
+	testCases := []struct {
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{value: "", want: "none"},
+		{value: "none", want: "none"},
+		{value: "TCP, record", want: "tcp,record"},
+		{value: "all", want: "none,tcp,record,window"},
+		{value: "tcp,segment", wantErr: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.value, func(t *testing.T) {
+			strategies, err := ParseTLSSplit(tc.value)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got %v", strategies)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if actual := strings.Join(strategies, ","); actual != tc.want {
+				t.Fatalf("unexpected strategies: got=%s want=%s", actual, tc.want)
+			}
+		})
+	}
+}
+
+func TestSplitClientHello(t *testing.T) {
+	record := chromeClientHelloRecord(t, DefaultSNI)
+	offset, length, ok := clientHelloSNI(record[5:])
+	if !ok || string(record[5+offset:5+offset+length]) != DefaultSNI {
+		t.Fatalf("sni not found: offset=%d length=%d ok=%t", offset, length, ok)
+	}
+	if _, _, ok := clientHelloSNI(record[5 : 5+offset+length-1]); ok {
+		t.Fatal("truncated sni reported as complete")
+	}
+
+	for _, strategy := range []string{tlsSplitTCP, tlsSplitRecord, tlsSplitWindow} {
+		t.Run(strategy, func(t *testing.T) {
+			chunks := splitClientHello(record, strategy)
+			if len(chunks) == 0 || bytes.Contains(chunks[0], []byte(DefaultSNI)) {
+				t.Fatalf("first chunk still carries the full sni: %d chunks", len(chunks))
+			}
+			joined := bytes.Join(chunks, nil)
+			if strategy != tlsSplitRecord {
+				if !bytes.Equal(joined, record) {
+					t.Fatal("segments do not reassemble to the client hello")
+				}
+				return
+			}
+			// 两个记录的载荷拼接后应为原握手消息
+			first := 5 + int(joined[3])<<8 + int(joined[4])
+			payload := append(append([]byte(nil), joined[5:first]...), joined[first+5:]...)
+			if !bytes.Equal(payload, record[5:]) || len(joined) != len(record)+5 {
+				t.Fatal("records do not reassemble to the client hello")
+			}
+		})
+	}
+	if splitClientHello([]byte{0x17, 0x03, 0x03, 0x00, 0x01, 0x00}, tlsSplitTCP) != nil {
+		t.Fatal("split a non-handshake record")
+	}
+}
+
+func TestProbeHTTPSTLSSplit(t *testing.T) {
+	var edges []SimEdge
+	for _, spec := range []string{"https@127.0.0.1:0,dpi=segment", "https@127.0.0.1:0,dpi=stream", "https@127.0.0.1:0"} {
+		edge, err := ParseSimEdge(spec, SimEdge{})
+		if err != nil {
+			t.Fatalf("parse %s: %v", spec, err)
+		}
+		edges = append(edges, edge)
+	}
+	var wgKey [32]byte
+	sim, err := StartSimulator(edges, wgKey)
+	if err != nil {
+		t.Fatalf("start simulator: %v", err)
+	}
+	defer sim.Close()
+
+	testCases := []struct {
+		name      string
+		edge      int
+		split     []string
+		wantTLS   string
+		wantSplit string
+	}{
+		{name: "segment_none", edge: 0, split: []string{tlsSplitNone}, wantTLS: httpsTLSReset},
+		{name: "segment_tcp", edge: 0, split: []string{tlsSplitTCP}, wantTLS: httpsTLSOK, wantSplit: tlsSplitTCP},
+		{name: "segment_record", edge: 0, split: []string{tlsSplitRecord}, wantTLS: httpsTLSReset},
+		{name: "segment_window", edge: 0, split: []string{tlsSplitWindow}, wantTLS: httpsTLSOK, wantSplit: tlsSplitWindow},
+		{name: "stream_tcp", edge: 1, split: []string{tlsSplitTCP}, wantTLS: httpsTLSReset},
+		{name: "stream_record", edge: 1, split: []string{tlsSplitRecord}, wantTLS: httpsTLSOK, wantSplit: tlsSplitRecord},
+		{name: "stream_window", edge: 1, split: []string{tlsSplitWindow}, wantTLS: httpsTLSReset},
+		{name: "segment_all", edge: 0, split: allTLSSplits, wantTLS: httpsTLSOK, wantSplit: tlsSplitTCP},
+		{name: "stream_all", edge: 1, split: allTLSSplits, wantTLS: httpsTLSOK, wantSplit: tlsSplitRecord},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			sample, err := ProbeHTTPSHandshake(context.Background(), simEndpoint(t, sim.Edges[tc.edge]), 500*time.Millisecond, ProbeOptions{TLSSplit: tc.split})
+			timing := sample.HTTPS
+			if timing == nil || timing.TLS != tc.wantTLS || timing.Split != tc.wantSplit {
+				t.Fatalf("unexpected timing: %v (err=%v)", timing, err)
+			}
+			if !timing.DPISuspect() {
+				t.Fatalf("endpoint behind dpi not flagged: %s", timing)
+			}
+		})
+	}
+
+	// 分片之间的等待不计入 ServerHello：ClientHello 以最后一片写出为准
+	sample, err := ProbeHTTPSHandshake(context.Background(), simEndpoint(t, sim.Edges[2]), 500*time.Millisecond, ProbeOptions{TLSSplit: []string{tlsSplitTCP}})
+	if err != nil || sample.HTTPS.ServerHello >= tlsSplitDelay {
+		t.Fatalf("split delay counted as server hello: %v (err=%v)", sample.HTTPS, err)
+	}
+
+	// 分片后握手成功的 endpoint 在 CSV 中标注所用策略
+	result := probeWithRounds(context.Background(), simEndpoint(t, sim.Edges[1]), 500*time.Millisecond, 2, ProbeOptions{TLSSplit: allTLSSplits})
+	if result.Latency <= 0 || !slices.Contains(result.Tags(), "tls-split=record") {
+		t.Fatalf("split strategy not reported: %+v tags=%v", result, result.Tags())
+	}
+}
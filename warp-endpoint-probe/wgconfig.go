@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// WireGuardIdentity 描述 WireGuard 探测使用的对端公钥与本端身份。
+type WireGuardIdentity struct {
+	PeerPublic [32]byte
+	// PrivateKey 为 nil 时每次探测生成一次性的 static key。
+	PrivateKey   *[32]byte
+	PresharedKey [32]byte
+	// Reserved 填入 initiation 的 bytes 1-3，即 WARP 的 client ID；零值为匿名握手。
+	Reserved [3]byte
+	// Addresses 为隧道内本端地址，仅隧道内校验使用。
+	Addresses []netip.Addr
+}
+
+// sourceAddress 返回与 target 同地址族的隧道地址。
+func (identity WireGuardIdentity) sourceAddress(target netip.Addr) (netip.Addr, bool) {
+	return sourceAddressFor(identity.Addresses, target)
+}
+
+// sourceAddressFor 在 addrs 中选出与 target 同地址族的地址。
+func sourceAddressFor(addrs []netip.Addr, target netip.Addr) (netip.Addr, bool) {
+	for _, addr := range addrs {
+		if addr.Is4() == target.Is4() {
+			return addr, true
+		}
+	}
+	return netip.Addr{}, false
+}
+
+// PublicKey returns the initiator static public key, or false when a
+// throwaway key is generated per probe.
+func (identity WireGuardIdentity) PublicKey() ([32]byte, bool) {
+	var pub [32]byte
+	if identity.PrivateKey == nil {
+		return pub, false
+	}
+	curve25519.ScalarBaseMult(&pub, identity.PrivateKey)
+	return pub, true
+}
+
+// WireGuardConfig holds the fields the probe reads from a wg-quick style file.
+type WireGuardConfig struct {
+	PrivateKey   string
+	Addresses    []string
+	PeerPublic   string
+	PresharedKey string
+	Endpoint     string
+}
+
+// LoadWireGuardConfig parses the [Interface] and first [Peer] section of a
+// standard WireGuard configuration file (wg-quick / wgcf-profile.conf).
+func LoadWireGuardConfig(path string) (WireGuardConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return WireGuardConfig{}, err
+	}
+	defer f.Close()
+
+	var (
+		config  WireGuardConfig
+		section string
+		peers   int
+	)
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.ToLower(strings.TrimSpace(line[1 : len(line)-1]))
+			if section == "peer" {
+				peers++
+			}
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return WireGuardConfig{}, fmt.Errorf("%s:%d: expected key = value", path, lineNo)
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+
+		switch {
+		case section == "interface" && key == "privatekey":
+			config.PrivateKey = value
+		case section == "interface" && key == "address":
+			for _, addr := range strings.Split(value, ",") {
+				if addr = strings.TrimSpace(addr); addr != "" {
+					config.Addresses = append(config.Addresses, addr)
+				}
+			}
+		case section == "peer" && peers == 1 && key == "publickey":
+			config.PeerPublic = value
+		case section == "peer" && peers == 1 && key == "presharedkey":
+			config.PresharedKey = value
+		case section == "peer" && peers == 1 && key == "endpoint":
+			config.Endpoint = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return WireGuardConfig{}, err
+	}
+	return config, nil
+}
+
+// ParseWireGuardAddresses parses a comma-separated Address list such as
+// "172.16.0.2/32, 2606:4700:110:8a36::1/128"; prefix lengths are optional.
+func ParseWireGuardAddresses(values []string) ([]netip.Addr, error) {
+	var addrs []netip.Addr
+	for _, value := range values {
+		for _, field := range strings.Split(value, ",") {
+			field = strings.TrimSpace(field)
+			if field == "" {
+				continue
+			}
+			if prefix, err := netip.ParsePrefix(field); err == nil {
+				addrs = append(addrs, prefix.Addr())
+				continue
+			}
+			addr, err := netip.ParseAddr(field)
+			if err != nil {
+				return nil, fmt.Errorf("invalid tunnel address %q", field)
+			}
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs, nil
+}
+
+// ParseWireGuardKey decodes a base64 WireGuard key (as printed by `wg genkey`).
+func ParseWireGuardKey(value string) ([32]byte, error) {
+	var key [32]byte
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+	if err != nil {
+		return key, fmt.Errorf("invalid wireguard key: %w", err)
+	}
+	if len(raw) != len(key) {
+		return key, fmt.Errorf("invalid wireguard key: %d bytes, want 32", len(raw))
+	}
+	copy(key[:], raw)
+	return key, nil
+}
+
+// ResolveWireGuardIdentity 按优先级合并身份来源：显式参数 > 配置文件 > 内置 Cloudflare 公钥。
+// peerKey / privateKey / addresses 为空字符串表示未指定。
+func ResolveWireGuardIdentity(peerKey, privateKey, addresses, configPath string) (WireGuardIdentity, error) {
+	identity := WireGuardIdentity{PeerPublic: cloudflarePublicKey}
+
+	var config WireGuardConfig
+	if configPath != "" {
+		var err error
+		if config, err = LoadWireGuardConfig(configPath); err != nil {
+			return WireGuardIdentity{}, fmt.Errorf("load wireguard config: %w", err)
+		}
+	}
+	if peerKey == "" {
+		peerKey = config.PeerPublic
+	}
+	if privateKey == "" {
+		privateKey = config.PrivateKey
+	}
+
+	if peerKey != "" {
+		key, err := ParseWireGuardKey(peerKey)
+		if err != nil {
+			return WireGuardIdentity{}, fmt.Errorf("peer public key: %w", err)
+		}
+		identity.PeerPublic = key
+	}
+	if privateKey != "" {
+		key, err := ParseWireGuardKey(privateKey)
+		if err != nil {
+			return WireGuardIdentity{}, fmt.Errorf("private key: %w", err)
+		}
+		identity.PrivateKey = &key
+	}
+	if config.PresharedKey != "" {
+		key, err := ParseWireGuardKey(config.PresharedKey)
+		if err != nil {
+			return WireGuardIdentity{}, fmt.Errorf("preshared key: %w", err)
+		}
+		identity.PresharedKey = key
+	}
+
+	addressList := config.Addresses
+	if addresses != "" {
+		addressList = []string{addresses}
+	}
+	addrs, err := ParseWireGuardAddresses(addressList)
+	if err != nil {
+		return WireGuardIdentity{}, err
+	}
+	identity.Addresses = addrs
+	return identity, nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func randomKey(t *testing.T) ([32]byte, string) {
+	t.Helper()
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	return key, base64.StdEncoding.EncodeToString(key[:])
+}
+
+func writeWireGuardConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "wg0.conf")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	return path
+}
+
+func TestLoadWireGuardConfig(t *testing.T) {
+	path := writeWireGuardConfig(t, `# wgcf-profile.conf
+[Interface]
+PrivateKey = aGVsbG8td29ybGQtcHJpdmF0ZS1rZXktMzItYnl0ZXM=
+Address = 172.16.0.2/32, 2606:4700:110:8a36::1/128
+DNS = 1.1.1.1
+
+[Peer]
+PublicKey = bmXOC+F1FxEMF9dyiK2H5/1SUtzH0JuVo51h2wPfgyo=  # cloudflare
+AllowedIPs = 0.0.0.0/0
+Endpoint = engage.cloudflareclient.com:2408
+
+[Peer]
+PublicKey = ignored-second-peer
+`)
+
+	config, err := LoadWireGuardConfig(path)
+	if err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	if config.PrivateKey != "aGVsbG8td29ybGQtcHJpdmF0ZS1rZXktMzItYnl0ZXM=" {
+		t.Fatalf("unexpected private key: %q", config.PrivateKey)
+	}
+	if len(config.Addresses) != 2 || config.Addresses[1] != "2606:4700:110:8a36::1/128" {
+		t.Fatalf("unexpected addresses: %v", config.Addresses)
+	}
+	if config.PeerPublic != "bmXOC+F1FxEMF9dyiK2H5/1SUtzH0JuVo51h2wPfgyo=" {
+		t.Fatalf("unexpected peer key: %q", config.PeerPublic)
+	}
+	if config.Endpoint != "engage.cloudflareclient.com:2408" {
+		t.Fatalf("unexpected endpoint: %q", config.Endpoint)
+	}
+
+	addrs, err := ParseWireGuardAddresses(config.Addresses)
+	if err != nil || len(addrs) != 2 || addrs[0] != netip.MustParseAddr("172.16.0.2") {
+		t.Fatalf("unexpected tunnel addresses: %v err=%v", addrs, err)
+	}
+
+	peer, err := ParseWireGuardKey(config.PeerPublic)
+	if err != nil {
+		t.Fatalf("parse peer key: %v", err)
+	}
+	if peer != cloudflarePublicKey {
+		t.Fatalf("peer key mismatch: got=%x", peer)
+	}
+}
+
+func TestResolveWireGuardIdentity(t *testing.T) {
+	configPeer, configPeerStr := randomKey(t)
+	configPriv, configPrivStr := randomKey(t)
+	flagPeer, flagPeerStr := randomKey(t)
+	psk, pskStr := randomKey(t)
+	path := writeWireGuardConfig(t, "[Interface]\nPrivateKey = "+configPrivStr+
+		"\n[Peer]\nPublicKey = "+configPeerStr+"\nPresharedKey = "+pskStr+"\n")
+
+	testCases := []struct {
+		name       string
+		peerKey    string
+		privateKey string
+		configPath string
+		wantPeer   [32]byte
+		wantPriv   *[32]byte
+		wantPSK    [32]byte
+		wantErr    bool
+	}{
+		{name: "default", wantPeer: cloudflarePublicKey},
+		{name: "config", configPath: path, wantPeer: configPeer, wantPriv: &configPriv, wantPSK: psk},
+		{name: "flag_overrides_config", peerKey: flagPeerStr, configPath: path, wantPeer: flagPeer, wantPriv: &configPriv, wantPSK: psk},
+		{name: "short_key", peerKey: base64.StdEncoding.EncodeToString([]byte("short")), wantErr: true},
+		{name: "not_base64", privateKey: "not base64!", wantErr: true},
+		{name: "missing_config", configPath: filepath.Join(t.TempDir(), "missing.conf"), wantErr: true},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			identity, err := ResolveWireGuardIdentity(testCase.peerKey, testCase.privateKey, "", testCase.configPath)
+			if testCase.wantErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if identity.PeerPublic != testCase.wantPeer {
+				t.Fatalf("unexpected peer key: got=%x want=%x", identity.PeerPublic, testCase.wantPeer)
+			}
+			if (identity.PrivateKey == nil) != (testCase.wantPriv == nil) ||
+				(identity.PrivateKey != nil && *identity.PrivateKey != *testCase.wantPriv) {
+				t.Fatalf("unexpected private key: got=%v want=%v", identity.PrivateKey, testCase.wantPriv)
+			}
+			if identity.PresharedKey != testCase.wantPSK {
+				t.Fatalf("unexpected preshared key: got=%x want=%x", identity.PresharedKey, testCase.wantPSK)
+			}
+		})
+	}
+}
+
+func TestProbeWireGuardHandshakeWithIdentity(t *testing.T) {
+	responder := newTestResponder(t)
+	responder.psk, _ = randomKey(t)
+	priv, _ := randomKey(t)
+	identity := WireGuardIdentity{PeerPublic: responder.pub, PrivateKey: &priv, PresharedKey: responder.psk}
+	wantInitiator, _ := identity.PublicKey()
+
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer server.Close()
+
+	addr := server.LocalAddr().(*net.UDPAddr)
+	endpoint := Endpoint{IP: addr.IP.String(), Port: addr.Port, Probe: ProbeWireGuard}
+
+	probe := func(identity WireGuardIdentity) (ProbeSample, error) {
+		type outcome struct {
+			sample ProbeSample
+			err    error
+		}
+		done := make(chan outcome, 1)
+		go func() {
+			opts := ProbeOptions{WireGuard: WireGuardOptions{Identity: identity}}
+			sample, err := ProbeWireGuardHandshake(context.Background(), endpoint, 2*time.Second, opts)
+			done <- outcome{sample, err}
+		}()
+
+		buf := make([]byte, 256)
+		_ = server.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, from, err := server.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatalf("read initiation: %v", err)
+		}
+		if _, err := server.WriteToUDP(responder.respond(t, buf[:n]), from); err != nil {
+			t.Fatalf("write response: %v", err)
+		}
+		result := <-done
+		return result.sample, result.err
+	}
+
+	sample, err := probe(identity)
+	if err != nil {
+		t.Fatalf("probe failed: %v", err)
+	}
+	if sample.Latency <= 0 {
+		t.Fatalf("non-positive latency: %v", sample.Latency)
+	}
+	if responder.last.initiator != wantInitiator {
+		t.Fatalf("responder saw initiator %x, want configured %x", responder.last.initiator, wantInitiator)
+	}
+
+	// PSK 不一致时响应无法通过 Noise 校验
+	wrongPSK := identity
+	wrongPSK.PresharedKey = [32]byte{}
+	if _, err := probe(wrongPSK); !errors.Is(err, errResponseAEAD) {
+		t.Fatalf("unexpected error with wrong psk: %v", err)
+	}
+}
@@ -17,6 +17,9 @@ TOTAL_TIMEOUT="${WARP_PROBE_TIMEOUT:-30s}"
 PROBE_CONCURRENCY="${WARP_PROBE_CONCURRENCY:-400}"
 PROBE_ROUNDS="${WARP_PROBE_ROUNDS:-3}"
 PROBE_SAMPLE="${WARP_PROBE_SAMPLE:-0}"
+PROBE_SOURCE_PORT="${WARP_PROBE_SOURCE_PORT:-random}"
+PROBE_PROGRESS_INTERVAL="${WARP_PROBE_PROGRESS_INTERVAL:-2s}"
+PROBE_API_CHECK="${WARP_PROBE_API_CHECK:-mark}"
 
 mkdir -p "$LOG_DIR"
 
@@ -71,10 +74,13 @@ run_probe() {
   local csv_file
   csv_file=$(mktemp /tmp/warp-probe.XXXXXX.csv)
 
-  local command=("$PROBE_BIN" "-mode" "$mode" "-n" "$PROBE_CONCURRENCY" "-timeout" "$TOTAL_TIMEOUT" "-rounds" "$PROBE_ROUNDS" "-sample" "$PROBE_SAMPLE" "-o" "$csv_file")
+  local command=("$PROBE_BIN" "-mode" "$mode" "-n" "$PROBE_CONCURRENCY" "-timeout" "$TOTAL_TIMEOUT" "-rounds" "$PROBE_ROUNDS" "-sample" "$PROBE_SAMPLE" "-sport" "$PROBE_SOURCE_PORT" "-progress" "$PROBE_PROGRESS_INTERVAL" "-progress-format" "json" "-o" "$csv_file")
   if [ -n "$target" ]; then
     command+=("-target" "$target")
   fi
+  if [ "$mode" = "api" ]; then
+    command+=("-api-check" "$PROBE_API_CHECK")
+  fi
   if [ "$WARP_IPV6_SELECTION" = "true" ]; then
     command+=("-6")
   fi